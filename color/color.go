@@ -0,0 +1,35 @@
+package color
+
+import "os"
+
+const (
+	reset = "\033[0m"
+	red   = "\033[31m"
+)
+
+// Enabled controls whether diagnostics are wrapped in ANSI escape codes.
+// It is set once at startup by the CLI and only read afterwards.
+var Enabled = false
+
+// Detect reports whether colored output makes sense for f: it must be a
+// terminal and the NO_COLOR convention must not be set.
+func Detect(f *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+func Red(s string) string { return wrap(red, s) }
+
+func wrap(code, s string) string {
+	if !Enabled {
+		return s
+	}
+	return code + s + reset
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// CONFORMANCE_ENV makes the test binary act as the hydor command, so the
+// harness can run it as a child process and observe its streams and exit
+// code.
+const CONFORMANCE_ENV = "HYDOR_CONFORMANCE_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(CONFORMANCE_ENV) == "1" {
+		os.Exit(runCLI(os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+// expectation is what a conformance script says running it should do.
+// Scripts state it in comments:
+//
+//	// run: disasm -O0       command and flags (default: run)
+//	// expect: 3             next line of stdout
+//	// expect error: ...     next line of stderr
+//	// expect exit: 65       exit code (default: 0)
+//
+// Lines are compared with trailing whitespace removed.
+type expectation struct {
+	args   []string
+	stdout []string
+	stderr []string
+	exit   int
+}
+
+func parseExpectation(t *testing.T, path string) expectation {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	exp := expectation{args: []string{"run"}, stdout: []string{}, stderr: []string{}}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.Index(line, "// ")
+		if i < 0 {
+			continue
+		}
+		directive := line[i+len("// "):]
+
+		if rest, ok := cutDirective(directive, "run:"); ok {
+			exp.args = strings.Fields(rest)
+		} else if rest, ok := cutDirective(directive, "expect:"); ok {
+			exp.stdout = append(exp.stdout, rest)
+		} else if rest, ok := cutDirective(directive, "expect error:"); ok {
+			exp.stderr = append(exp.stderr, rest)
+		} else if rest, ok := cutDirective(directive, "expect exit:"); ok {
+			exp.exit, err = strconv.Atoi(strings.TrimSpace(rest))
+			if err != nil {
+				t.Fatalf("%s: bad exit code %q", path, rest)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return exp
+}
+
+// cutDirective strips name and the single space after it, keeping any
+// further leading space as part of the expected text.
+func cutDirective(s, name string) (string, bool) {
+	rest, ok := strings.CutPrefix(s, name)
+	if !ok {
+		return "", false
+	}
+	return strings.TrimRight(strings.TrimPrefix(rest, " "), " \t"), true
+}
+
+func outputLines(b []byte) []string {
+	lines := []string{}
+	for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+		lines = append(lines, strings.TrimRight(line, " \t"))
+	}
+	if len(lines) == 1 && lines[0] == "" {
+		return []string{}
+	}
+	return lines
+}
+
+func TestConformance(t *testing.T) {
+	scripts, err := filepath.Glob(filepath.Join("testdata", "*", "*.hd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scripts) == 0 {
+		t.Fatal("no conformance scripts found")
+	}
+
+	for _, script := range scripts {
+		name := strings.TrimSuffix(filepath.ToSlash(script), ".hd")
+		t.Run(strings.TrimPrefix(name, "testdata/"), func(t *testing.T) {
+			t.Parallel()
+			exp := parseExpectation(t, script)
+
+			// Running from the script's directory keeps paths in
+			// tracebacks and headers short and stable.
+			cmd := exec.Command(os.Args[0], append([]string{"--no-color"}, append(exp.args, filepath.Base(script))...)...)
+			cmd.Dir = filepath.Dir(script)
+			cmd.Env = append(os.Environ(), CONFORMANCE_ENV+"=1")
+			var stdout, stderr bytes.Buffer
+			cmd.Stdout = &stdout
+			cmd.Stderr = &stderr
+
+			exit := 0
+			if err := cmd.Run(); err != nil {
+				var exitErr *exec.ExitError
+				if !errors.As(err, &exitErr) {
+					t.Fatal(err)
+				}
+				exit = exitErr.ExitCode()
+			}
+
+			compareLines(t, "stdout", exp.stdout, outputLines(stdout.Bytes()))
+			compareLines(t, "stderr", exp.stderr, outputLines(stderr.Bytes()))
+			if exit != exp.exit {
+				t.Errorf("exit code = %d, want %d", exit, exp.exit)
+			}
+		})
+	}
+}
+
+func compareLines(t *testing.T, stream string, want, got []string) {
+	t.Helper()
+	for i := 0; i < max(len(want), len(got)); i++ {
+		switch {
+		case i >= len(got):
+			t.Errorf("%s line %d missing, want %q", stream, i+1, want[i])
+		case i >= len(want):
+			t.Errorf("%s line %d unexpected: %q", stream, i+1, got[i])
+		case want[i] != got[i]:
+			t.Errorf("%s line %d:\n got: %q\nwant: %q", stream, i+1, got[i], want[i])
+		}
+	}
+}
+
+// runHydor runs the hydor command in dir and returns its combined output
+// and exit code.
+func runHydor(t *testing.T, dir string, args ...string) (string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], append([]string{"--no-color"}, args...)...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), CONFORMANCE_ENV+"=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			t.Fatal(err)
+		}
+		return string(out), exitErr.ExitCode()
+	}
+	return string(out), 0
+}
+
+// TestStaleBytecode checks that a .hdc file is refused once the source it
+// was built from changes, and still runs when the source is absent.
+func TestStaleBytecode(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "stale.hd")
+	hydor := func(args ...string) (string, int) {
+		t.Helper()
+		return runHydor(t, dir, args...)
+	}
+
+	if err := os.WriteFile(source, []byte("1 + 2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if out, exit := hydor("build", "stale.hd"); exit != 0 {
+		t.Fatalf("build exited with %d: %s", exit, out)
+	}
+	if out, exit := hydor("run", "stale.hdc"); exit != 0 || out != "3\n" {
+		t.Fatalf("fresh run exited with %d printing %q", exit, out)
+	}
+
+	// The source is found relative to the .hdc file, not to where hydor
+	// runs or where the file was built from.
+	if err := os.Mkdir(filepath.Join(dir, "out"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if out, exit := hydor("build", "stale.hd", "-o", filepath.Join("out", "moved.hdc")); exit != 0 {
+		t.Fatalf("build into another directory exited with %d: %s", exit, out)
+	}
+
+	if err := os.WriteFile(source, []byte("1 + 3\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if out, exit := hydor("run", "stale.hdc"); exit != EXIT_COMPILE_ERROR || !strings.Contains(out, "has changed since") {
+		t.Errorf("stale run exited with %d printing %q", exit, out)
+	}
+	if out, exit := runHydor(t, filepath.Join(dir, "out"), "run", "moved.hdc"); exit != EXIT_COMPILE_ERROR || !strings.Contains(out, "has changed since") {
+		t.Errorf("stale run from the .hdc's directory exited with %d printing %q", exit, out)
+	}
+	if out, exit := runHydor(t, t.TempDir(), "run", filepath.Join(dir, "stale.hdc")); exit != EXIT_COMPILE_ERROR || !strings.Contains(out, "has changed since") {
+		t.Errorf("stale run from elsewhere exited with %d printing %q", exit, out)
+	}
+
+	if err := os.Remove(source); err != nil {
+		t.Fatal(err)
+	}
+	if out, exit := hydor("run", "stale.hdc"); exit != 0 || out != "3\n" {
+		t.Errorf("run without the source exited with %d printing %q", exit, out)
+	}
+}
@@ -0,0 +1,59 @@
+// Package framing reads and writes the Content-Length framed messages used
+// by both the Debug Adapter Protocol and the Language Server Protocol.
+package framing
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// MAX_MESSAGE_SIZE bounds the body of an incoming message so a corrupt
+// Content-Length cannot trigger a huge allocation.
+const MAX_MESSAGE_SIZE = 16 << 20
+
+// ReadMessage reads one Content-Length framed message body.
+func ReadMessage(r *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+
+		name, val, found := strings.Cut(line, ":")
+		if found && strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			if length, err = strconv.Atoi(strings.TrimSpace(val)); err != nil {
+				return nil, fmt.Errorf("invalid Content-Length '%s'", strings.TrimSpace(val))
+			}
+		}
+	}
+
+	if length < 0 {
+		return nil, fmt.Errorf("message has no Content-Length header")
+	}
+	if length > MAX_MESSAGE_SIZE {
+		return nil, fmt.Errorf("message of %d bytes exceeds the %d byte limit", length, MAX_MESSAGE_SIZE)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// WriteMessage frames body with its Content-Length header.
+func WriteMessage(w io.Writer, body []byte) error {
+	if _, err := fmt.Fprintf(w, "Content-Length: %d\r\n\r\n", len(body)); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
@@ -0,0 +1,61 @@
+package framing
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	messages := []string{`{"a":1}`, ``, `{"text":"héllo"}`}
+	for _, m := range messages {
+		if err := WriteMessage(&buf, []byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := bufio.NewReader(&buf)
+	for _, want := range messages {
+		got, err := ReadMessage(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("ReadMessage = %q, want %q", got, want)
+		}
+	}
+	if _, err := ReadMessage(r); err != io.EOF {
+		t.Errorf("ReadMessage at end = %v, want io.EOF", err)
+	}
+}
+
+func TestReadMessageHeaders(t *testing.T) {
+	input := "content-length: 2\r\nContent-Type: application/json\r\n\r\n{}"
+	got, err := ReadMessage(bufio.NewReader(strings.NewReader(input)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "{}" {
+		t.Errorf("ReadMessage = %q, want %q", got, "{}")
+	}
+}
+
+func TestReadMessageErrors(t *testing.T) {
+	tests := map[string]string{
+		"no length":    "Content-Type: x\r\n\r\n{}",
+		"bad length":   "Content-Length: two\r\n\r\n{}",
+		"too large":    "Content-Length: 999999999\r\n\r\n",
+		"short body":   "Content-Length: 10\r\n\r\n{}",
+		"no separator": "Content-Length: 2\r\n",
+	}
+	for name, input := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ReadMessage(bufio.NewReader(strings.NewReader(input))); err == nil {
+				t.Error("ReadMessage succeeded, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+// Package ast defines the syntax tree the parser builds and the code
+// generator compiles. Every node keeps the tokens it was parsed from, so
+// later stages can point at exact source positions.
+package ast
+
+import (
+	"fmt"
+
+	"github.com/caelondev/hydor/frontend/tokens"
+	"github.com/caelondev/hydor/runtime/value"
+)
+
+// Expr is any expression node. Pos is the expression's first token and End
+// its last.
+//
+// A tree built from source with a syntax error is cut short where the
+// error was found: any child expression may then be nil.
+type Expr interface {
+	Pos() tokens.Token
+	End() tokens.Token
+	exprNode()
+}
+
+// Program is a whole script: a single expression followed by the end of
+// the source.
+type Program struct {
+	Expr Expr
+	EOF  tokens.Token
+}
+
+// Literal is a number, string, true, false or nil.
+type Literal struct {
+	Token tokens.Token
+	Value value.Value
+}
+
+// Variable is a name, resolved by the code generator.
+type Variable struct {
+	Name tokens.Token
+}
+
+type Grouping struct {
+	LeftParen  tokens.Token
+	Expr       Expr
+	RightParen tokens.Token
+}
+
+// Unary is '-' or '!' applied to an operand.
+type Unary struct {
+	Operator tokens.Token
+	Operand  Expr
+}
+
+type Binary struct {
+	Left     Expr
+	Operator tokens.Token
+	Right    Expr
+}
+
+// Property reads a named property, as in e.message.
+type Property struct {
+	Object Expr
+	Dot    tokens.Token
+	Name   tokens.Token
+}
+
+type Throw struct {
+	Keyword tokens.Token
+	Value   Expr
+}
+
+// Try is try { Body } with a Catch clause, a Finally clause or both.
+type Try struct {
+	Keyword tokens.Token
+	Body    *Block
+	Catch   *Catch
+	Finally *Finally
+}
+
+// Catch is catch (Name) { Body }.
+type Catch struct {
+	Keyword    tokens.Token
+	Name       tokens.Token
+	RightParen tokens.Token
+	Body       *Block
+}
+
+type Finally struct {
+	Keyword tokens.Token
+	Body    *Block
+}
+
+// Block is a braced expression belonging to a try, catch or finally.
+type Block struct {
+	LeftBrace  tokens.Token
+	Expr       Expr
+	RightBrace tokens.Token
+}
+
+func (e *Literal) Pos() tokens.Token  { return e.Token }
+func (e *Variable) Pos() tokens.Token { return e.Name }
+func (e *Grouping) Pos() tokens.Token { return e.LeftParen }
+func (e *Unary) Pos() tokens.Token    { return e.Operator }
+func (e *Binary) Pos() tokens.Token   { return Pos(e.Left, e.Operator) }
+func (e *Property) Pos() tokens.Token { return Pos(e.Object, e.Dot) }
+func (e *Throw) Pos() tokens.Token    { return e.Keyword }
+func (e *Try) Pos() tokens.Token      { return e.Keyword }
+
+func (e *Literal) End() tokens.Token  { return e.Token }
+func (e *Variable) End() tokens.Token { return e.Name }
+func (e *Grouping) End() tokens.Token { return e.RightParen }
+func (e *Unary) End() tokens.Token    { return End(e.Operand, e.Operator) }
+func (e *Binary) End() tokens.Token   { return End(e.Right, e.Operator) }
+func (e *Property) End() tokens.Token { return e.Name }
+func (e *Throw) End() tokens.Token    { return End(e.Value, e.Keyword) }
+
+func (e *Try) End() tokens.Token {
+	blocks := e.Blocks()
+	if len(blocks) == 0 {
+		return e.Keyword
+	}
+	return blocks[len(blocks)-1].RightBrace
+}
+
+func (*Literal) exprNode()  {}
+func (*Variable) exprNode() {}
+func (*Grouping) exprNode() {}
+func (*Unary) exprNode()    {}
+func (*Binary) exprNode()   {}
+func (*Property) exprNode() {}
+func (*Throw) exprNode()    {}
+func (*Try) exprNode()      {}
+
+// Pos returns e's first token, or fallback when e is missing.
+func Pos(e Expr, fallback tokens.Token) tokens.Token {
+	if e == nil {
+		return fallback
+	}
+	return e.Pos()
+}
+
+// End returns e's last token, or fallback when e is missing.
+func End(e Expr, fallback tokens.Token) tokens.Token {
+	if e == nil {
+		return fallback
+	}
+	return e.End()
+}
+
+// Error is a compile error and the token it was reported at.
+type Error struct {
+	At      tokens.Token
+	Message string
+	// Offset is where in the source the error was found. It is normally
+	// where At starts, but the lexer reads a token ahead, so a bad token
+	// is found while the one before it is being parsed.
+	Offset int
+}
+
+func (e *Error) Error() string {
+	switch e.At.Type {
+	case tokens.TOKEN_EOF:
+		return fmt.Sprintf("[line %d] Error at end: %s", e.At.Line, e.Message)
+	case tokens.TOKEN_ERROR:
+		return fmt.Sprintf("[line %d] Error: %s", e.At.Line, e.Message)
+	default:
+		return fmt.Sprintf("[line %d] Error at '%s': %s", e.At.Line, e.At.Lexeme, e.Message)
+	}
+}
+
+// Before reports whether e was found earlier in the source than other.
+// A nil error comes after every other.
+func (e *Error) Before(other *Error) bool {
+	if e == nil {
+		return false
+	}
+	return other == nil || e.Offset < other.Offset
+}
+
+// Walk calls visit for e and each expression below it, parents first. It
+// skips the children of any node for which visit returns false.
+func Walk(e Expr, visit func(Expr) bool) {
+	if e == nil || !visit(e) {
+		return
+	}
+
+	switch e := e.(type) {
+	case *Grouping:
+		Walk(e.Expr, visit)
+	case *Unary:
+		Walk(e.Operand, visit)
+	case *Binary:
+		Walk(e.Left, visit)
+		Walk(e.Right, visit)
+	case *Property:
+		Walk(e.Object, visit)
+	case *Throw:
+		Walk(e.Value, visit)
+	case *Try:
+		for _, b := range e.Blocks() {
+			Walk(b.Expr, visit)
+		}
+	}
+}
+
+// Blocks returns the try's blocks that were parsed, in source order.
+func (e *Try) Blocks() []*Block {
+	blocks := []*Block{}
+	if e.Body != nil {
+		blocks = append(blocks, e.Body)
+	}
+	if e.Catch != nil && e.Catch.Body != nil {
+		blocks = append(blocks, e.Catch.Body)
+	}
+	if e.Finally != nil && e.Finally.Body != nil {
+		blocks = append(blocks, e.Finally.Body)
+	}
+	return blocks
+}
@@ -1,30 +1,194 @@
 package bytecode
 
-import "github.com/caelondev/hydor/runtime/value"
+import (
+	"math"
+
+	"github.com/caelondev/hydor/runtime/value"
+)
 
 type OpCode byte
 const (
 	OP_CONSTANT OpCode = iota
+	OP_CONSTANT_LONG
 	OP_NIL
 	OP_TRUE
 	OP_FALSE
 	OP_EQUAL
+	OP_NOT_EQUAL
 	OP_GREATER
+	OP_GREATER_EQUAL
 	OP_LESS
+	OP_LESS_EQUAL
 	OP_NOT
 	OP_ADD
+	OP_ADD_CONSTANT
 	OP_SUBTRACT
 	OP_MULTIPLY
 	OP_DIVIDE
 	OP_MODULO
 	OP_NEGATE
+	OP_POP
+	OP_SWAP
+	OP_GET_LOCAL
+	OP_GET_PROPERTY
+	OP_GET_PROPERTY_LONG
+	OP_JUMP
+	OP_JUMP_IF_FALSE
+	OP_THROW
 	OP_RETURN
 )
 
+var opNames = [...]string{
+	OP_CONSTANT:      "OP_CONSTANT",
+	OP_CONSTANT_LONG: "OP_CONSTANT_LONG",
+	OP_NIL:           "OP_NIL",
+	OP_TRUE:          "OP_TRUE",
+	OP_FALSE:         "OP_FALSE",
+	OP_EQUAL:         "OP_EQUAL",
+	OP_NOT_EQUAL:     "OP_NOT_EQUAL",
+	OP_GREATER:       "OP_GREATER",
+	OP_GREATER_EQUAL: "OP_GREATER_EQUAL",
+	OP_LESS:          "OP_LESS",
+	OP_LESS_EQUAL:    "OP_LESS_EQUAL",
+	OP_NOT:           "OP_NOT",
+	OP_ADD:           "OP_ADD",
+	OP_ADD_CONSTANT:  "OP_ADD_CONSTANT",
+	OP_SUBTRACT:      "OP_SUBTRACT",
+	OP_MULTIPLY:      "OP_MULTIPLY",
+	OP_DIVIDE:        "OP_DIVIDE",
+	OP_MODULO:        "OP_MODULO",
+	OP_NEGATE:        "OP_NEGATE",
+	OP_POP:           "OP_POP",
+	OP_SWAP:          "OP_SWAP",
+	OP_GET_LOCAL:     "OP_GET_LOCAL",
+	OP_GET_PROPERTY:  "OP_GET_PROPERTY",
+	OP_GET_PROPERTY_LONG: "OP_GET_PROPERTY_LONG",
+	OP_JUMP:          "OP_JUMP",
+	OP_JUMP_IF_FALSE: "OP_JUMP_IF_FALSE",
+	OP_THROW:         "OP_THROW",
+	OP_RETURN:        "OP_RETURN",
+}
+
+func (op OpCode) String() string {
+	if int(op) < len(opNames) && opNames[op] != "" {
+		return opNames[op]
+	}
+	return "OP_UNKNOWN"
+}
+
+// OperandWidth returns the number of operand bytes that follow op in the
+// code stream, or -1 if op is not a known opcode.
+func OperandWidth(op OpCode) int {
+	switch op {
+	case OP_CONSTANT, OP_ADD_CONSTANT, OP_GET_LOCAL, OP_GET_PROPERTY:
+		return 1
+	case OP_JUMP, OP_JUMP_IF_FALSE:
+		return 2
+	case OP_CONSTANT_LONG, OP_GET_PROPERTY_LONG:
+		return 3
+	default:
+		if int(op) < len(opNames) {
+			return 0
+		}
+		return -1
+	}
+}
+
+// HasConstantOperand reports whether op's operand is a constant pool index.
+func HasConstantOperand(op OpCode) bool {
+	return op == OP_CONSTANT || op == OP_CONSTANT_LONG || op == OP_ADD_CONSTANT ||
+		op == OP_GET_PROPERTY || op == OP_GET_PROPERTY_LONG
+}
+
+// IsJump reports whether op transfers control to the offset encoded in its
+// operand.
+func IsJump(op OpCode) bool {
+	return op == OP_JUMP || op == OP_JUMP_IF_FALSE
+}
+
+// StackEffect is how many values an instruction pops and then pushes.
+type StackEffect struct {
+	Pops, Pushes int
+}
+
+var effects = [...]StackEffect{
+	OP_CONSTANT:      {0, 1},
+	OP_CONSTANT_LONG: {0, 1},
+	OP_NIL:           {0, 1},
+	OP_TRUE:          {0, 1},
+	OP_FALSE:         {0, 1},
+	OP_EQUAL:         {2, 1},
+	OP_NOT_EQUAL:     {2, 1},
+	OP_GREATER:       {2, 1},
+	OP_GREATER_EQUAL: {2, 1},
+	OP_LESS:          {2, 1},
+	OP_LESS_EQUAL:    {2, 1},
+	OP_NOT:           {1, 1},
+	OP_ADD:           {2, 1},
+	OP_ADD_CONSTANT:  {1, 1},
+	OP_SUBTRACT:      {2, 1},
+	OP_MULTIPLY:      {2, 1},
+	OP_DIVIDE:        {2, 1},
+	OP_MODULO:        {2, 1},
+	OP_NEGATE:        {1, 1},
+	OP_POP:           {1, 0},
+	OP_SWAP:          {2, 2},
+	OP_GET_LOCAL:     {0, 1},
+	OP_GET_PROPERTY:  {1, 1},
+	OP_GET_PROPERTY_LONG: {1, 1},
+	OP_JUMP:          {0, 0},
+	// The condition is only inspected; the compiler pops it explicitly.
+	OP_JUMP_IF_FALSE: {1, 1},
+	OP_THROW:         {1, 0},
+	OP_RETURN:        {1, 0},
+}
+
+// Effect returns the stack effect of op, which must be a known opcode.
+func Effect(op OpCode) StackEffect {
+	return effects[op]
+}
+
+// Handler routes errors raised by the instructions in [Start, End) to the
+// code at Target. The stack is cut back to Depth values above the frame's
+// base and the error is pushed before Target runs. Nested handlers come
+// before the handlers that enclose them.
+type Handler struct {
+	Start, End, Target, Depth int
+}
+
+// Local is debug information naming the stack slot, relative to the frame's
+// base, that holds a variable while the instructions in [Start, End) run.
+type Local struct {
+	Name             string
+	Slot, Start, End int
+}
+
+// UINT24_MAX is the largest constant index OP_CONSTANT_LONG can address.
+const UINT24_MAX = 1<<24 - 1
+
+// UINT16_MAX is the longest distance a jump can cover.
+const UINT16_MAX = 1<<16 - 1
+
 type Bytecode struct {
+	// File names the source the chunk was compiled from, for tracebacks.
+	// It is empty for code that did not come from a file.
+	File string
+
 	Code      []byte
 	Lines     []LineRun
 	Constants value.ValueArray
+	Handlers  []Handler
+	Locals    []Local
+
+	// constantIndex maps number and string constants to their slot so
+	// repeated literals share one pool entry.
+	constantIndex map[constantKey]int
+}
+
+type constantKey struct {
+	isString bool
+	bits     uint64
+	chars    string
 }
 
 type LineRun struct { Line, Count int }
@@ -37,9 +201,90 @@ func NewBytecode(src string) *Bytecode {
 	}
 }
 
+// AddConstant returns the pool index of v, reusing an existing slot when an
+// identical number or string is already in the pool.
 func (c *Bytecode) AddConstant(v value.Value) int {
+	key, dedupe := keyOf(v)
+	if dedupe {
+		if idx, ok := c.constantIndex[key]; ok {
+			return idx
+		}
+	}
+
 	c.Constants.Write(v)
-	return len(c.Constants.Values) - 1
+	idx := len(c.Constants.Values) - 1
+
+	if dedupe {
+		if c.constantIndex == nil {
+			c.constantIndex = make(map[constantKey]int)
+		}
+		c.constantIndex[key] = idx
+	}
+	return idx
+}
+
+// keyOf compares numbers by bit pattern so 0 and -0 stay distinct.
+func keyOf(v value.Value) (constantKey, bool) {
+	switch {
+	case v.IsNumber():
+		return constantKey{bits: math.Float64bits(v.AsNumber())}, true
+	case v.IsString():
+		return constantKey{isString: true, chars: v.AsCString()}, true
+	default:
+		return constantKey{}, false
+	}
+}
+
+// Truncate discards code from codeLen onwards and constants from poolLen
+// onwards, keeping the line table in step with the code.
+func (c *Bytecode) Truncate(codeLen, poolLen int) {
+	c.Code = c.Code[:codeLen]
+
+	remaining := codeLen
+	for i, run := range c.Lines {
+		if remaining <= run.Count {
+			if remaining == 0 {
+				c.Lines = c.Lines[:i]
+			} else {
+				c.Lines[i].Count = remaining
+				c.Lines = c.Lines[:i+1]
+			}
+			break
+		}
+		remaining -= run.Count
+	}
+
+	for _, v := range c.Constants.Values[poolLen:] {
+		if key, ok := keyOf(v); ok {
+			delete(c.constantIndex, key)
+		}
+	}
+	c.Constants.Values = c.Constants.Values[:poolLen]
+}
+
+// ReadUint16 decodes the little-endian 16-bit operand starting at offset.
+func ReadUint16(code []byte, offset int) int {
+	return int(code[offset]) | int(code[offset+1])<<8
+}
+
+// JumpTarget returns where the jump at offset lands. Jump offsets are
+// relative to the end of the instruction and only run forwards.
+func (c *Bytecode) JumpTarget(offset int) int {
+	return offset + 3 + ReadUint16(c.Code, offset+1)
+}
+
+// ReadUint24 decodes the little-endian 24-bit operand starting at offset.
+func ReadUint24(code []byte, offset int) int {
+	return int(code[offset]) | int(code[offset+1])<<8 | int(code[offset+2])<<16
+}
+
+// ConstantIndex returns the pool index referenced by the instruction at
+// offset, which must satisfy HasConstantOperand.
+func (c *Bytecode) ConstantIndex(offset int) int {
+	if op := OpCode(c.Code[offset]); op == OP_CONSTANT_LONG || op == OP_GET_PROPERTY_LONG {
+		return ReadUint24(c.Code, offset+1)
+	}
+	return int(c.Code[offset+1])
 }
 
 func (c *Bytecode) Write(b byte, line int) {
@@ -0,0 +1,19 @@
+package bytecode
+
+import (
+	"testing"
+
+	"github.com/caelondev/hydor/runtime/value"
+)
+
+func TestAddConstantShares(t *testing.T) {
+	bc := NewBytecode("")
+	a := bc.AddConstant(value.NumberVal(2))
+	b := bc.AddConstant(value.ObjVal(value.NewString("x").AsObj()))
+	if bc.AddConstant(value.NumberVal(2)) != a || bc.AddConstant(value.ObjVal(value.NewString("x").AsObj())) != b {
+		t.Error("equal constants were given separate slots")
+	}
+	if len(bc.Constants.Values) != 2 {
+		t.Errorf("pool has %d entries, want 2", len(bc.Constants.Values))
+	}
+}
@@ -0,0 +1,273 @@
+package bytecode
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+
+	"github.com/caelondev/hydor/runtime/value"
+)
+
+// Compiled bytecode files (.hdc) have the layout:
+//
+//	magic       "HYDC"
+//	version     uint16
+//	source hash [32]byte, SHA-256 of the source the chunk was compiled from
+//	file        uvarint length, then the source file name
+//	constants   uvarint count, then one tagged entry per constant
+//	code        uvarint length, then the raw code bytes
+//	lines       uvarint count, then (line, count) uvarint pairs
+//	handlers    uvarint count, then (start, end, target, depth) uvarint tuples
+//	locals      uvarint count, then per local its uvarint-prefixed name and
+//	            (slot, start, end) uvarints
+//	checksum    uint32, CRC-32 of every preceding byte
+//
+// All fixed-width integers are little endian.
+
+const FORMAT_MAGIC = "HYDC"
+const FORMAT_VERSION = 1
+
+const (
+	CONST_NIL byte = iota
+	CONST_FALSE
+	CONST_TRUE
+	CONST_NUMBER
+	CONST_STRING
+	CONST_FUNCTION
+)
+
+const headerSize = len(FORMAT_MAGIC) + 2 + sha256.Size
+const checksumSize = 4
+
+var ErrNotCompiled = errors.New("not a compiled Hydor file")
+
+type SourceHash [sha256.Size]byte
+
+func HashSource(source string) SourceHash {
+	return sha256.Sum256([]byte(source))
+}
+
+// IsCompiled reports whether data starts with the .hdc magic header.
+func IsCompiled(data []byte) bool {
+	return len(data) >= len(FORMAT_MAGIC) && string(data[:len(FORMAT_MAGIC)]) == FORMAT_MAGIC
+}
+
+func Marshal(bc *Bytecode, hash SourceHash) ([]byte, error) {
+	out := make([]byte, 0, headerSize+len(bc.Code)+16*len(bc.Constants.Values))
+	out = append(out, FORMAT_MAGIC...)
+	out = binary.LittleEndian.AppendUint16(out, FORMAT_VERSION)
+	out = append(out, hash[:]...)
+
+	out = binary.AppendUvarint(out, uint64(len(bc.File)))
+	out = append(out, bc.File...)
+
+	out = binary.AppendUvarint(out, uint64(len(bc.Constants.Values)))
+	for i, v := range bc.Constants.Values {
+		var err error
+		if out, err = appendConstant(out, v); err != nil {
+			return nil, fmt.Errorf("constant %d: %w", i, err)
+		}
+	}
+
+	out = binary.AppendUvarint(out, uint64(len(bc.Code)))
+	out = append(out, bc.Code...)
+
+	out = binary.AppendUvarint(out, uint64(len(bc.Lines)))
+	for _, run := range bc.Lines {
+		out = binary.AppendUvarint(out, uint64(run.Line))
+		out = binary.AppendUvarint(out, uint64(run.Count))
+	}
+
+	out = binary.AppendUvarint(out, uint64(len(bc.Handlers)))
+	for _, h := range bc.Handlers {
+		out = binary.AppendUvarint(out, uint64(h.Start))
+		out = binary.AppendUvarint(out, uint64(h.End))
+		out = binary.AppendUvarint(out, uint64(h.Target))
+		out = binary.AppendUvarint(out, uint64(h.Depth))
+	}
+
+	out = binary.AppendUvarint(out, uint64(len(bc.Locals)))
+	for _, l := range bc.Locals {
+		out = binary.AppendUvarint(out, uint64(len(l.Name)))
+		out = append(out, l.Name...)
+		out = binary.AppendUvarint(out, uint64(l.Slot))
+		out = binary.AppendUvarint(out, uint64(l.Start))
+		out = binary.AppendUvarint(out, uint64(l.End))
+	}
+
+	return binary.LittleEndian.AppendUint32(out, crc32.ChecksumIEEE(out)), nil
+}
+
+func appendConstant(out []byte, v value.Value) ([]byte, error) {
+	switch {
+	case v.IsNil():
+		return append(out, CONST_NIL), nil
+	case v.IsBool():
+		if v.AsBool() {
+			return append(out, CONST_TRUE), nil
+		}
+		return append(out, CONST_FALSE), nil
+	case v.IsNumber():
+		out = append(out, CONST_NUMBER)
+		return binary.LittleEndian.AppendUint64(out, math.Float64bits(v.AsNumber())), nil
+	case v.IsString():
+		chars := v.AsCString()
+		out = append(out, CONST_STRING)
+		out = binary.AppendUvarint(out, uint64(len(chars)))
+		return append(out, chars...), nil
+	default:
+		return nil, fmt.Errorf("cannot serialize %s constant", value.ValueTypeName(v))
+	}
+}
+
+// Unmarshal decodes a compiled file, rejecting anything that is truncated,
+// fails its checksum or was written by a different format version.
+func Unmarshal(data []byte) (*Bytecode, SourceHash, error) {
+	var hash SourceHash
+
+	if !IsCompiled(data) {
+		return nil, hash, ErrNotCompiled
+	}
+	if len(data) < headerSize+checksumSize {
+		return nil, hash, errors.New("truncated header")
+	}
+
+	version := binary.LittleEndian.Uint16(data[len(FORMAT_MAGIC):])
+	if version != FORMAT_VERSION {
+		return nil, hash, fmt.Errorf("unsupported format version %d, expected %d", version, FORMAT_VERSION)
+	}
+
+	body := data[:len(data)-checksumSize]
+	expected := binary.LittleEndian.Uint32(data[len(data)-checksumSize:])
+	if crc32.ChecksumIEEE(body) != expected {
+		return nil, hash, errors.New("checksum mismatch, file is corrupt")
+	}
+	copy(hash[:], body[len(FORMAT_MAGIC)+2:headerSize])
+
+	r := &reader{data: body, pos: headerSize}
+	bc := &Bytecode{Constants: *value.NewValueArray()}
+
+	bc.File = string(r.bytes(r.count("file name")))
+
+	count := r.count("constant")
+	for i := 0; i < count && r.err == nil; i++ {
+		bc.Constants.Write(r.constant())
+	}
+
+	bc.Code = r.bytes(r.count("code"))
+
+	runs := r.count("line")
+	bc.Lines = make([]LineRun, 0, runs)
+	total := 0
+	for i := 0; i < runs && r.err == nil; i++ {
+		run := LineRun{Line: r.int(), Count: r.int()}
+		total += run.Count
+		bc.Lines = append(bc.Lines, run)
+	}
+
+	handlers := r.count("handler")
+	for i := 0; i < handlers && r.err == nil; i++ {
+		bc.Handlers = append(bc.Handlers, Handler{Start: r.int(), End: r.int(), Target: r.int(), Depth: r.int()})
+	}
+
+	locals := r.count("local")
+	for i := 0; i < locals && r.err == nil; i++ {
+		name := string(r.bytes(r.count("local name")))
+		bc.Locals = append(bc.Locals, Local{Name: name, Slot: r.int(), Start: r.int(), End: r.int()})
+	}
+
+	if r.err != nil {
+		return nil, hash, r.err
+	}
+	if r.pos != len(body) {
+		return nil, hash, fmt.Errorf("%d trailing bytes", len(body)-r.pos)
+	}
+	if total != len(bc.Code) {
+		return nil, hash, fmt.Errorf("line table covers %d bytes but code has %d", total, len(bc.Code))
+	}
+
+	return bc, hash, nil
+}
+
+type reader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *reader) fail(format string, args ...interface{}) {
+	if r.err == nil {
+		r.err = fmt.Errorf(format, args...)
+	}
+}
+
+func (r *reader) int() int {
+	if r.err != nil {
+		return 0
+	}
+	n, size := binary.Uvarint(r.data[r.pos:])
+	if size <= 0 || n > math.MaxInt32 {
+		r.fail("malformed integer at byte %d", r.pos)
+		return 0
+	}
+	r.pos += size
+	return int(n)
+}
+
+// count reads a length prefix and checks it against the bytes left, so a
+// corrupt length cannot trigger a huge allocation.
+func (r *reader) count(what string) int {
+	n := r.int()
+	if n > len(r.data)-r.pos {
+		r.fail("%s count %d exceeds remaining data", what, n)
+		return 0
+	}
+	return n
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.data)-r.pos {
+		r.fail("unexpected end of data at byte %d", r.pos)
+		return nil
+	}
+	out := make([]byte, n)
+	copy(out, r.data[r.pos:r.pos+n])
+	r.pos += n
+	return out
+}
+
+func (r *reader) constant() value.Value {
+	tag := r.bytes(1)
+	if r.err != nil {
+		return value.NilVal()
+	}
+
+	switch tag[0] {
+	case CONST_NIL:
+		return value.NilVal()
+	case CONST_FALSE:
+		return value.BoolVal(false)
+	case CONST_TRUE:
+		return value.BoolVal(true)
+	case CONST_NUMBER:
+		raw := r.bytes(8)
+		if r.err != nil {
+			return value.NilVal()
+		}
+		return value.NumberVal(math.Float64frombits(binary.LittleEndian.Uint64(raw)))
+	case CONST_STRING:
+		chars := r.bytes(r.count("string"))
+		return value.ObjVal(value.NewString(string(chars)).AsObj())
+	case CONST_FUNCTION:
+		r.fail("function constants are not supported by this version of hydor")
+	default:
+		r.fail("unknown constant tag %d", tag[0])
+	}
+	return value.NilVal()
+}
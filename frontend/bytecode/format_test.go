@@ -0,0 +1,89 @@
+package bytecode
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/caelondev/hydor/runtime/value"
+)
+
+func sampleChunk() *Bytecode {
+	bc := NewBytecode("")
+	bc.File = "sample.hd"
+	bc.AddConstant(value.NumberVal(1.5))
+	bc.AddConstant(value.ObjVal(value.NewString("héllo").AsObj()))
+	bc.Constants.Write(value.NilVal())
+	bc.Constants.Write(value.BoolVal(true))
+	for i, b := range []byte{byte(OP_CONSTANT), 0, byte(OP_CONSTANT), 1, byte(OP_THROW), byte(OP_GET_LOCAL), 0, byte(OP_RETURN)} {
+		bc.Write(b, 1+i/3)
+	}
+	bc.Handlers = []Handler{{Start: 0, End: 5, Target: 5, Depth: 1}}
+	bc.Locals = []Local{{Name: "e", Slot: 1, Start: 5, End: 7}}
+	return bc
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	bc := sampleChunk()
+	hash := HashSource("source")
+	data, err := Marshal(bc, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsCompiled(data) {
+		t.Fatal("IsCompiled is false for marshalled data")
+	}
+
+	got, gotHash, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotHash != hash {
+		t.Error("source hash changed")
+	}
+	if got.File != bc.File {
+		t.Errorf("File = %q, want %q", got.File, bc.File)
+	}
+	if !reflect.DeepEqual(got.Code, bc.Code) {
+		t.Errorf("Code = %v, want %v", got.Code, bc.Code)
+	}
+	if !reflect.DeepEqual(got.Lines, bc.Lines) {
+		t.Errorf("Lines = %v, want %v", got.Lines, bc.Lines)
+	}
+	if !reflect.DeepEqual(got.Handlers, bc.Handlers) {
+		t.Errorf("Handlers = %v, want %v", got.Handlers, bc.Handlers)
+	}
+	if !reflect.DeepEqual(got.Locals, bc.Locals) {
+		t.Errorf("Locals = %v, want %v", got.Locals, bc.Locals)
+	}
+	if len(got.Constants.Values) != len(bc.Constants.Values) {
+		t.Fatalf("%d constants, want %d", len(got.Constants.Values), len(bc.Constants.Values))
+	}
+	for i, want := range bc.Constants.Values {
+		if !value.ValuesEqual(got.Constants.Values[i], want) {
+			t.Errorf("constant %d differs", i)
+		}
+	}
+}
+
+func TestUnmarshalRejectsDamage(t *testing.T) {
+	data, err := Marshal(sampleChunk(), HashSource(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := Unmarshal([]byte("print 1")); err == nil {
+		t.Error("Unmarshal accepted source text")
+	}
+	for _, n := range []int{0, 4, len(data) / 2, len(data) - 1} {
+		if _, _, err := Unmarshal(data[:n]); err == nil {
+			t.Errorf("Unmarshal accepted data truncated to %d bytes", n)
+		}
+	}
+	for i := len(FORMAT_MAGIC); i < len(data); i++ {
+		damaged := append([]byte{}, data...)
+		damaged[i] ^= 0x40
+		if _, _, err := Unmarshal(damaged); err == nil {
+			t.Errorf("Unmarshal accepted data with byte %d flipped", i)
+		}
+	}
+}
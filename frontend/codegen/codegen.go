@@ -0,0 +1,368 @@
+// Package codegen compiles a syntax tree to bytecode.
+package codegen
+
+import (
+	"fmt"
+
+	"github.com/caelondev/hydor/frontend/ast"
+	"github.com/caelondev/hydor/frontend/bytecode"
+	"github.com/caelondev/hydor/frontend/tokens"
+	"github.com/caelondev/hydor/runtime/value"
+)
+
+const UINT8_MAX = 255
+
+type Generator struct {
+	chunk *bytecode.Bytecode
+	err   *ast.Error
+
+	// previous is the token code is being emitted for, which gives each
+	// byte its line. It is the last token of whatever has been compiled
+	// so far, as though the code were emitted while parsing.
+	previous tokens.Token
+
+	// fold collapses literal-only subexpressions into a single constant.
+	fold bool
+
+	// depth is how many values the code emitted so far leaves on the
+	// stack, which gives each local its slot.
+	depth  int
+	locals []local
+
+	// bindings gives names outside any scope a fixed value, which lets a
+	// debugger evaluate expressions against a paused program.
+	bindings map[string]value.Value
+}
+
+// local is a name bound to a stack slot, such as a catch variable.
+type local struct {
+	name string
+	slot int
+}
+
+func NewGenerator() *Generator {
+	return &Generator{fold: true}
+}
+
+// SetBindings makes each name in bindings evaluate to its value wherever
+// no local of the same name is in scope.
+func (g *Generator) SetBindings(bindings map[string]value.Value) {
+	g.bindings = bindings
+}
+
+// SetConstantFolding controls whether literal-only subexpressions are
+// collapsed while compiling. Folding is on by default.
+func (g *Generator) SetConstantFolding(enabled bool) {
+	g.fold = enabled
+}
+
+// Generate compiles program into chunk and returns the first error found.
+// A program cut short by a syntax error may still be generated, to find
+// any error that comes before the syntax error in the source.
+func (g *Generator) Generate(program *ast.Program, chunk *bytecode.Bytecode) *ast.Error {
+	g.chunk = chunk
+	g.err = nil
+	g.depth = 0
+	g.locals = g.locals[:0]
+
+	g.expression(program.Expr)
+	g.previous = program.EOF
+	g.emitReturn()
+
+	return g.err
+}
+
+func (g *Generator) error(msg string) {
+	if g.err == nil {
+		g.err = &ast.Error{At: g.previous, Message: msg, Offset: g.previous.Start}
+	}
+}
+
+func (g *Generator) emitByte(b byte) {
+	g.chunk.Write(b, g.previous.Line)
+}
+
+func (g *Generator) emitBytes(b1, b2 byte) {
+	g.emitByte(b1)
+	g.emitByte(b2)
+}
+
+// emitOp writes an opcode and tracks its effect on the stack depth. Any
+// operand bytes follow through emitByte.
+func (g *Generator) emitOp(op bytecode.OpCode) {
+	g.emitByte(byte(op))
+	effect := bytecode.Effect(op)
+	g.depth += effect.Pushes - effect.Pops
+}
+
+func (g *Generator) emitReturn() {
+	g.emitOp(bytecode.OP_RETURN)
+}
+
+func (g *Generator) emitConstant(v value.Value) {
+	idx := g.makeConstant(v)
+	if idx <= UINT8_MAX {
+		g.emitOp(bytecode.OP_CONSTANT)
+		g.emitByte(byte(idx))
+		return
+	}
+
+	g.emitOp(bytecode.OP_CONSTANT_LONG)
+	g.emitBytes(byte(idx), byte(idx>>8))
+	g.emitByte(byte(idx >> 16))
+}
+
+// emitJump writes a forward jump with a placeholder offset and returns
+// where the instruction starts, for patchJump.
+func (g *Generator) emitJump(op bytecode.OpCode) int {
+	g.emitOp(op)
+	g.emitBytes(0xff, 0xff)
+	return len(g.chunk.Code) - 3
+}
+
+// patchJump points the jump at offset to the next instruction emitted.
+func (g *Generator) patchJump(offset int) {
+	code := g.chunk.Code
+	jump := len(code) - offset - 3
+	if jump > bytecode.UINT16_MAX {
+		g.error("Too much code to jump over")
+	}
+
+	code[offset+1] = byte(jump)
+	code[offset+2] = byte(jump >> 8)
+}
+
+func (g *Generator) makeConstant(v value.Value) int {
+	idx := g.chunk.AddConstant(v)
+	if idx > bytecode.UINT24_MAX {
+		g.error("Too many constants")
+		return 0
+	}
+	return idx
+}
+
+// ---- Expressions ----
+
+// expression compiles e. Missing parts of a tree cut short by a syntax
+// error compile to nothing.
+func (g *Generator) expression(e ast.Expr) {
+	switch e := e.(type) {
+	case *ast.Literal:
+		g.literal(e)
+	case *ast.Variable:
+		g.variable(e)
+	case *ast.Grouping:
+		g.expression(e.Expr)
+	case *ast.Unary:
+		g.unary(e)
+	case *ast.Binary:
+		g.binary(e)
+	case *ast.Property:
+		g.property(e)
+	case *ast.Throw:
+		g.throw(e)
+	case *ast.Try:
+		g.try(e)
+	}
+}
+
+func (g *Generator) literal(e *ast.Literal) {
+	g.previous = e.Token
+	switch {
+	case e.Token.Type == tokens.TOKEN_FALSE:
+		g.emitOp(bytecode.OP_FALSE)
+	case e.Token.Type == tokens.TOKEN_TRUE:
+		g.emitOp(bytecode.OP_TRUE)
+	case e.Token.Type == tokens.TOKEN_NIL:
+		g.emitOp(bytecode.OP_NIL)
+	default:
+		g.emitConstant(e.Value)
+	}
+}
+
+func (g *Generator) variable(e *ast.Variable) {
+	g.previous = e.Name
+	name := e.Name.Lexeme
+	for i := len(g.locals) - 1; i >= 0; i-- {
+		if g.locals[i].name == name {
+			g.emitOp(bytecode.OP_GET_LOCAL)
+			g.emitByte(byte(g.locals[i].slot))
+			return
+		}
+	}
+	if v, ok := g.bindings[name]; ok {
+		g.emitConstant(v)
+		return
+	}
+	g.error(fmt.Sprintf("Undefined variable '%s'", name))
+}
+
+func (g *Generator) unary(e *ast.Unary) {
+	operand := g.mark()
+	g.expression(e.Operand)
+	g.previous = e.End()
+
+	if g.foldUnary(e.Operator.Type, operand) {
+		return
+	}
+
+	switch e.Operator.Type {
+	case tokens.TOKEN_MINUS:
+		g.emitOp(bytecode.OP_NEGATE)
+	case tokens.TOKEN_BANG:
+		g.emitOp(bytecode.OP_NOT)
+	}
+}
+
+func (g *Generator) binary(e *ast.Binary) {
+	left := g.mark()
+	g.expression(e.Left)
+	right := len(g.chunk.Code)
+	g.expression(e.Right)
+	g.previous = e.End()
+
+	if g.foldBinary(e.Operator.Type, left, right) {
+		return
+	}
+
+	switch e.Operator.Type {
+	case tokens.TOKEN_PLUS:
+		g.emitOp(bytecode.OP_ADD)
+	case tokens.TOKEN_MINUS:
+		g.emitOp(bytecode.OP_SUBTRACT)
+	case tokens.TOKEN_STAR:
+		g.emitOp(bytecode.OP_MULTIPLY)
+	case tokens.TOKEN_SLASH:
+		g.emitOp(bytecode.OP_DIVIDE)
+	case tokens.TOKEN_PERCENT:
+		g.emitOp(bytecode.OP_MODULO)
+
+	// !(a == b)
+	case tokens.TOKEN_BANG_EQUAL:
+		g.emitOp(bytecode.OP_EQUAL)
+		g.emitOp(bytecode.OP_NOT)
+	case tokens.TOKEN_EQUAL_EQUAL:
+		g.emitOp(bytecode.OP_EQUAL)
+	case tokens.TOKEN_GREATER:
+		g.emitOp(bytecode.OP_GREATER)
+	// !(a < b)
+	case tokens.TOKEN_GREATER_EQUAL:
+		g.emitOp(bytecode.OP_LESS)
+		g.emitOp(bytecode.OP_NOT)
+	case tokens.TOKEN_LESS:
+		g.emitOp(bytecode.OP_LESS)
+	// !(a > b)
+	case tokens.TOKEN_LESS_EQUAL:
+		g.emitOp(bytecode.OP_GREATER)
+		g.emitOp(bytecode.OP_NOT)
+	}
+}
+
+func (g *Generator) property(e *ast.Property) {
+	g.expression(e.Object)
+	g.previous = e.Name
+	idx := g.makeConstant(value.ObjVal(value.NewString(e.Name.Lexeme).AsObj()))
+	if idx <= UINT8_MAX {
+		g.emitOp(bytecode.OP_GET_PROPERTY)
+		g.emitByte(byte(idx))
+		return
+	}
+
+	g.emitOp(bytecode.OP_GET_PROPERTY_LONG)
+	g.emitBytes(byte(idx), byte(idx>>8))
+	g.emitByte(byte(idx >> 16))
+}
+
+func (g *Generator) throw(e *ast.Throw) {
+	g.expression(e.Value)
+	g.previous = e.End()
+	g.emitOp(bytecode.OP_THROW)
+	// Control never comes back, but the code that follows still expects
+	// the throw expression to have produced a value.
+	g.depth++
+}
+
+// try compiles
+//
+//	try { body } catch (name) { handler } finally { cleanup }
+//
+// The value is the body's, or the catch clause's if the body raised an
+// error. The cleanup runs on every path and its value is discarded; an
+// error that reaches it is raised again once it finishes.
+func (g *Generator) try(e *ast.Try) {
+	chunk := g.chunk
+	base := g.depth
+
+	start := len(chunk.Code)
+	g.block(e.Body)
+	bodyEnd := len(chunk.Code)
+
+	protectedEnd := bodyEnd
+	if c := e.Catch; c != nil {
+		skip := g.emitJump(bytecode.OP_JUMP)
+
+		g.previous = c.RightParen
+		if base > UINT8_MAX {
+			g.error("Expression too deeply nested to bind a catch variable")
+		}
+
+		// The handler pushes the error into the slot the body's value
+		// would have used.
+		target := len(chunk.Code)
+		g.depth = base + 1
+		g.locals = append(g.locals, local{c.Name.Lexeme, base})
+		g.block(c.Body)
+		g.locals = g.locals[:len(g.locals)-1]
+		chunk.Locals = append(chunk.Locals, bytecode.Local{
+			Name: c.Name.Lexeme, Slot: base, Start: target, End: len(chunk.Code),
+		})
+
+		g.emitOp(bytecode.OP_SWAP)
+		g.emitOp(bytecode.OP_POP)
+		protectedEnd = len(chunk.Code)
+		g.patchJump(skip)
+
+		chunk.Handlers = append(chunk.Handlers, bytecode.Handler{
+			Start: start, End: bodyEnd, Target: target, Depth: base,
+		})
+	}
+
+	if f := e.Finally; f != nil {
+		// Both ways into the cleanup leave a flag above the value or
+		// error saying whether to raise it again afterwards.
+		g.previous = f.Keyword
+		g.emitOp(bytecode.OP_FALSE)
+		normal := g.emitJump(bytecode.OP_JUMP)
+
+		target := len(chunk.Code)
+		g.depth = base + 1
+		g.emitOp(bytecode.OP_TRUE)
+		g.patchJump(normal)
+
+		g.block(f.Body)
+		g.emitOp(bytecode.OP_POP)
+
+		done := g.emitJump(bytecode.OP_JUMP_IF_FALSE)
+		g.emitOp(bytecode.OP_POP)
+		g.emitOp(bytecode.OP_THROW)
+
+		// The jump lands with the flag still above the value.
+		g.depth = base + 2
+		g.patchJump(done)
+		g.emitOp(bytecode.OP_POP)
+
+		chunk.Handlers = append(chunk.Handlers, bytecode.Handler{
+			Start: start, End: protectedEnd, Target: target, Depth: base,
+		})
+	}
+}
+
+// block compiles a braced expression, leaving its closing brace as the
+// token code after it is emitted for.
+func (g *Generator) block(b *ast.Block) {
+	if b == nil {
+		return
+	}
+	g.expression(b.Expr)
+	g.previous = b.RightBrace
+}
@@ -0,0 +1,163 @@
+package codegen
+
+import (
+	"math"
+
+	"github.com/caelondev/hydor/frontend/bytecode"
+	"github.com/caelondev/hydor/frontend/tokens"
+	"github.com/caelondev/hydor/runtime/value"
+)
+
+// mark records how much code and how many constants existed before an
+// operand was compiled, so a folded operand can be rolled back.
+type mark struct {
+	code, constants, depth int
+}
+
+func (g *Generator) mark() mark {
+	return mark{len(g.chunk.Code), len(g.chunk.Constants.Values), g.depth}
+}
+
+// literalAt returns the value loaded by the code between from and to when
+// that code is exactly one literal load.
+func (g *Generator) literalAt(from, to int) (value.Value, bool) {
+	chunk := g.chunk
+	if from >= to {
+		return value.Value{}, false
+	}
+
+	op := bytecode.OpCode(chunk.Code[from])
+	if from+1+bytecode.OperandWidth(op) != to {
+		return value.Value{}, false
+	}
+
+	switch op {
+	case bytecode.OP_CONSTANT, bytecode.OP_CONSTANT_LONG:
+		return chunk.Constants.Values[chunk.ConstantIndex(from)], true
+	case bytecode.OP_TRUE:
+		return value.BoolVal(true), true
+	case bytecode.OP_FALSE:
+		return value.BoolVal(false), true
+	case bytecode.OP_NIL:
+		return value.NilVal(), true
+	default:
+		return value.Value{}, false
+	}
+}
+
+// replaceWithLiteral rolls the chunk back to m and emits v in its place.
+func (g *Generator) replaceWithLiteral(m mark, v value.Value) {
+	g.chunk.Truncate(m.code, m.constants)
+	g.depth = m.depth
+
+	switch {
+	case v.IsNil():
+		g.emitOp(bytecode.OP_NIL)
+	case v.IsBool() && v.AsBool():
+		g.emitOp(bytecode.OP_TRUE)
+	case v.IsBool():
+		g.emitOp(bytecode.OP_FALSE)
+	default:
+		g.emitConstant(v)
+	}
+}
+
+// foldUnary collapses a unary operator applied to a literal. Negating a
+// non-number is left for the VM so the runtime error is preserved.
+func (g *Generator) foldUnary(op tokens.TokenType, m mark) bool {
+	if !g.fold {
+		return false
+	}
+
+	operand, ok := g.literalAt(m.code, len(g.chunk.Code))
+	if !ok {
+		return false
+	}
+
+	switch op {
+	case tokens.TOKEN_MINUS:
+		if !operand.IsNumber() {
+			return false
+		}
+		g.replaceWithLiteral(m, value.NumberVal(-operand.AsNumber()))
+	case tokens.TOKEN_BANG:
+		g.replaceWithLiteral(m, value.BoolVal(operand.IsFalsy()))
+	default:
+		return false
+	}
+	return true
+}
+
+// foldBinary collapses a binary operator whose operands are both literals.
+// Anything that would raise a runtime error is left unfolded.
+func (g *Generator) foldBinary(op tokens.TokenType, left mark, right int) bool {
+	if !g.fold {
+		return false
+	}
+
+	a, ok := g.literalAt(left.code, right)
+	if !ok {
+		return false
+	}
+	b, ok := g.literalAt(right, len(g.chunk.Code))
+	if !ok {
+		return false
+	}
+
+	folded, ok := evalBinary(op, a, b)
+	if !ok {
+		return false
+	}
+	g.replaceWithLiteral(left, folded)
+	return true
+}
+
+func evalBinary(op tokens.TokenType, a, b value.Value) (value.Value, bool) {
+	switch op {
+	case tokens.TOKEN_EQUAL_EQUAL:
+		return value.BoolVal(value.ValuesEqual(a, b)), true
+	case tokens.TOKEN_BANG_EQUAL:
+		return value.BoolVal(!value.ValuesEqual(a, b)), true
+	case tokens.TOKEN_PLUS:
+		if a.IsString() && b.IsString() {
+			str := value.NewString(a.AsCString() + b.AsCString())
+			return value.ObjVal(str.AsObj()), true
+		}
+	}
+
+	if !a.IsNumber() || !b.IsNumber() {
+		return value.Value{}, false
+	}
+	x, y := a.AsNumber(), b.AsNumber()
+
+	switch op {
+	case tokens.TOKEN_PLUS:
+		return value.NumberVal(x + y), true
+	case tokens.TOKEN_MINUS:
+		return value.NumberVal(x - y), true
+	case tokens.TOKEN_STAR:
+		return value.NumberVal(x * y), true
+	case tokens.TOKEN_SLASH:
+		if y == 0 {
+			return value.Value{}, false
+		}
+		return value.NumberVal(x / y), true
+	case tokens.TOKEN_PERCENT:
+		if y == 0 {
+			return value.Value{}, false
+		}
+		return value.NumberVal(math.Mod(x, y)), true
+
+	// These mirror the negated forms the VM evaluates, which differ from
+	// the direct comparison when an operand is NaN.
+	case tokens.TOKEN_GREATER:
+		return value.BoolVal(x > y), true
+	case tokens.TOKEN_GREATER_EQUAL:
+		return value.BoolVal(!(x < y)), true
+	case tokens.TOKEN_LESS:
+		return value.BoolVal(x < y), true
+	case tokens.TOKEN_LESS_EQUAL:
+		return value.BoolVal(!(x > y)), true
+	}
+	return value.Value{}, false
+}
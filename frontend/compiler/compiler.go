@@ -0,0 +1,94 @@
+package compiler
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/caelondev/hydor/color"
+	"github.com/caelondev/hydor/frontend/ast"
+	"github.com/caelondev/hydor/frontend/bytecode"
+	"github.com/caelondev/hydor/frontend/codegen"
+	"github.com/caelondev/hydor/frontend/lexer"
+	"github.com/caelondev/hydor/frontend/optimizer"
+	"github.com/caelondev/hydor/frontend/parser"
+	"github.com/caelondev/hydor/frontend/tokens"
+	"github.com/caelondev/hydor/frontend/verifier"
+	"github.com/caelondev/hydor/runtime/value"
+)
+
+type Options struct {
+	// File names the source for diagnostics and tracebacks.
+	File     string
+	Optimize optimizer.Level
+	// Errors receives compile diagnostics. Nil means stderr.
+	Errors io.Writer
+	// OnError, if set, is also given the compile error, whose token
+	// locates it exactly in the source.
+	OnError func(err *ast.Error)
+	// Bindings gives free names a fixed value instead of making them an
+	// error.
+	Bindings map[string]value.Value
+}
+
+func DefaultOptions() Options {
+	return Options{Optimize: optimizer.O1}
+}
+
+// Compile runs the whole front end over source: parsing, code generation,
+// verification and optimization. Diagnostics are written to opts.Errors.
+// Every call works on fresh state, so Compile is safe to call from many
+// goroutines at once.
+func Compile(source string, opts Options) (*bytecode.Bytecode, bool) {
+	errors := opts.Errors
+	if errors == nil {
+		errors = os.Stderr
+	}
+
+	tokenizer := lexer.NewTokenizer(source)
+	chunk := bytecode.NewBytecode(source)
+	chunk.File = opts.File
+	program, err := parser.NewParser().Parse(tokenizer)
+
+	generator := codegen.NewGenerator()
+	generator.SetConstantFolding(opts.Optimize >= optimizer.O1)
+	generator.SetBindings(opts.Bindings)
+	// Generating even a program cut short by a syntax error finds any
+	// error that comes before it in the source, which is the one to report.
+	if genErr := generator.Generate(program, chunk); genErr.Before(err) {
+		err = genErr
+	}
+
+	if err != nil {
+		report(errors, err)
+		if opts.OnError != nil {
+			opts.OnError(err)
+		}
+		return nil, false
+	}
+
+	if _, err := verifier.Verify(chunk); err != nil {
+		fmt.Fprintf(errors, "%s %s\n", color.Red("Verify Error:"), err.Error())
+		return nil, false
+	}
+	if opts.Optimize >= optimizer.O1 {
+		// The optimizer moves jumps, handlers and locals around, so its
+		// output is checked again rather than trusted.
+		optimizer.Optimize(chunk, opts.Optimize)
+		if _, err := verifier.Verify(chunk); err != nil {
+			fmt.Fprintf(errors, "%s %s\n", color.Red("Verify Error:"), err.Error())
+			return nil, false
+		}
+	}
+	return chunk, true
+}
+
+func report(w io.Writer, err *ast.Error) {
+	fmt.Fprintf(w, "[line %d] %s", err.At.Line, color.Red("Error"))
+	if err.At.Type == tokens.TOKEN_EOF {
+		fmt.Fprintf(w, " at end")
+	} else if err.At.Type != tokens.TOKEN_ERROR {
+		fmt.Fprintf(w, " at '%s'", err.At.Lexeme)
+	}
+	fmt.Fprintf(w, ": %s\n", err.Message)
+}
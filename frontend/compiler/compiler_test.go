@@ -0,0 +1,181 @@
+package compiler
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/caelondev/hydor/frontend/ast"
+	"github.com/caelondev/hydor/frontend/bytecode"
+	"github.com/caelondev/hydor/frontend/debug"
+	"github.com/caelondev/hydor/frontend/optimizer"
+	"github.com/caelondev/hydor/runtime/value"
+)
+
+// ops lists chunk's opcodes, skipping operands.
+func ops(chunk *bytecode.Bytecode) []bytecode.OpCode {
+	list := []bytecode.OpCode{}
+	for offset := 0; offset < len(chunk.Code); {
+		op := bytecode.OpCode(chunk.Code[offset])
+		list = append(list, op)
+		offset += 1 + bytecode.OperandWidth(op)
+	}
+	return list
+}
+
+func compile(t *testing.T, source string, level optimizer.Level) *bytecode.Bytecode {
+	t.Helper()
+	var errors strings.Builder
+	chunk, ok := Compile(source, Options{Optimize: level, Errors: &errors})
+	if !ok {
+		t.Fatalf("%q does not compile: %s", source, errors.String())
+	}
+	return chunk
+}
+
+func TestConstantFolding(t *testing.T) {
+	tests := []struct {
+		source string
+		want   value.Value
+	}{
+		{"(1*(46+(8-29)))/3", value.NumberVal(25.0 / 3)},
+		{"-(2 + 3)", value.NumberVal(-5)},
+		{`"a" + "b"`, value.ObjVal(value.NewString("ab").AsObj())},
+		{"1 < 2 == !false", value.BoolVal(true)},
+		{"7 % 4 >= 3", value.BoolVal(true)},
+	}
+
+	for _, tt := range tests {
+		chunk := compile(t, tt.source, optimizer.O1)
+		got := ops(chunk)
+		if !slices.Equal(got, []bytecode.OpCode{bytecode.OP_CONSTANT, bytecode.OP_RETURN}) &&
+			!slices.Equal(got, []bytecode.OpCode{bytecode.OP_TRUE, bytecode.OP_RETURN}) {
+			t.Errorf("%q compiles to %v, want a single constant", tt.source, got)
+			continue
+		}
+		if got[0] == bytecode.OP_CONSTANT {
+			if c := chunk.Constants.Values[chunk.Code[1]]; !value.ValuesEqual(c, tt.want) {
+				t.Errorf("%q folds to %v, want %v", tt.source, c, tt.want)
+			}
+		}
+	}
+}
+
+func TestFoldingKeepsRuntimeErrors(t *testing.T) {
+	for _, source := range []string{"1 / 0", "1 % 0", `"a" * 2`, `-"a"`, `1 + "a"`, `nil < nil`, `(1 / 0) + 2`} {
+		if got := ops(compile(t, source, optimizer.O1)); len(got) <= 2 {
+			t.Errorf("%q compiles to %v, want it left unfolded", source, got)
+		}
+	}
+}
+
+func TestOptimizationLevels(t *testing.T) {
+	source := "try { 1 } catch (e) { e != 1 }"
+
+	unoptimized := ops(compile(t, source, optimizer.O0))
+	if !slices.Contains(unoptimized, bytecode.OP_NOT) || slices.Contains(unoptimized, bytecode.OP_NOT_EQUAL) {
+		t.Errorf("-O0 output %v should keep OP_EQUAL, OP_NOT", unoptimized)
+	}
+	optimized := ops(compile(t, source, optimizer.O1))
+	if slices.Contains(optimized, bytecode.OP_NOT) || !slices.Contains(optimized, bytecode.OP_NOT_EQUAL) {
+		t.Errorf("-O1 output %v should fuse into OP_NOT_EQUAL", optimized)
+	}
+
+	if got := ops(compile(t, "1 + 2", optimizer.O0)); len(got) != 4 {
+		t.Errorf("-O0 should not fold 1 + 2, got %v", got)
+	}
+}
+
+func TestJumpThreading(t *testing.T) {
+	source := "try { try { 1 } catch (a) { 2 } } catch (b) { 3 }"
+	if targets := jumpTargets(compile(t, source, optimizer.O0)); !slices.Contains(targets, bytecode.OP_JUMP) {
+		t.Fatalf("-O0 output has no jump to a jump, targets %v", targets)
+	}
+	if targets := jumpTargets(compile(t, source, optimizer.O1)); slices.Contains(targets, bytecode.OP_JUMP) {
+		t.Errorf("-O1 output still jumps to a jump, targets %v", targets)
+	}
+}
+
+// jumpTargets lists the opcode each jump in chunk lands on.
+func jumpTargets(chunk *bytecode.Bytecode) []bytecode.OpCode {
+	targets := []bytecode.OpCode{}
+	for offset := 0; offset < len(chunk.Code); {
+		op := bytecode.OpCode(chunk.Code[offset])
+		if bytecode.IsJump(op) {
+			targets = append(targets, bytecode.OpCode(chunk.Code[chunk.JumpTarget(offset)]))
+		}
+		offset += 1 + bytecode.OperandWidth(op)
+	}
+	return targets
+}
+
+func TestLines(t *testing.T) {
+	chunk := compile(t, "1 +\n\n  (2 *\n  -nil)", optimizer.O0)
+	want := map[bytecode.OpCode]int{
+		bytecode.OP_NIL:      4,
+		bytecode.OP_NEGATE:   4,
+		bytecode.OP_MULTIPLY: 4,
+		bytecode.OP_ADD:      4,
+		bytecode.OP_RETURN:   4,
+	}
+	for offset := 0; offset < len(chunk.Code); {
+		op := bytecode.OpCode(chunk.Code[offset])
+		if line, ok := want[op]; ok && debug.GetLine(chunk, offset) != line {
+			t.Errorf("%s at %04d is on line %d, want %d", op, offset, debug.GetLine(chunk, offset), line)
+		}
+		offset += 1 + bytecode.OperandWidth(op)
+	}
+	if line := debug.GetLine(chunk, 0); line != 1 {
+		t.Errorf("first constant is on line %d, want 1", line)
+	}
+
+	// A fused instruction keeps the line of the operator it replaces.
+	chunk = compile(t, "nil < nil\n  != true", optimizer.O1)
+	for offset := 0; offset < len(chunk.Code); {
+		op := bytecode.OpCode(chunk.Code[offset])
+		if op == bytecode.OP_NOT_EQUAL && debug.GetLine(chunk, offset) != 2 {
+			t.Errorf("%s at %04d is on line %d, want 2", op, offset, debug.GetLine(chunk, offset))
+		}
+		offset += 1 + bytecode.OperandWidth(op)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := map[string]string{
+		"x": "[line 1] Error at 'x': Undefined variable 'x'",
+		// The lexer reads a token ahead, so '$' is found before 'x' is
+		// resolved.
+		"1 +\n  x $":                     "[line 2] Error: Unknown character found '$'",
+		"1 +\n  x 1":                     "[line 2] Error at 'x': Undefined variable 'x'",
+		"1 + $ x":                        "[line 1] Error: Unknown character found '$'",
+		"try { e } catch (e) { e }":      "[line 1] Error at 'e': Undefined variable 'e'",
+		"try { 1 } catch (e) { 1 } + e":  "[line 1] Error at 'e': Undefined variable 'e'",
+		"try { 1 } catch (e) { e } e":    "[line 1] Error at 'e': Expected end of file",
+		"try { 1 } catch (e) { f } + (1": "[line 1] Error at 'f': Undefined variable 'f'",
+	}
+
+	for source, want := range tests {
+		var got *ast.Error
+		_, ok := Compile(source, Options{Errors: io.Discard, OnError: func(err *ast.Error) { got = err }})
+		if ok {
+			t.Errorf("%q compiled, want %s", source, want)
+			continue
+		}
+		if got == nil || got.Error() != want {
+			t.Errorf("%q:\n got %v\nwant %s", source, got, want)
+		}
+	}
+}
+
+func TestBindings(t *testing.T) {
+	bindings := map[string]value.Value{"x": value.NumberVal(2)}
+	var errors strings.Builder
+	chunk, ok := Compile("try { x * 3 } catch (x) { x }", Options{Errors: &errors, Bindings: bindings})
+	if !ok {
+		t.Fatal(errors.String())
+	}
+	if got := ops(chunk); !slices.Contains(got, bytecode.OP_GET_LOCAL) {
+		t.Errorf("catch variable should shadow the binding, got %v", got)
+	}
+}
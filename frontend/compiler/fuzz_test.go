@@ -0,0 +1,87 @@
+package compiler
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caelondev/hydor/frontend/ast"
+	"github.com/caelondev/hydor/frontend/bytecode"
+	"github.com/caelondev/hydor/frontend/optimizer"
+	"github.com/caelondev/hydor/frontend/verifier"
+)
+
+// addSeeds seeds f with the conformance scripts and a few truncated
+// programs.
+func addSeeds(f *testing.F) {
+	scripts, _ := filepath.Glob(filepath.Join("..", "..", "testdata", "*", "*.hd"))
+	for _, path := range scripts {
+		if data, err := os.ReadFile(path); err == nil {
+			f.Add(string(data))
+		}
+	}
+	for _, s := range []string{"", "(", "1 +", "try {", "try { 1 } catch (", "throw", "-", "e.kind", "((((((((1))))))))"} {
+		f.Add(s)
+	}
+}
+
+// FuzzCompile checks that any source either compiles to a chunk the
+// verifier accepts or fails with a single located error, the same way
+// every time.
+func FuzzCompile(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, source string) {
+		for _, level := range []optimizer.Level{optimizer.O0, optimizer.O1} {
+			chunk, diagnostics, compileErr := compileFuzz(source, level)
+			again, diagnosticsAgain, compileErrAgain := compileFuzz(source, level)
+			if diagnostics != diagnosticsAgain || (chunk == nil) != (again == nil) {
+				t.Fatalf("-O%d: compiling twice gave %q, then %q", level, diagnostics, diagnosticsAgain)
+			}
+
+			if chunk == nil {
+				if compileErr == nil || compileErrAgain == nil {
+					t.Fatalf("-O%d: failed without reporting an error: %q", level, diagnostics)
+				}
+				if compileErr.Offset < 0 || compileErr.Offset > len(source) {
+					t.Fatalf("-O%d: error at offset %d in %d bytes", level, compileErr.Offset, len(source))
+				}
+				continue
+			}
+
+			if !bytes.Equal(chunk.Code, again.Code) {
+				t.Fatalf("-O%d: compiling twice gave different code", level)
+			}
+			if _, err := verifier.Verify(chunk); err != nil {
+				t.Fatalf("-O%d: compiled chunk does not verify: %v", level, err)
+			}
+
+			data, err := bytecode.Marshal(chunk, bytecode.HashSource(source))
+			if err != nil {
+				t.Fatalf("-O%d: Marshal: %v", level, err)
+			}
+			loaded, _, err := bytecode.Unmarshal(data)
+			if err != nil {
+				t.Fatalf("-O%d: Unmarshal: %v", level, err)
+			}
+			if !bytes.Equal(loaded.Code, chunk.Code) {
+				t.Fatalf("-O%d: code changed in a round trip", level)
+			}
+		}
+	})
+}
+
+func compileFuzz(source string, level optimizer.Level) (*bytecode.Bytecode, string, *ast.Error) {
+	var diagnostics strings.Builder
+	var compileErr *ast.Error
+	chunk, ok := Compile(source, Options{
+		Optimize: level,
+		Errors:   &diagnostics,
+		OnError:  func(err *ast.Error) { compileErr = err },
+	})
+	if !ok {
+		return nil, diagnostics.String(), compileErr
+	}
+	return chunk, diagnostics.String(), nil
+}
@@ -2,67 +2,119 @@ package debug
 
 import (
 	"fmt"
+	"io"
+	"os"
 
 	"github.com/caelondev/hydor/frontend/bytecode"
 	"github.com/caelondev/hydor/runtime/value"
 )
 
 func DisassembleBytecode(bc *bytecode.Bytecode, name string) {
-	fmt.Printf("\t===== %s =====\n", name)
+	FdisassembleBytecode(os.Stdout, bc, name)
+}
+
+func FdisassembleBytecode(w io.Writer, bc *bytecode.Bytecode, name string) {
+	fmt.Fprintf(w, "\t===== %s =====\n", name)
 
 	offset := 0
 	for offset < len(bc.Code) {
-    offset = DisassembleInstruction(bc, offset);
+    offset = FdisassembleInstruction(w, bc, offset);
   }
+
+	for _, h := range bc.Handlers {
+		fmt.Fprintf(w, "handler [%04d, %04d) -> %04d depth %d\n", h.Start, h.End, h.Target, h.Depth)
+	}
+	for _, l := range bc.Locals {
+		fmt.Fprintf(w, "local '%s' slot %d [%04d, %04d)\n", l.Name, l.Slot, l.Start, l.End)
+	}
 }
 
 func DisassembleInstruction(bc *bytecode.Bytecode, offset int) int {
+	return FdisassembleInstruction(os.Stdout, bc, offset)
+}
+
+func FdisassembleInstruction(w io.Writer, bc *bytecode.Bytecode, offset int) int {
 	line := GetLine(bc, offset)
-	fmt.Printf("%04d ", offset)
+	fmt.Fprintf(w, "%04d ", offset)
 
 	if offset > 0 && line == GetLine(bc, offset-1) {
-		fmt.Printf("   ^ ")
+		fmt.Fprintf(w, "   ^ ")
 	} else {
-		fmt.Printf("%4d ", line)
+		fmt.Fprintf(w, "%4d ", line)
 	}
 
 	instruction := bytecode.OpCode(bc.Code[offset])
 
 	switch instruction {
-	case bytecode.OP_CONSTANT: return constantInstruction("OP_CONSTANT", offset, bc)
-	case bytecode.OP_NEGATE: return simpleInstruction("OP_NEGATE", offset)
-
-	case bytecode.OP_TRUE: return simpleInstruction("OP_TRUE", offset)
-	case bytecode.OP_FALSE: return simpleInstruction("OP_FALSE", offset)
-	case bytecode.OP_NIL: return simpleInstruction("OP_NIL", offset)
-	case bytecode.OP_NOT: return simpleInstruction("OP_NOT", offset)
+	case bytecode.OP_CONSTANT: return constantInstruction(w, "OP_CONSTANT", offset, bc)
+	case bytecode.OP_CONSTANT_LONG: return constantLongInstruction(w, "OP_CONSTANT_LONG", offset, bc)
+	case bytecode.OP_NEGATE: return simpleInstruction(w, "OP_NEGATE", offset)
+
+	case bytecode.OP_TRUE: return simpleInstruction(w, "OP_TRUE", offset)
+	case bytecode.OP_FALSE: return simpleInstruction(w, "OP_FALSE", offset)
+	case bytecode.OP_NIL: return simpleInstruction(w, "OP_NIL", offset)
+	case bytecode.OP_NOT: return simpleInstruction(w, "OP_NOT", offset)
 	
-	case bytecode.OP_EQUAL: return simpleInstruction("OP_EQUAL", offset)
-	case bytecode.OP_LESS: return simpleInstruction("OP_LESS", offset)
-	case bytecode.OP_GREATER: return simpleInstruction("OP_GREATER", offset)
-
-	case bytecode.OP_ADD: return simpleInstruction("OP_ADD", offset)
-	case bytecode.OP_SUBTRACT: return simpleInstruction("OP_SUBTRACT", offset)
-	case bytecode.OP_MULTIPLY: return simpleInstruction("OP_MULTIPLY", offset)
-	case bytecode.OP_DIVIDE: return simpleInstruction("OP_DIVIDE", offset)
-
-	case bytecode.OP_RETURN: return simpleInstruction("OP_RETURN", offset)
+	case bytecode.OP_EQUAL: return simpleInstruction(w, "OP_EQUAL", offset)
+	case bytecode.OP_NOT_EQUAL: return simpleInstruction(w, "OP_NOT_EQUAL", offset)
+	case bytecode.OP_LESS: return simpleInstruction(w, "OP_LESS", offset)
+	case bytecode.OP_LESS_EQUAL: return simpleInstruction(w, "OP_LESS_EQUAL", offset)
+	case bytecode.OP_GREATER: return simpleInstruction(w, "OP_GREATER", offset)
+	case bytecode.OP_GREATER_EQUAL: return simpleInstruction(w, "OP_GREATER_EQUAL", offset)
+
+	case bytecode.OP_ADD: return simpleInstruction(w, "OP_ADD", offset)
+	case bytecode.OP_ADD_CONSTANT: return constantInstruction(w, "OP_ADD_CONSTANT", offset, bc)
+	case bytecode.OP_SUBTRACT: return simpleInstruction(w, "OP_SUBTRACT", offset)
+	case bytecode.OP_MULTIPLY: return simpleInstruction(w, "OP_MULTIPLY", offset)
+	case bytecode.OP_DIVIDE: return simpleInstruction(w, "OP_DIVIDE", offset)
+	case bytecode.OP_MODULO: return simpleInstruction(w, "OP_MODULO", offset)
+
+	case bytecode.OP_POP: return simpleInstruction(w, "OP_POP", offset)
+	case bytecode.OP_SWAP: return simpleInstruction(w, "OP_SWAP", offset)
+	case bytecode.OP_GET_LOCAL: return byteInstruction(w, "OP_GET_LOCAL", offset, bc)
+	case bytecode.OP_GET_PROPERTY: return constantInstruction(w, "OP_GET_PROPERTY", offset, bc)
+	case bytecode.OP_GET_PROPERTY_LONG: return constantLongInstruction(w, "OP_GET_PROPERTY_LONG", offset, bc)
+
+	case bytecode.OP_JUMP: return jumpInstruction(w, "OP_JUMP", offset, bc)
+	case bytecode.OP_JUMP_IF_FALSE: return jumpInstruction(w, "OP_JUMP_IF_FALSE", offset, bc)
+	case bytecode.OP_THROW: return simpleInstruction(w, "OP_THROW", offset)
+
+	case bytecode.OP_RETURN: return simpleInstruction(w, "OP_RETURN", offset)
 	default:
-		fmt.Printf("Unrecognized opcode '%d'\n", instruction)
+		fmt.Fprintf(w, "Unrecognized opcode '%d'\n", instruction)
 		return move(offset, 1)
 	}
 }
 
-func constantInstruction(name string, offset int, chunk *bytecode.Bytecode) int {
+func constantInstruction(w io.Writer, name string, offset int, chunk *bytecode.Bytecode) int {
 	constant := chunk.Code[offset+1]
-	fmt.Printf("%-12s %4d  ", name, constant)
-	value.PrintValue(chunk.Constants.Values[constant])
-	fmt.Println()
+	fmt.Fprintf(w, "%-12s %4d  ", name, constant)
+	value.FprintValue(w, chunk.Constants.Values[constant])
+	fmt.Fprintln(w)
+	return move(offset, 2)
+}
+
+func constantLongInstruction(w io.Writer, name string, offset int, chunk *bytecode.Bytecode) int {
+	constant := bytecode.ReadUint24(chunk.Code, offset+1)
+	fmt.Fprintf(w, "%-12s %4d  ", name, constant)
+	value.FprintValue(w, chunk.Constants.Values[constant])
+	fmt.Fprintln(w)
+	return move(offset, 4)
+}
+
+func byteInstruction(w io.Writer, name string, offset int, chunk *bytecode.Bytecode) int {
+	slot := chunk.Code[offset+1]
+	fmt.Fprintf(w, "%-12s %4d\n", name, slot)
 	return move(offset, 2)
 }
 
-func simpleInstruction(name string, offset int) int {
-	fmt.Printf("%-12s\n", name)
+func jumpInstruction(w io.Writer, name string, offset int, chunk *bytecode.Bytecode) int {
+	fmt.Fprintf(w, "%-12s %4d -> %d\n", name, offset, chunk.JumpTarget(offset))
+	return move(offset, 3)
+}
+
+func simpleInstruction(w io.Writer, name string, offset int) int {
+	fmt.Fprintf(w, "%-12s\n", name)
 	return move(offset, 1)
 }
 
@@ -0,0 +1,177 @@
+// Package formatter rewrites Hydor source in its canonical style, keeping
+// every comment.
+package formatter
+
+import "strings"
+
+// INDENT is one level of block indentation.
+const INDENT = "    "
+
+// Format returns source in canonical style: one space around binary
+// operators and between keywords and braces, none inside parentheses,
+// and every try, catch and finally block on its own indented lines.
+// Comments stay attached to the code they were next to, and a blank line
+// before a comment is kept. Formatting already formatted source changes
+// nothing.
+func Format(source string) (string, error) {
+	list, err := scan(source)
+	if err != nil {
+		return "", err
+	}
+	tree, err := parse(list)
+	if err != nil {
+		return "", err
+	}
+
+	p := &printer{lineStart: true}
+	p.node(tree.expr)
+	p.leading(tree.eof)
+	p.endLine()
+	return p.out.String(), nil
+}
+
+type printer struct {
+	out    strings.Builder
+	indent int
+
+	// lineStart is set when nothing has been written on the current line.
+	lineStart bool
+	// space asks for a space before whatever is written next on the line.
+	space bool
+	// mustBreak is set after a line comment, which nothing may follow on
+	// its line.
+	mustBreak bool
+}
+
+func (p *printer) write(text string) {
+	if p.mustBreak {
+		p.endLine()
+	}
+	if p.lineStart {
+		p.out.WriteString(strings.Repeat(INDENT, p.indent))
+	} else if p.space {
+		p.out.WriteByte(' ')
+	}
+	p.out.WriteString(text)
+	p.lineStart = false
+	p.space = false
+}
+
+// endLine finishes the current line, if anything is on it.
+func (p *printer) endLine() {
+	if !p.lineStart {
+		p.out.WriteByte('\n')
+	}
+	p.lineStart = true
+	p.space = false
+	p.mustBreak = false
+}
+
+func (p *printer) blankLine() {
+	p.endLine()
+	if p.out.Len() > 0 {
+		p.out.WriteByte('\n')
+	}
+}
+
+func (p *printer) comment(c comment) {
+	p.write(c.text)
+	if c.isLine() {
+		p.mustBreak = true
+	} else {
+		p.space = true
+	}
+}
+
+func (p *printer) leading(t *token) {
+	for _, c := range t.leading {
+		if c.ownLine {
+			if c.blankBefore {
+				p.blankLine()
+			}
+			p.endLine()
+			p.comment(c)
+			p.endLine()
+		} else {
+			p.space = true
+			p.comment(c)
+		}
+	}
+	if t.blankBefore {
+		p.blankLine()
+	}
+}
+
+func (p *printer) trailing(t *token) {
+	for _, c := range t.trailing {
+		p.space = true
+		p.comment(c)
+	}
+}
+
+// token writes t with its comments. Whether a space separates it from
+// what came before is up to the caller, through p.space.
+func (p *printer) token(t *token) {
+	p.leading(t)
+	p.write(t.text)
+	p.trailing(t)
+}
+
+func (p *printer) spaced(t *token) {
+	p.space = true
+	p.token(t)
+}
+
+// node writes n. Like token, it leaves the space before n to the caller.
+func (p *printer) node(n node) {
+	switch n := n.(type) {
+	case *leaf:
+		p.token(n.tok)
+	case *group:
+		p.token(n.open)
+		p.node(n.inner)
+		p.token(n.close)
+	case *unary:
+		p.token(n.op)
+		p.node(n.operand)
+	case *binary:
+		p.node(n.left)
+		p.spaced(n.op)
+		p.space = true
+		p.node(n.right)
+	case *property:
+		p.node(n.object)
+		p.token(n.dot)
+		p.token(n.name)
+	case *throwExpr:
+		p.token(n.keyword)
+		p.space = true
+		p.node(n.value)
+	case *tryExpr:
+		p.token(n.keyword)
+		p.block(n.body)
+		if c := n.catch; c != nil {
+			p.spaced(c.keyword)
+			p.spaced(c.open)
+			p.token(c.name)
+			p.token(c.close)
+			p.block(c.body)
+		}
+		if f := n.finally; f != nil {
+			p.spaced(f.keyword)
+			p.block(f.body)
+		}
+	}
+}
+
+func (p *printer) block(b *block) {
+	p.spaced(b.open)
+	p.indent++
+	p.endLine()
+	p.node(b.inner)
+	p.leading(b.close)
+	p.indent--
+	p.endLine()
+	p.write(b.close.text)
+	p.trailing(b.close)
+}
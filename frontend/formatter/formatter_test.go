@@ -0,0 +1,68 @@
+package formatter
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the .golden files from the formatter's output")
+
+// TestGolden formats each testdata/*.input file and compares the result
+// with the matching .golden file. Formatting the golden output again must
+// leave it unchanged.
+func TestGolden(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "*.input"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) == 0 {
+		t.Fatal("no testdata/*.input files")
+	}
+
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".input")
+		t.Run(name, func(t *testing.T) {
+			source, err := os.ReadFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Format(string(source))
+			if err != nil {
+				t.Fatalf("Format: %v", err)
+			}
+
+			golden := strings.TrimSuffix(input, ".input") + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("output differs from %s:\n got:\n%s\nwant:\n%s", golden, got, want)
+			}
+
+			again, err := Format(got)
+			if err != nil {
+				t.Fatalf("formatting the output: %v", err)
+			}
+			if again != got {
+				t.Errorf("formatting is not idempotent:\nfirst:\n%s\nsecond:\n%s", got, again)
+			}
+		})
+	}
+}
+
+func TestSyntaxErrors(t *testing.T) {
+	for _, source := range []string{"1 +", "(1", "try { 1 }", "try { 1 } catch e { 2 }", `"open`, "/* open"} {
+		if out, err := Format(source); err == nil {
+			t.Errorf("Format(%q) = %q, want a syntax error", source, out)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package formatter
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/caelondev/hydor/frontend/lexer"
+	"github.com/caelondev/hydor/frontend/tokens"
+)
+
+// The concrete syntax tree keeps every token of the source, each carrying
+// the comments around it, so printing it loses nothing but whitespace.
+
+type node interface{}
+
+// leaf is a literal or a variable.
+type leaf struct {
+	tok *token
+}
+
+type group struct {
+	open  *token
+	inner node
+	close *token
+}
+
+type unary struct {
+	op      *token
+	operand node
+}
+
+type binary struct {
+	left  node
+	op    *token
+	right node
+}
+
+type property struct {
+	object    node
+	dot, name *token
+}
+
+type throwExpr struct {
+	keyword *token
+	value   node
+}
+
+type tryExpr struct {
+	keyword *token
+	body    *block
+	catch   *catchClause
+	finally *finallyClause
+}
+
+type catchClause struct {
+	keyword, open, name, close *token
+	body                       *block
+}
+
+type finallyClause struct {
+	keyword *token
+	body    *block
+}
+
+type block struct {
+	open  *token
+	inner node
+	close *token
+}
+
+// file is a whole program. Comments after the last expression are leading
+// comments of eof.
+type file struct {
+	expr node
+	eof  *token
+}
+
+// token is a lexer token with its exact source text and the comments that
+// belong to it.
+type token struct {
+	tokens.Token
+	text string
+
+	// leading comments come before the token, trailing ones follow it on
+	// the same line.
+	leading  []comment
+	trailing []comment
+	// blankBefore marks a blank line between the last leading comment and
+	// the token.
+	blankBefore bool
+}
+
+type comment struct {
+	text string
+	// ownLine is set when the comment starts its line.
+	ownLine bool
+	// blankBefore marks a blank line before the comment.
+	blankBefore bool
+}
+
+func (c comment) isLine() bool {
+	return strings.HasPrefix(c.text, "//")
+}
+
+// SyntaxError reports source the formatter cannot parse. It reads like the
+// compiler's own diagnostics.
+type SyntaxError struct {
+	Line    int
+	At      string
+	Message string
+}
+
+func (e *SyntaxError) Error() string {
+	if e.At == "" {
+		return fmt.Sprintf("[line %d] Error: %s", e.Line, e.Message)
+	}
+	return fmt.Sprintf("[line %d] Error %s: %s", e.Line, e.At, e.Message)
+}
+
+// scan splits source into tokens, attaching each comment to the token it
+// trails on the same line or else to the next token.
+func scan(source string) ([]*token, error) {
+	tokenizer := lexer.NewTokenizer(source)
+	tokenizer.KeepComments = true
+
+	var list []*token
+	var pending []comment
+	end := 0
+
+	for {
+		t := tokenizer.ScanToken()
+		if t.Type == tokens.TOKEN_ERROR {
+			return nil, &SyntaxError{Line: t.Line, Message: t.Lexeme}
+		}
+		text := source[t.Start:tokenizer.Current]
+		newlines := strings.Count(source[end:t.Start], "\n")
+		end = tokenizer.Current
+
+		if t.Type == tokens.TOKEN_COMMENT {
+			if len(list) > 0 && len(pending) == 0 && newlines == 0 {
+				prev := list[len(list)-1]
+				prev.trailing = append(prev.trailing, comment{text: text})
+				continue
+			}
+			pending = append(pending, comment{
+				text:        text,
+				ownLine:     newlines > 0 || len(list) == 0,
+				blankBefore: newlines > 1,
+			})
+			continue
+		}
+
+		list = append(list, &token{
+			Token:       t,
+			text:        text,
+			leading:     pending,
+			blankBefore: len(pending) > 0 && newlines > 1,
+		})
+		pending = nil
+
+		if t.Type == tokens.TOKEN_EOF {
+			return list, nil
+		}
+	}
+}
+
+type precedence int
+
+const (
+	precNone precedence = iota
+	precEquality
+	precComparison
+	precTerm
+	precFactor
+	precUnary
+	precCall
+)
+
+var infixPrecedence = map[tokens.TokenType]precedence{
+	tokens.TOKEN_BANG_EQUAL:    precEquality,
+	tokens.TOKEN_EQUAL_EQUAL:   precEquality,
+	tokens.TOKEN_GREATER:       precComparison,
+	tokens.TOKEN_GREATER_EQUAL: precComparison,
+	tokens.TOKEN_LESS:          precComparison,
+	tokens.TOKEN_LESS_EQUAL:    precComparison,
+	tokens.TOKEN_MINUS:         precTerm,
+	tokens.TOKEN_PLUS:          precTerm,
+	tokens.TOKEN_SLASH:         precFactor,
+	tokens.TOKEN_STAR:          precFactor,
+	tokens.TOKEN_PERCENT:       precFactor,
+	tokens.TOKEN_DOT:           precCall,
+}
+
+// syntaxParser builds the tree with the same grammar, and the same error
+// messages, as the compiler's parser.
+type syntaxParser struct {
+	tokens []*token
+	pos    int
+	err    *SyntaxError
+}
+
+func parse(list []*token) (*file, error) {
+	p := &syntaxParser{tokens: list}
+	expr := p.expression(precEquality)
+	eof := p.consume(tokens.TOKEN_EOF, "Expected end of file")
+	if p.err != nil {
+		return nil, p.err
+	}
+	return &file{expr: expr, eof: eof}, nil
+}
+
+func (p *syntaxParser) current() *token {
+	return p.tokens[p.pos]
+}
+
+func (p *syntaxParser) advance() *token {
+	t := p.tokens[p.pos]
+	if t.Type != tokens.TOKEN_EOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *syntaxParser) consume(tt tokens.TokenType, msg string) *token {
+	if p.current().Type == tt {
+		return p.advance()
+	}
+	p.errorAt(p.current(), msg)
+	return p.current()
+}
+
+// errorAt keeps only the first error, as the compiler does.
+func (p *syntaxParser) errorAt(t *token, msg string) {
+	if p.err != nil {
+		return
+	}
+	at := fmt.Sprintf("at '%s'", t.Lexeme)
+	if t.Type == tokens.TOKEN_EOF {
+		at = "at end"
+	}
+	p.err = &SyntaxError{Line: t.Line, At: at, Message: msg}
+}
+
+func (p *syntaxParser) expression(min precedence) node {
+	left := p.prefix()
+	for p.err == nil {
+		prec, ok := infixPrecedence[p.current().Type]
+		if !ok || prec < min {
+			return left
+		}
+
+		op := p.advance()
+		if op.Type == tokens.TOKEN_DOT {
+			name := p.consume(tokens.TOKEN_IDENTIFIER, "Expected property name after '.'")
+			left = &property{object: left, dot: op, name: name}
+			continue
+		}
+		left = &binary{left: left, op: op, right: p.expression(prec + 1)}
+	}
+	return left
+}
+
+func (p *syntaxParser) prefix() node {
+	t := p.advance()
+	switch t.Type {
+	case tokens.TOKEN_NUMBER, tokens.TOKEN_STRING, tokens.TOKEN_IDENTIFIER,
+		tokens.TOKEN_TRUE, tokens.TOKEN_FALSE, tokens.TOKEN_NIL:
+		return &leaf{t}
+	case tokens.TOKEN_MINUS, tokens.TOKEN_BANG:
+		return &unary{op: t, operand: p.expression(precUnary)}
+	case tokens.TOKEN_LEFT_PAREN:
+		inner := p.expression(precEquality)
+		return &group{open: t, inner: inner, close: p.consume(tokens.TOKEN_RIGHT_PAREN, "Expected ')' after parseGrouping")}
+	case tokens.TOKEN_THROW:
+		return &throwExpr{keyword: t, value: p.expression(precEquality)}
+	case tokens.TOKEN_TRY:
+		return p.try(t)
+	}
+	p.errorAt(t, "Expected expression")
+	return &leaf{t}
+}
+
+func (p *syntaxParser) try(keyword *token) node {
+	expr := &tryExpr{keyword: keyword, body: p.block("try")}
+	if p.err != nil {
+		return expr
+	}
+	if p.current().Type != tokens.TOKEN_CATCH && p.current().Type != tokens.TOKEN_FINALLY {
+		p.errorAt(p.current(), "Expected 'catch' or 'finally' after try block")
+		return expr
+	}
+
+	if p.current().Type == tokens.TOKEN_CATCH {
+		c := &catchClause{keyword: p.advance()}
+		c.open = p.consume(tokens.TOKEN_LEFT_PAREN, "Expected '(' after 'catch'")
+		c.name = p.consume(tokens.TOKEN_IDENTIFIER, "Expected error variable name")
+		c.close = p.consume(tokens.TOKEN_RIGHT_PAREN, "Expected ')' after error variable name")
+		c.body = p.block("catch")
+		expr.catch = c
+	}
+	if p.current().Type == tokens.TOKEN_FINALLY {
+		expr.finally = &finallyClause{keyword: p.advance(), body: p.block("finally")}
+	}
+	return expr
+}
+
+func (p *syntaxParser) block(keyword string) *block {
+	b := &block{open: p.consume(tokens.TOKEN_LEFT_BRACE, fmt.Sprintf("Expected '{' after '%s'", keyword))}
+	b.inner = p.expression(precEquality)
+	b.close = p.consume(tokens.TOKEN_RIGHT_BRACE, fmt.Sprintf("Expected '}' after %s block", keyword))
+	return b
+}
@@ -0,0 +1,67 @@
+package lexer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caelondev/hydor/frontend/tokens"
+)
+
+// addSeeds seeds f with the conformance scripts and a few inputs that end
+// inside a token.
+func addSeeds(f *testing.F) {
+	scripts, _ := filepath.Glob(filepath.Join("..", "..", "testdata", "*", "*.hd"))
+	for _, path := range scripts {
+		if data, err := os.ReadFile(path); err == nil {
+			f.Add(string(data))
+		}
+	}
+	for _, s := range []string{"", "/*", "/* *", "//", `"`, "'a", "`\n", "1.", "1e", "\xff\xfe", "é$", "\x00"} {
+		f.Add(s)
+	}
+}
+
+func FuzzScanToken(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, source string) {
+		for _, keep := range []bool{false, true} {
+			tokenizer := NewTokenizer(source)
+			tokenizer.KeepComments = keep
+			first := scanAll(t, tokenizer)
+
+			start, line := 0, 1
+			for _, tok := range first {
+				end := tok.Start + tok.Length
+				if tok.Type == tokens.TOKEN_ERROR {
+					// An error's length is its message's.
+					end = tok.Start
+				}
+				if tok.Start < start || tok.Length < 0 || end > len(source) {
+					t.Fatalf("%v spans [%d, %d) after offset %d in %d bytes", tok.Type, tok.Start, end, start, len(source))
+				}
+				if tok.Line < line {
+					t.Fatalf("%v on line %d after line %d", tok.Type, tok.Line, line)
+				}
+				start, line = tok.Start, tok.Line
+			}
+
+			tokenizer = NewTokenizer(source)
+			tokenizer.KeepComments = keep
+			second := scanAll(t, tokenizer)
+			if len(first) != len(second) {
+				t.Fatalf("scanned %d tokens, then %d", len(first), len(second))
+			}
+			for i := range first {
+				if first[i] != second[i] {
+					t.Fatalf("token %d was %+v, then %+v", i, first[i], second[i])
+				}
+			}
+
+			// The tokenizer keeps returning EOF once it has reached it.
+			if last := tokenizer.ScanToken(); last.Type != tokens.TOKEN_EOF {
+				t.Fatalf("scanned %v after EOF", last.Type)
+			}
+		}
+	})
+}
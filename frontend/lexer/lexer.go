@@ -11,6 +11,10 @@ type Tokenizer struct {
 	Start   int
 	Current int
 	Line    int
+
+	// KeepComments makes comments come back as TOKEN_COMMENT tokens
+	// instead of being skipped, for tools that rewrite source.
+	KeepComments bool
 }
 
 func NewTokenizer(source string) *Tokenizer {
@@ -50,7 +54,11 @@ func (s *Tokenizer) ScanToken() tokens.Token {
 	case '.': return s.newToken(tokens.TOKEN_DOT)
 	case '-': return s.newToken(tokens.TOKEN_MINUS)
 	case '+': return s.newToken(tokens.TOKEN_PLUS)
-	case '/': return s.newToken(tokens.TOKEN_SLASH)
+	case '/':
+		if s.KeepComments && (s.peek() == '/' || s.peek() == '*') {
+			return s.comment()
+		}
+		return s.newToken(tokens.TOKEN_SLASH)
 	case '*': return s.newToken(tokens.TOKEN_STAR)
 	case '%': return s.newToken(tokens.TOKEN_PERCENT)
 	case '!': return s.matchEqual(tokens.TOKEN_BANG, tokens.TOKEN_BANG_EQUAL)
@@ -82,11 +90,33 @@ func (s *Tokenizer) multilineString(terminator byte) tokens.Token {
 		Type: tokens.TOKEN_STRING,
 		Start: s.Start,
 		Line: startLine,
-		Length: s.Line,
+		Length: len(lexeme),
 		Lexeme: lexeme,
 	}
 }
 
+// comment scans a comment whose leading '/' has been consumed. The lexeme
+// is the whole comment, delimiters included. An unterminated block comment
+// runs to the end of the source, as it does when comments are skipped.
+func (s *Tokenizer) comment() tokens.Token {
+	startLine := s.Line
+	if s.advance() == '/' {
+		for s.peek() != '\n' && !s.isAtEnd() { s.advance() }
+	} else {
+		for !s.isAtEnd() && !(s.peek() == '*' && s.peekNext() == '/') {
+			if s.peek() == '\n' { s.Line++ }
+			s.advance()
+		}
+		if !s.isAtEnd() {
+			s.advance(); s.advance()
+		}
+	}
+
+	token := s.newToken(tokens.TOKEN_COMMENT)
+	token.Line = startLine
+	return token
+}
+
 func (s *Tokenizer) identifier() tokens.Token {
 	for isAlphanumeric(s.peek()) { s.advance() }
 	lexeme := s.Source[s.Start:s.Current]
@@ -130,6 +160,9 @@ func (s *Tokenizer) skipIgnored() {
 			s.Line++
 			s.advance()
 		case '/':
+			if s.KeepComments && (s.peekNext() == '/' || s.peekNext() == '*') {
+				return
+			}
 			if s.peekNext() == '/' {
 				s.advance(); s.advance()
 				for s.peek() != '\n' && !s.isAtEnd() { s.advance() }
@@ -0,0 +1,121 @@
+package lexer
+
+import (
+	"testing"
+
+	"github.com/caelondev/hydor/frontend/tokens"
+)
+
+// scanAll returns every token in source up to and including EOF.
+func scanAll(t *testing.T, tokenizer *Tokenizer) []tokens.Token {
+	t.Helper()
+	all := []tokens.Token{}
+	for i := 0; i <= len(tokenizer.Source)+1; i++ {
+		tok := tokenizer.ScanToken()
+		all = append(all, tok)
+		if tok.Type == tokens.TOKEN_EOF {
+			return all
+		}
+	}
+	t.Fatalf("no EOF after %d tokens", len(all))
+	return nil
+}
+
+func TestScanToken(t *testing.T) {
+	tests := []struct {
+		source string
+		want   []tokens.TokenType
+	}{
+		{"", nil},
+		{"(){},.-+;*/%", []tokens.TokenType{
+			tokens.TOKEN_LEFT_PAREN, tokens.TOKEN_RIGHT_PAREN, tokens.TOKEN_LEFT_BRACE, tokens.TOKEN_RIGHT_BRACE,
+			tokens.TOKEN_COMMA, tokens.TOKEN_DOT, tokens.TOKEN_MINUS, tokens.TOKEN_PLUS,
+			tokens.TOKEN_SEMICOLON, tokens.TOKEN_STAR, tokens.TOKEN_SLASH, tokens.TOKEN_PERCENT,
+		}},
+		{"! != = == < <= > >=", []tokens.TokenType{
+			tokens.TOKEN_BANG, tokens.TOKEN_BANG_EQUAL, tokens.TOKEN_EQUAL, tokens.TOKEN_EQUAL_EQUAL,
+			tokens.TOKEN_LESS, tokens.TOKEN_LESS_EQUAL, tokens.TOKEN_GREATER, tokens.TOKEN_GREATER_EQUAL,
+		}},
+		{"try catch finally throw nil true false", []tokens.TokenType{
+			tokens.TOKEN_TRY, tokens.TOKEN_CATCH, tokens.TOKEN_FINALLY, tokens.TOKEN_THROW,
+			tokens.TOKEN_NIL, tokens.TOKEN_TRUE, tokens.TOKEN_FALSE,
+		}},
+		{"tryhard _x x1", []tokens.TokenType{tokens.TOKEN_IDENTIFIER, tokens.TOKEN_IDENTIFIER, tokens.TOKEN_IDENTIFIER}},
+		{"1 2.5 3.", []tokens.TokenType{tokens.TOKEN_NUMBER, tokens.TOKEN_NUMBER, tokens.TOKEN_NUMBER, tokens.TOKEN_DOT}},
+		{`"a" 'b' ` + "`c\nd`", []tokens.TokenType{tokens.TOKEN_STRING, tokens.TOKEN_STRING, tokens.TOKEN_STRING}},
+		{"1 // comment\n/* block\n */ 2", []tokens.TokenType{tokens.TOKEN_NUMBER, tokens.TOKEN_NUMBER}},
+		{"@", []tokens.TokenType{tokens.TOKEN_ERROR}},
+		{`"open`, []tokens.TokenType{tokens.TOKEN_ERROR}},
+		{"`open", []tokens.TokenType{tokens.TOKEN_ERROR}},
+		{"1 /* open", []tokens.TokenType{tokens.TOKEN_NUMBER}},
+	}
+
+	for _, tt := range tests {
+		got := scanAll(t, NewTokenizer(tt.source))
+		want := append(tt.want, tokens.TOKEN_EOF)
+		if len(got) != len(want) {
+			t.Errorf("%q: got %d tokens %v, want %v", tt.source, len(got), got, want)
+			continue
+		}
+		for i := range want {
+			if got[i].Type != want[i] {
+				t.Errorf("%q: token %d is %s, want %s", tt.source, i, got[i].Type, want[i])
+			}
+		}
+	}
+}
+
+func TestTokenPositions(t *testing.T) {
+	source := "1 +\n  \"two\"\n`three\nlines` x"
+	got := scanAll(t, NewTokenizer(source))
+
+	want := []struct {
+		lexeme string
+		line   int
+		start  int
+	}{
+		{"1", 1, 0},
+		{"+", 1, 2},
+		{"two", 2, 6},
+		{"three\nlines", 3, 12},
+		{"x", 4, 26},
+		{"", 4, 27},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d tokens, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		if got[i].Lexeme != w.lexeme || got[i].Line != w.line || got[i].Start != w.start {
+			t.Errorf("token %d = {%q line %d start %d}, want {%q line %d start %d}",
+				i, got[i].Lexeme, got[i].Line, got[i].Start, w.lexeme, w.line, w.start)
+		}
+	}
+}
+
+func TestKeepComments(t *testing.T) {
+	tokenizer := NewTokenizer("// line\n1 /* block\n */ / 2")
+	tokenizer.KeepComments = true
+	got := scanAll(t, tokenizer)
+
+	want := []struct {
+		tt     tokens.TokenType
+		lexeme string
+		line   int
+	}{
+		{tokens.TOKEN_COMMENT, "// line", 1},
+		{tokens.TOKEN_NUMBER, "1", 2},
+		{tokens.TOKEN_COMMENT, "/* block\n */", 2},
+		{tokens.TOKEN_SLASH, "/", 3},
+		{tokens.TOKEN_NUMBER, "2", 3},
+		{tokens.TOKEN_EOF, "", 3},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d tokens, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		if got[i].Type != w.tt || got[i].Lexeme != w.lexeme || got[i].Line != w.line {
+			t.Errorf("token %d = {%s %q line %d}, want {%s %q line %d}",
+				i, got[i].Type, got[i].Lexeme, got[i].Line, w.tt, w.lexeme, w.line)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// Package lint finds suspicious but legal code. Each finding comes from a
+// rule with an ID, which a config file can switch off or change the
+// severity of, and which a `// hydor:ignore RULE` comment can silence for
+// a single line.
+package lint
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/caelondev/hydor/frontend/lexer"
+	"github.com/caelondev/hydor/frontend/parser"
+	"github.com/caelondev/hydor/frontend/tokens"
+)
+
+// CONFIG_FILE is the name of the config file looked for next to a linted
+// file and in each directory above it.
+const CONFIG_FILE = ".hydorlint.json"
+
+// IGNORE_DIRECTIVE starts a comment silencing rules. On a line of its own
+// it applies to the next line, otherwise to its own line.
+const IGNORE_DIRECTIVE = "hydor:ignore"
+
+type Severity int
+
+const (
+	SEVERITY_OFF Severity = iota
+	SEVERITY_INFO
+	SEVERITY_WARNING
+	SEVERITY_ERROR
+)
+
+var severityNames = map[Severity]string{
+	SEVERITY_OFF:     "off",
+	SEVERITY_INFO:    "info",
+	SEVERITY_WARNING: "warning",
+	SEVERITY_ERROR:   "error",
+}
+
+func (s Severity) String() string {
+	if name, ok := severityNames[s]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+func (s *Severity) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+	for severity, n := range severityNames {
+		if n == name {
+			*s = severity
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown severity '%s'", name)
+}
+
+// Rule is one kind of finding.
+type Rule struct {
+	ID          string
+	Description string
+	Severity    Severity
+}
+
+// Diagnostic is a single finding. Line and Column are 1-based; Column
+// counts bytes.
+type Diagnostic struct {
+	Rule     string
+	Severity Severity
+	Line     int
+	Column   int
+	Message  string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%d:%d: %s: %s [%s]", d.Line, d.Column, d.Severity, d.Message, d.Rule)
+}
+
+// Config overrides the severity of rules by ID. Rules it leaves out keep
+// their default.
+type Config struct {
+	Rules map[string]Severity `json:"rules"`
+}
+
+// LoadConfig reads a JSON config file such as
+//
+//	{"rules": {"unused-variable": "off", "shadowed-variable": "error"}}
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for id := range config.Rules {
+		if ruleByID(id) == nil {
+			return nil, fmt.Errorf("%s: unknown rule '%s'", path, id)
+		}
+	}
+	return config, nil
+}
+
+// FindConfig looks for CONFIG_FILE in dir and each directory above it.
+func FindConfig(dir string) (string, bool) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+	for {
+		path := filepath.Join(dir, CONFIG_FILE)
+		if _, err := os.Stat(path); err == nil {
+			return path, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+func (c *Config) severity(rule *Rule) Severity {
+	if c != nil {
+		if s, ok := c.Rules[rule.ID]; ok {
+			return s
+		}
+	}
+	return rule.Severity
+}
+
+func ruleByID(id string) *Rule {
+	for _, rule := range Rules {
+		if rule.ID == id {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Lint parses source and runs every enabled rule over it. Source that does
+// not parse is not linted; the syntax error is returned instead.
+func Lint(source string, config *Config) ([]Diagnostic, error) {
+	program, err := parser.NewParser().Parse(lexer.NewTokenizer(source))
+	if err != nil {
+		return nil, err
+	}
+
+	l := &linter{source: source, config: config, ignored: ignoredLines(source)}
+	l.expr(program.Expr)
+
+	sort.SliceStable(l.diagnostics, func(i, j int) bool {
+		a, b := l.diagnostics[i], l.diagnostics[j]
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return l.diagnostics, nil
+}
+
+// ignoredLines maps each line to the rules silenced on it. An empty list
+// silences every rule.
+func ignoredLines(source string) map[int][]string {
+	ignored := map[int][]string{}
+	tokenizer := lexer.NewTokenizer(source)
+	tokenizer.KeepComments = true
+
+	for {
+		t := tokenizer.ScanToken()
+		if t.Type == tokens.TOKEN_EOF {
+			return ignored
+		}
+		if t.Type != tokens.TOKEN_COMMENT || !strings.HasPrefix(t.Lexeme, "//") {
+			continue
+		}
+
+		text := strings.TrimSpace(strings.TrimPrefix(t.Lexeme, "//"))
+		rest, found := strings.CutPrefix(text, IGNORE_DIRECTIVE)
+		if !found {
+			continue
+		}
+
+		line := t.Line
+		lineStart := strings.LastIndexByte(source[:t.Start], '\n') + 1
+		if strings.TrimSpace(source[lineStart:t.Start]) == "" {
+			line++
+		}
+		rules := strings.FieldsFunc(rest, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+		if len(rules) == 0 {
+			ignored[line] = []string{}
+		} else if prev, ok := ignored[line]; !ok || len(prev) > 0 {
+			ignored[line] = append(prev, rules...)
+		}
+	}
+}
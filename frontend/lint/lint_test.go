@@ -0,0 +1,113 @@
+package lint
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func lint(t *testing.T, source string, config *Config) []string {
+	t.Helper()
+	diagnostics, err := Lint(source, config)
+	if err != nil {
+		t.Fatalf("%q: %v", source, err)
+	}
+	got := []string{}
+	for _, d := range diagnostics {
+		got = append(got, d.String())
+	}
+	return got
+}
+
+func TestRules(t *testing.T) {
+	tests := map[string]string{
+		"try { 1 } catch (e) { 2 }":                         "1:18: warning: Catch variable 'e' is never used [unused-variable]",
+		"try { 1 } catch (e) { try { e } catch (e) { e } }": "1:40: warning: Catch variable 'e' shadows the one declared on line 1 [shadowed-variable]",
+		"(throw 1) * 2":                                     "1:13: warning: Unreachable code: the left operand of '*' always throws [unreachable-code]",
+		`"a" == nil`:                                        "1:5: warning: Comparing a string with nil using '==' is always false [nil-comparison]",
+		"try { 1 } catch (e) { e.kind == nil }":             "1:30: warning: Comparing a string with nil using '==' is always false [nil-comparison]",
+		"1 == 2":                                            "1:3: warning: Both sides of '==' are constants, so the comparison always gives the same result [constant-condition]",
+		"try { 1 } catch (e) { e == e }":                    "1:25: warning: Both sides of '==' are the same expression, so the comparison is always true [constant-condition]",
+		"try { 1 } catch (e) { e + 1 }":                     "",
+		"try { 1 } catch (e) { e == nil }":                  "1:25: warning: Comparing an error with nil using '==' is always false [nil-comparison]",
+		`try { 1 } catch (e) { e.kind == "TypeError" }`:     "",
+	}
+
+	for source, want := range tests {
+		got := strings.Join(lint(t, source, nil), "\n")
+		if got != want {
+			t.Errorf("%q:\n got %q\nwant %q", source, got, want)
+		}
+	}
+}
+
+func TestIgnoreDirective(t *testing.T) {
+	tests := map[string]int{
+		"// hydor:ignore unused-variable\ntry { 1 } catch (e) { 2 }":   0,
+		"try { 1 } catch (e) { 2 } // hydor:ignore":                    0,
+		"try { 1 } catch (e) { 2 } // hydor:ignore nil-comparison":     1,
+		"// hydor:ignore\n\ntry { 1 } catch (e) { 2 }":                 1,
+		"try { 1 } catch (e) { 2 } // hydor:ignore a, unused-variable": 0,
+	}
+	for source, want := range tests {
+		if got := lint(t, source, nil); len(got) != want {
+			t.Errorf("%q: %d diagnostics %v, want %d", source, len(got), got, want)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	source := "try { 1 } catch (e) { 1 == 2 }"
+	config := &Config{Rules: map[string]Severity{
+		RULE_UNUSED_VARIABLE:    SEVERITY_OFF,
+		RULE_CONSTANT_CONDITION: SEVERITY_ERROR,
+	}}
+	got := lint(t, source, config)
+	if len(got) != 1 || !strings.Contains(got[0], "error: Both sides") {
+		t.Errorf("diagnostics %v, want only the constant condition as an error", got)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	nested := filepath.Join(dir, "a", "b")
+	if err := os.MkdirAll(nested, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, CONFIG_FILE)
+	write := func(text string) {
+		if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"rules": {"unused-variable": "info"}}`)
+	if found, ok := FindConfig(nested); !ok || found != path {
+		t.Fatalf("FindConfig = %q, %t, want %q", found, ok, path)
+	}
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Rules[RULE_UNUSED_VARIABLE] != SEVERITY_INFO {
+		t.Errorf("rules = %v", config.Rules)
+	}
+
+	for text, want := range map[string]string{
+		`{"rules": {"no-such-rule": "off"}}`:     "unknown rule 'no-such-rule'",
+		`{"rules": {"unused-variable": "loud"}}`: "unknown severity 'loud'",
+		`{"rules": `:                             "unexpected end",
+	} {
+		write(text)
+		if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: error %v, want %q", text, err, want)
+		}
+	}
+}
+
+func TestSyntaxError(t *testing.T) {
+	if _, err := Lint("1 +", nil); err == nil {
+		t.Error("Lint accepted a syntax error")
+	}
+}
@@ -0,0 +1,262 @@
+package lint
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/caelondev/hydor/frontend/ast"
+	"github.com/caelondev/hydor/frontend/tokens"
+)
+
+const (
+	RULE_UNUSED_VARIABLE    = "unused-variable"
+	RULE_SHADOWED_VARIABLE  = "shadowed-variable"
+	RULE_UNREACHABLE_CODE   = "unreachable-code"
+	RULE_NIL_COMPARISON     = "nil-comparison"
+	RULE_CONSTANT_CONDITION = "constant-condition"
+)
+
+// Rules lists every rule with its default severity.
+var Rules = []*Rule{
+	{RULE_UNUSED_VARIABLE, "A catch variable is never used. Names starting with '_' are exempt.", SEVERITY_WARNING},
+	{RULE_SHADOWED_VARIABLE, "A catch variable hides an enclosing one of the same name.", SEVERITY_WARNING},
+	{RULE_UNREACHABLE_CODE, "Code can never run because an error is always thrown before it.", SEVERITY_WARNING},
+	{RULE_NIL_COMPARISON, "A value that can never be nil is compared with nil.", SEVERITY_WARNING},
+	{RULE_CONSTANT_CONDITION, "A comparison always gives the same result.", SEVERITY_WARNING},
+}
+
+type linter struct {
+	source      string
+	config      *Config
+	ignored     map[int][]string
+	diagnostics []Diagnostic
+
+	// scopes holds the catch variables in scope, innermost last.
+	scopes []*variable
+}
+
+type variable struct {
+	name tokens.Token
+	used bool
+}
+
+func (l *linter) report(id string, at tokens.Token, format string, args ...interface{}) {
+	severity := l.config.severity(ruleByID(id))
+	if severity == SEVERITY_OFF {
+		return
+	}
+	if rules, ok := l.ignored[at.Line]; ok && (len(rules) == 0 || slices.Contains(rules, id)) {
+		return
+	}
+
+	lineStart := strings.LastIndexByte(l.source[:at.Start], '\n') + 1
+	l.diagnostics = append(l.diagnostics, Diagnostic{
+		Rule:     id,
+		Severity: severity,
+		Line:     at.Line,
+		Column:   at.Start - lineStart + 1,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+func (l *linter) lookup(name string) *variable {
+	for i := len(l.scopes) - 1; i >= 0; i-- {
+		if l.scopes[i].name.Lexeme == name {
+			return l.scopes[i]
+		}
+	}
+	return nil
+}
+
+func (l *linter) expr(e ast.Expr) {
+	switch e := e.(type) {
+	case *ast.Variable:
+		if v := l.lookup(e.Name.Lexeme); v != nil {
+			v.used = true
+		}
+	case *ast.Grouping:
+		l.expr(e.Expr)
+	case *ast.Unary:
+		l.expr(e.Operand)
+	case *ast.Binary:
+		l.binary(e)
+	case *ast.Property:
+		l.expr(e.Object)
+	case *ast.Throw:
+		l.expr(e.Value)
+	case *ast.Try:
+		l.try(e)
+	}
+}
+
+func (l *linter) binary(e *ast.Binary) {
+	if alwaysThrows(e.Left) {
+		l.report(RULE_UNREACHABLE_CODE, e.Right.Pos(), "Unreachable code: the left operand of '%s' always throws", e.Operator.Lexeme)
+	}
+
+	if isComparison(e.Operator.Type) {
+		l.comparison(e)
+	}
+	l.expr(e.Left)
+	l.expr(e.Right)
+}
+
+func (l *linter) comparison(e *ast.Binary) {
+	op := e.Operator.Type
+	left, right := unwrap(e.Left), unwrap(e.Right)
+
+	if op == tokens.TOKEN_EQUAL_EQUAL || op == tokens.TOKEN_BANG_EQUAL {
+		for _, pair := range [][2]ast.Expr{{left, right}, {right, left}} {
+			if !isNil(pair[0]) {
+				continue
+			}
+			if kind := l.staticType(pair[1]); kind != "" {
+				l.report(RULE_NIL_COMPARISON, e.Operator, "Comparing %s with nil using '%s' is always %t",
+					kind, e.Operator.Lexeme, op == tokens.TOKEN_BANG_EQUAL)
+				return
+			}
+		}
+	}
+
+	switch {
+	case isLiteral(left) && isLiteral(right):
+		l.report(RULE_CONSTANT_CONDITION, e.Operator, "Both sides of '%s' are constants, so the comparison always gives the same result", e.Operator.Lexeme)
+	case (op == tokens.TOKEN_EQUAL_EQUAL || op == tokens.TOKEN_BANG_EQUAL) && sameExpr(left, right):
+		l.report(RULE_CONSTANT_CONDITION, e.Operator, "Both sides of '%s' are the same expression, so the comparison is always %t",
+			e.Operator.Lexeme, op == tokens.TOKEN_EQUAL_EQUAL)
+	}
+}
+
+func (l *linter) try(e *ast.Try) {
+	l.block(e.Body)
+
+	if c := e.Catch; c != nil {
+		if outer := l.lookup(c.Name.Lexeme); outer != nil {
+			l.report(RULE_SHADOWED_VARIABLE, c.Name, "Catch variable '%s' shadows the one declared on line %d", c.Name.Lexeme, outer.name.Line)
+		}
+
+		v := &variable{name: c.Name}
+		l.scopes = append(l.scopes, v)
+		l.block(c.Body)
+		l.scopes = l.scopes[:len(l.scopes)-1]
+
+		if !v.used && !strings.HasPrefix(c.Name.Lexeme, "_") {
+			l.report(RULE_UNUSED_VARIABLE, c.Name, "Catch variable '%s' is never used", c.Name.Lexeme)
+		}
+	}
+
+	if f := e.Finally; f != nil {
+		l.block(f.Body)
+	}
+}
+
+func (l *linter) block(b *ast.Block) {
+	if b != nil {
+		l.expr(b.Expr)
+	}
+}
+
+// staticType describes the type e always has, or returns "" when it could
+// be anything, nil included.
+func (l *linter) staticType(e ast.Expr) string {
+	switch e := unwrap(e).(type) {
+	case *ast.Literal:
+		switch e.Token.Type {
+		case tokens.TOKEN_NUMBER:
+			return "a number"
+		case tokens.TOKEN_STRING:
+			return "a string"
+		case tokens.TOKEN_TRUE, tokens.TOKEN_FALSE:
+			return "a boolean"
+		}
+	case *ast.Variable:
+		if l.lookup(e.Name.Lexeme) != nil {
+			return "an error"
+		}
+	case *ast.Unary:
+		if e.Operator.Type == tokens.TOKEN_BANG {
+			return "a boolean"
+		}
+		return "a number"
+	case *ast.Binary:
+		if isComparison(e.Operator.Type) {
+			return "a boolean"
+		}
+		if e.Operator.Type == tokens.TOKEN_PLUS {
+			return "a number or string"
+		}
+		return "a number"
+	case *ast.Property:
+		return "a string"
+	}
+	return ""
+}
+
+// alwaysThrows reports whether evaluating e can only end in an error.
+func alwaysThrows(e ast.Expr) bool {
+	switch e := unwrap(e).(type) {
+	case *ast.Throw:
+		return true
+	case *ast.Unary:
+		return alwaysThrows(e.Operand)
+	case *ast.Binary:
+		return alwaysThrows(e.Left) || alwaysThrows(e.Right)
+	case *ast.Property:
+		return alwaysThrows(e.Object)
+	case *ast.Try:
+		if e.Finally != nil && e.Finally.Body != nil && alwaysThrows(e.Finally.Body.Expr) {
+			return true
+		}
+		if e.Catch != nil {
+			return e.Catch.Body != nil && alwaysThrows(e.Catch.Body.Expr)
+		}
+		return e.Body != nil && alwaysThrows(e.Body.Expr)
+	}
+	return false
+}
+
+// sameExpr reports whether a and b are the same expression with no side
+// effects, so evaluating them gives equal values.
+func sameExpr(a, b ast.Expr) bool {
+	a, b = unwrap(a), unwrap(b)
+	switch a := a.(type) {
+	case *ast.Variable:
+		b, ok := b.(*ast.Variable)
+		return ok && a.Name.Lexeme == b.Name.Lexeme
+	case *ast.Property:
+		b, ok := b.(*ast.Property)
+		return ok && a.Name.Lexeme == b.Name.Lexeme && sameExpr(a.Object, b.Object)
+	}
+	return false
+}
+
+func unwrap(e ast.Expr) ast.Expr {
+	for {
+		group, ok := e.(*ast.Grouping)
+		if !ok {
+			return e
+		}
+		e = group.Expr
+	}
+}
+
+func isLiteral(e ast.Expr) bool {
+	_, ok := e.(*ast.Literal)
+	return ok
+}
+
+func isNil(e ast.Expr) bool {
+	lit, ok := e.(*ast.Literal)
+	return ok && lit.Token.Type == tokens.TOKEN_NIL
+}
+
+func isComparison(tt tokens.TokenType) bool {
+	switch tt {
+	case tokens.TOKEN_EQUAL_EQUAL, tokens.TOKEN_BANG_EQUAL,
+		tokens.TOKEN_GREATER, tokens.TOKEN_GREATER_EQUAL,
+		tokens.TOKEN_LESS, tokens.TOKEN_LESS_EQUAL:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,269 @@
+package lsp
+
+import (
+	"io"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/caelondev/hydor/frontend/ast"
+	"github.com/caelondev/hydor/frontend/compiler"
+	"github.com/caelondev/hydor/frontend/lexer"
+	"github.com/caelondev/hydor/frontend/optimizer"
+	"github.com/caelondev/hydor/frontend/parser"
+	"github.com/caelondev/hydor/frontend/tokens"
+)
+
+// document is an open file along with everything the server derived from
+// its text, recomputed on every change.
+type document struct {
+	uri  string
+	text string
+	// lineStarts holds the byte offset of the start of each line.
+	lineStarts []int
+
+	tokens []token
+	// comments holds the extent of every comment, which the token list
+	// leaves out.
+	comments    [][2]int
+	bindings    []*binding
+	diagnostics []diagnostic
+}
+
+// token is a lexer token with its full extent in the source. A lexer token
+// only carries its lexeme, which for strings leaves out the quotes.
+type token struct {
+	tokens.Token
+	End int
+
+	// binding is the catch variable an identifier declares or refers to.
+	binding *binding
+	// declares marks the identifier that introduces its binding.
+	declares bool
+	// property marks an identifier naming a property after '.'.
+	property bool
+}
+
+// binding is a catch variable. Its scope is the catch block.
+type binding struct {
+	name string
+	// decl indexes the declaring identifier in the document's tokens.
+	decl int
+	// clause spans from the catch keyword to the end of its block.
+	clause [2]int
+	parent *binding
+	// line is where the try the variable belongs to starts.
+	line int
+}
+
+func newDocument(uri, text string) *document {
+	d := &document{uri: uri, text: text, lineStarts: []int{0}, diagnostics: []diagnostic{}}
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\n' {
+			d.lineStarts = append(d.lineStarts, i+1)
+		}
+	}
+	d.scan()
+	d.resolve()
+	d.check()
+	return d
+}
+
+func (d *document) scan() {
+	tokenizer := lexer.NewTokenizer(d.text)
+	tokenizer.KeepComments = true
+	for {
+		t := tokenizer.ScanToken()
+		if t.Type == tokens.TOKEN_COMMENT {
+			d.comments = append(d.comments, [2]int{t.Start, tokenizer.Current})
+			continue
+		}
+		d.tokens = append(d.tokens, token{Token: t, End: tokenizer.Current})
+		if t.Type == tokens.TOKEN_EOF {
+			return
+		}
+	}
+}
+
+// resolve ties each identifier to the catch variable it names, walking the
+// syntax tree the way the code generator does. On a syntax error the tree
+// stops where the error was found, and so does resolution.
+func (d *document) resolve() {
+	program, _ := parser.NewParser().Parse(lexer.NewTokenizer(d.text))
+	r := &resolver{d: d, index: map[int]int{}}
+	for i, t := range d.tokens {
+		r.index[t.Start] = i
+	}
+	r.expr(program.Expr)
+}
+
+// resolver walks a document's syntax tree, keeping the catch variables in
+// scope with the innermost last.
+type resolver struct {
+	d *document
+	// index maps the offset of each token to its place in the document's
+	// tokens, which were scanned separately from the parser's.
+	index  map[int]int
+	scopes []*binding
+}
+
+func (r *resolver) token(t tokens.Token) *token {
+	i, ok := r.index[t.Start]
+	if !ok || t.Type != tokens.TOKEN_IDENTIFIER {
+		return nil
+	}
+	return &r.d.tokens[i]
+}
+
+func (r *resolver) expr(e ast.Expr) {
+	switch e := e.(type) {
+	case *ast.Variable:
+		t := r.token(e.Name)
+		if t == nil {
+			return
+		}
+		for i := len(r.scopes) - 1; i >= 0; i-- {
+			if r.scopes[i].name == t.Lexeme {
+				t.binding = r.scopes[i]
+				return
+			}
+		}
+	case *ast.Grouping:
+		r.expr(e.Expr)
+	case *ast.Unary:
+		r.expr(e.Operand)
+	case *ast.Binary:
+		r.expr(e.Left)
+		r.expr(e.Right)
+	case *ast.Property:
+		r.expr(e.Object)
+		if t := r.token(e.Name); t != nil {
+			t.property = true
+		}
+	case *ast.Throw:
+		r.expr(e.Value)
+	case *ast.Try:
+		r.try(e)
+	}
+}
+
+func (r *resolver) try(e *ast.Try) {
+	r.block(e.Body)
+
+	if c := e.Catch; c != nil {
+		t := r.token(c.Name)
+		if t == nil {
+			// Without a name there is nothing to bind, but the block is
+			// still resolved against the variables around it.
+			r.block(c.Body)
+		} else {
+			b := &binding{
+				name: t.Lexeme,
+				decl: r.index[t.Start],
+				// A clause whose block is never closed runs to the end of
+				// the document.
+				clause: [2]int{c.Keyword.Start, len(r.d.text)},
+				line:   e.Keyword.Line,
+			}
+			if len(r.scopes) > 0 {
+				b.parent = r.scopes[len(r.scopes)-1]
+			}
+			if c.Body != nil && c.Body.RightBrace.Type == tokens.TOKEN_RIGHT_BRACE {
+				b.clause[1] = c.Body.RightBrace.Start + 1
+			}
+			t.binding = b
+			t.declares = true
+			r.d.bindings = append(r.d.bindings, b)
+
+			r.scopes = append(r.scopes, b)
+			r.block(c.Body)
+			r.scopes = r.scopes[:len(r.scopes)-1]
+		}
+	}
+
+	if f := e.Finally; f != nil {
+		r.block(f.Body)
+	}
+}
+
+func (r *resolver) block(b *ast.Block) {
+	if b != nil {
+		r.expr(b.Expr)
+	}
+}
+
+// check compiles the document and records the error the compiler reports.
+func (d *document) check() {
+	compiler.Compile(d.text, compiler.Options{
+		Optimize: optimizer.O0,
+		Errors:   io.Discard,
+		OnError: func(err *ast.Error) {
+			end := err.At.Start
+			if t := d.tokenAt(err.At.Start); t != nil && t.Start == err.At.Start {
+				end = t.End
+			}
+			d.diagnostics = append(d.diagnostics, diagnostic{
+				Range:    d.span(err.At.Start, end),
+				Severity: SEVERITY_ERROR,
+				Source:   "hydor",
+				Message:  err.Message,
+			})
+		},
+	})
+}
+
+// tokenAt returns the token covering offset. An offset just past the end
+// of a token counts as inside it, so a cursor placed after a name finds it.
+func (d *document) tokenAt(offset int) *token {
+	for i := range d.tokens {
+		t := &d.tokens[i]
+		if t.Type != tokens.TOKEN_EOF && t.Start <= offset && offset <= t.End {
+			return t
+		}
+	}
+	return nil
+}
+
+// position converts a byte offset to a protocol position, whose character
+// counts UTF-16 code units.
+func (d *document) position(offset int) position {
+	offset = min(max(offset, 0), len(d.text))
+	line := sort.Search(len(d.lineStarts), func(i int) bool { return d.lineStarts[i] > offset }) - 1
+	character := 0
+	for _, r := range d.text[d.lineStarts[line]:offset] {
+		character += utf16Len(r)
+	}
+	return position{line, character}
+}
+
+// offset converts a protocol position back to a byte offset, clamping it to
+// the end of its line.
+func (d *document) offset(pos position) int {
+	if pos.Line < 0 {
+		return 0
+	}
+	if pos.Line >= len(d.lineStarts) {
+		return len(d.text)
+	}
+
+	offset := d.lineStarts[pos.Line]
+	for character := 0; character < pos.Character && offset < len(d.text); {
+		r, size := utf8.DecodeRuneInString(d.text[offset:])
+		if r == '\n' {
+			break
+		}
+		character += utf16Len(r)
+		offset += size
+	}
+	return offset
+}
+
+func (d *document) span(start, end int) textRange {
+	return textRange{d.position(start), d.position(end)}
+}
+
+func utf16Len(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
@@ -0,0 +1,159 @@
+package lsp
+
+import "encoding/json"
+
+// JSON-RPC error codes used in responses.
+const (
+	ERROR_PARSE            = -32700
+	ERROR_INVALID_PARAMS   = -32602
+	ERROR_METHOD_NOT_FOUND = -32601
+	ERROR_INVALID_REQUEST  = -32600
+)
+
+// TEXT_SYNC_FULL asks the client to send the whole document on each change.
+const TEXT_SYNC_FULL = 1
+
+// Symbol kinds, severities and semantic token types take the numeric values
+// the protocol assigns them.
+const (
+	SYMBOL_VARIABLE = 13
+	SEVERITY_ERROR  = 1
+)
+
+// semanticTokenTypes is the legend sent to the client. A token's type is its
+// index in this list.
+var semanticTokenTypes = []string{"keyword", "variable", "property", "string", "number", "operator", "comment"}
+
+const (
+	TYPE_KEYWORD = iota
+	TYPE_VARIABLE
+	TYPE_PROPERTY
+	TYPE_STRING
+	TYPE_NUMBER
+	TYPE_OPERATOR
+	TYPE_COMMENT
+)
+
+var semanticTokenModifiers = []string{"declaration"}
+
+const MODIFIER_DECLARATION = 1 << 0
+
+type message struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Id      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type response struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Id      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *responseError  `json:"error,omitempty"`
+}
+
+type responseError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type notification struct {
+	Jsonrpc string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type position struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type textRange struct {
+	Start position `json:"start"`
+	End   position `json:"end"`
+}
+
+type location struct {
+	Uri   string    `json:"uri"`
+	Range textRange `json:"range"`
+}
+
+type serverCapabilities struct {
+	TextDocumentSync       int                   `json:"textDocumentSync"`
+	HoverProvider          bool                  `json:"hoverProvider"`
+	DefinitionProvider     bool                  `json:"definitionProvider"`
+	DocumentSymbolProvider bool                  `json:"documentSymbolProvider"`
+	SemanticTokensProvider semanticTokensOptions `json:"semanticTokensProvider"`
+}
+
+type semanticTokensOptions struct {
+	Legend semanticTokensLegend `json:"legend"`
+	Full   bool                 `json:"full"`
+}
+
+type semanticTokensLegend struct {
+	TokenTypes     []string `json:"tokenTypes"`
+	TokenModifiers []string `json:"tokenModifiers"`
+}
+
+type textDocumentIdentifier struct {
+	Uri string `json:"uri"`
+}
+
+type didOpenParams struct {
+	TextDocument struct {
+		Uri  string `json:"uri"`
+		Text string `json:"text"`
+	} `json:"textDocument"`
+}
+
+type didChangeParams struct {
+	TextDocument   textDocumentIdentifier `json:"textDocument"`
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+}
+
+type documentParams struct {
+	TextDocument textDocumentIdentifier `json:"textDocument"`
+}
+
+type positionParams struct {
+	TextDocument textDocumentIdentifier `json:"textDocument"`
+	Position     position               `json:"position"`
+}
+
+type diagnostic struct {
+	Range    textRange `json:"range"`
+	Severity int       `json:"severity"`
+	Source   string    `json:"source"`
+	Message  string    `json:"message"`
+}
+
+type publishDiagnosticsParams struct {
+	Uri         string       `json:"uri"`
+	Diagnostics []diagnostic `json:"diagnostics"`
+}
+
+type markupContent struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+type hover struct {
+	Contents markupContent `json:"contents"`
+	Range    textRange     `json:"range"`
+}
+
+type documentSymbol struct {
+	Name           string           `json:"name"`
+	Detail         string           `json:"detail,omitempty"`
+	Kind           int              `json:"kind"`
+	Range          textRange        `json:"range"`
+	SelectionRange textRange        `json:"selectionRange"`
+	Children       []documentSymbol `json:"children,omitempty"`
+}
+
+type semanticTokens struct {
+	Data []int `json:"data"`
+}
@@ -0,0 +1,166 @@
+package lsp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/caelondev/hydor/frontend/tokens"
+	"github.com/caelondev/hydor/runtime/value"
+)
+
+// semanticTokens encodes every token and comment as the protocol's
+// relative (line, start, length, type, modifiers) groups. Tokens spanning
+// several lines, like multi-line strings, are split at each line break.
+func (d *document) semanticTokens() []int {
+	type span struct{ start, end, kind, modifiers int }
+	spans := []span{}
+
+	comments := d.comments
+	for _, t := range d.tokens {
+		for len(comments) > 0 && comments[0][0] < t.Start {
+			spans = append(spans, span{comments[0][0], comments[0][1], TYPE_COMMENT, 0})
+			comments = comments[1:]
+		}
+		if kind, modifiers, ok := t.semanticType(); ok {
+			spans = append(spans, span{t.Start, t.End, kind, modifiers})
+		}
+	}
+
+	data := []int{}
+	prev := position{}
+	for _, sp := range spans {
+		for start := sp.start; start < sp.end; {
+			end := sp.end
+			if nl := strings.IndexByte(d.text[start:end], '\n'); nl >= 0 {
+				end = start + nl
+			}
+			if end > start {
+				pos := d.position(start)
+				deltaStart := pos.Character
+				if pos.Line == prev.Line {
+					deltaStart -= prev.Character
+				}
+				length := d.position(end).Character - pos.Character
+				data = append(data, pos.Line-prev.Line, deltaStart, length, sp.kind, sp.modifiers)
+				prev = pos
+			}
+			start = end + 1
+		}
+	}
+	return data
+}
+
+func (t *token) semanticType() (int, int, bool) {
+	switch t.Type {
+	case tokens.TOKEN_IDENTIFIER:
+		if t.property {
+			return TYPE_PROPERTY, 0, true
+		}
+		if t.declares {
+			return TYPE_VARIABLE, MODIFIER_DECLARATION, true
+		}
+		return TYPE_VARIABLE, 0, true
+	case tokens.TOKEN_STRING:
+		return TYPE_STRING, 0, true
+	case tokens.TOKEN_NUMBER:
+		return TYPE_NUMBER, 0, true
+	case tokens.TOKEN_ERROR, tokens.TOKEN_EOF,
+		tokens.TOKEN_LEFT_PAREN, tokens.TOKEN_RIGHT_PAREN,
+		tokens.TOKEN_LEFT_BRACE, tokens.TOKEN_RIGHT_BRACE,
+		tokens.TOKEN_COMMA, tokens.TOKEN_DOT, tokens.TOKEN_SEMICOLON:
+		return 0, 0, false
+	}
+	if _, ok := tokens.RESERVED_KEYWORDS[t.Lexeme]; ok {
+		return TYPE_KEYWORD, 0, true
+	}
+	return TYPE_OPERATOR, 0, true
+}
+
+// keywordDocs describes each keyword on hover.
+var keywordDocs = map[tokens.TokenType]string{
+	tokens.TOKEN_TRY:     "`try { body } catch (name) { handler } finally { cleanup }`\n\nEvaluates the body. If it raises an error, the catch clause runs with the error bound to its variable. The finally clause runs on every path and its value is discarded.",
+	tokens.TOKEN_CATCH:   "`catch (name) { handler }`\n\nRuns when the try body raises an error, with the error bound to `name`. Its value replaces the body's.",
+	tokens.TOKEN_FINALLY: "`finally { cleanup }`\n\nRuns after the try body and any catch clause, whether or not an error was raised. An error that reaches it is raised again once it finishes.",
+	tokens.TOKEN_THROW:   "`throw value`\n\nRaises an error. An error value is raised again as it is; any other value becomes the message of a new `Error`.",
+	tokens.TOKEN_TRUE:    "`true`: bool",
+	tokens.TOKEN_FALSE:   "`false`: bool",
+	tokens.TOKEN_NIL:     "`nil`: the absence of a value",
+}
+
+// propertyDocs describes the properties of an error value.
+var propertyDocs = map[string]string{
+	"message": "`message`: string\n\nThe error's message.",
+	"kind":    "`kind`: string\n\nThe error's kind, such as `TypeError` or `ZeroDivisionError`.",
+	"trace":   "`trace`: string\n\nThe traceback captured where the error was first raised.",
+}
+
+func (d *document) hover(offset int) *hover {
+	t := d.tokenAt(offset)
+	if t == nil {
+		return nil
+	}
+
+	text := ""
+	switch t.Type {
+	case tokens.TOKEN_NUMBER:
+		n, _ := strconv.ParseFloat(t.Lexeme, 64)
+		var out strings.Builder
+		value.FprintValue(&out, value.NumberVal(n))
+		text = fmt.Sprintf("`%s`: number", out.String())
+	case tokens.TOKEN_STRING:
+		text = fmt.Sprintf("string of %d characters", utf8.RuneCountInString(t.Lexeme))
+	case tokens.TOKEN_IDENTIFIER:
+		switch {
+		case t.property:
+			text = propertyDocs[t.Lexeme]
+		case t.binding != nil:
+			text = fmt.Sprintf("`%s`: error\n\nThe error caught by the try on line %d.", t.Lexeme, t.binding.line)
+		}
+	default:
+		if doc, ok := keywordDocs[t.Type]; ok {
+			text = doc
+		} else if _, ok := tokens.RESERVED_KEYWORDS[t.Lexeme]; ok && t.Type != tokens.TOKEN_ERROR {
+			text = fmt.Sprintf("`%s` is reserved for future use.", t.Lexeme)
+		}
+	}
+
+	if text == "" {
+		return nil
+	}
+	return &hover{
+		Contents: markupContent{Kind: "markdown", Value: text},
+		Range:    d.span(t.Start, t.End),
+	}
+}
+
+func (d *document) definition(offset int) *location {
+	t := d.tokenAt(offset)
+	if t == nil || t.Type != tokens.TOKEN_IDENTIFIER || t.binding == nil {
+		return nil
+	}
+	decl := d.tokens[t.binding.decl]
+	return &location{Uri: d.uri, Range: d.span(decl.Start, decl.End)}
+}
+
+// symbols lists the catch variables declared directly inside parent, each
+// with the variables nested in its own block as children.
+func (d *document) symbols(parent *binding) []documentSymbol {
+	symbols := []documentSymbol{}
+	for _, b := range d.bindings {
+		if b.parent != parent {
+			continue
+		}
+		decl := d.tokens[b.decl]
+		symbols = append(symbols, documentSymbol{
+			Name:           b.name,
+			Detail:         "catch variable",
+			Kind:           SYMBOL_VARIABLE,
+			Range:          d.span(b.clause[0], b.clause[1]),
+			SelectionRange: d.span(decl.Start, decl.End),
+			Children:       d.symbols(b),
+		})
+	}
+	return symbols
+}
@@ -0,0 +1,241 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/caelondev/hydor/framing"
+)
+
+var errExitBeforeShutdown = errors.New("client exited without a shutdown request")
+
+// Server speaks the Language Server Protocol over a pair of streams,
+// normally stdin and stdout. Documents are synchronized in full on every
+// change and requests are answered one at a time.
+type Server struct {
+	in  *bufio.Reader
+	out io.Writer
+
+	documents map[string]*document
+	shutdown  bool
+}
+
+// requestError is a failure reported back to the client with a JSON-RPC
+// error code.
+type requestError struct {
+	code    int
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+func NewServer(in io.Reader, out io.Writer) *Server {
+	return &Server{
+		in:        bufio.NewReader(in),
+		out:       out,
+		documents: map[string]*document{},
+	}
+}
+
+// Serve handles messages until the client sends exit or the input ends.
+func (s *Server) Serve() error {
+	for {
+		body, err := framing.ReadMessage(s.in)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var msg message
+		if err := json.Unmarshal(body, &msg); err != nil {
+			s.reply(nil, nil, &requestError{ERROR_PARSE, fmt.Sprintf("Malformed message: %s", err.Error())})
+			continue
+		}
+
+		if msg.Method == "exit" {
+			if !s.shutdown {
+				return errExitBeforeShutdown
+			}
+			return nil
+		}
+
+		result, err := s.handle(&msg)
+		if len(msg.Id) == 0 {
+			// Notifications get no reply, even when they fail.
+			continue
+		}
+		s.reply(msg.Id, result, err)
+	}
+}
+
+// handle dispatches one request or notification.
+func (s *Server) handle(msg *message) (interface{}, error) {
+	if s.shutdown && msg.Method != "shutdown" && len(msg.Id) != 0 {
+		return nil, &requestError{ERROR_INVALID_REQUEST, "The server is shutting down"}
+	}
+
+	switch msg.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": serverCapabilities{
+				TextDocumentSync:       TEXT_SYNC_FULL,
+				HoverProvider:          true,
+				DefinitionProvider:     true,
+				DocumentSymbolProvider: true,
+				SemanticTokensProvider: semanticTokensOptions{
+					Legend: semanticTokensLegend{semanticTokenTypes, semanticTokenModifiers},
+					Full:   true,
+				},
+			},
+			"serverInfo": map[string]string{"name": "hydor"},
+		}, nil
+	case "initialized":
+		return nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if err := decode(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		s.update(params.TextDocument.Uri, params.TextDocument.Text)
+		return nil, nil
+	case "textDocument/didChange":
+		var params didChangeParams
+		if err := decode(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		if n := len(params.ContentChanges); n > 0 {
+			s.update(params.TextDocument.Uri, params.ContentChanges[n-1].Text)
+		}
+		return nil, nil
+	case "textDocument/didClose":
+		var params documentParams
+		if err := decode(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		delete(s.documents, params.TextDocument.Uri)
+		s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{params.TextDocument.Uri, []diagnostic{}})
+		return nil, nil
+	case "textDocument/semanticTokens/full":
+		doc, err := s.document(msg.Params)
+		if err != nil {
+			return nil, err
+		}
+		return semanticTokens{doc.semanticTokens()}, nil
+	case "textDocument/hover":
+		doc, offset, err := s.documentPosition(msg.Params)
+		if err != nil {
+			return nil, err
+		}
+		return doc.hover(offset), nil
+	case "textDocument/definition":
+		doc, offset, err := s.documentPosition(msg.Params)
+		if err != nil {
+			return nil, err
+		}
+		return doc.definition(offset), nil
+	case "textDocument/documentSymbol":
+		doc, err := s.document(msg.Params)
+		if err != nil {
+			return nil, err
+		}
+		return doc.symbols(nil), nil
+	}
+
+	if strings.HasPrefix(msg.Method, "$/") {
+		// Optional notifications and requests may be ignored.
+		return nil, nil
+	}
+	return nil, &requestError{ERROR_METHOD_NOT_FOUND, fmt.Sprintf("Unsupported method '%s'", msg.Method)}
+}
+
+// update replaces a document's text and publishes its diagnostics.
+func (s *Server) update(uri, text string) {
+	doc := newDocument(uri, text)
+	s.documents[uri] = doc
+	s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{uri, doc.diagnostics})
+}
+
+func (s *Server) document(raw json.RawMessage) (*document, error) {
+	var params documentParams
+	if err := decode(raw, &params); err != nil {
+		return nil, err
+	}
+	return s.lookup(params.TextDocument.Uri)
+}
+
+func (s *Server) documentPosition(raw json.RawMessage) (*document, int, error) {
+	var params positionParams
+	if err := decode(raw, &params); err != nil {
+		return nil, 0, err
+	}
+	doc, err := s.lookup(params.TextDocument.Uri)
+	if err != nil {
+		return nil, 0, err
+	}
+	return doc, doc.offset(params.Position), nil
+}
+
+func (s *Server) lookup(uri string) (*document, error) {
+	doc, ok := s.documents[uri]
+	if !ok {
+		return nil, &requestError{ERROR_INVALID_PARAMS, fmt.Sprintf("Document '%s' is not open", uri)}
+	}
+	return doc, nil
+}
+
+func (s *Server) reply(id json.RawMessage, result interface{}, err error) {
+	res := response{Jsonrpc: "2.0", Id: id}
+	if id == nil {
+		res.Id = json.RawMessage("null")
+	}
+
+	if err != nil {
+		code := ERROR_INVALID_REQUEST
+		var reqErr *requestError
+		if errors.As(err, &reqErr) {
+			code = reqErr.code
+		}
+		res.Error = &responseError{code, err.Error()}
+	} else {
+		data, marshalErr := json.Marshal(result)
+		if marshalErr != nil {
+			res.Error = &responseError{ERROR_INVALID_REQUEST, marshalErr.Error()}
+		} else {
+			res.Result = data
+		}
+	}
+	s.send(res)
+}
+
+func (s *Server) notify(method string, params interface{}) {
+	s.send(notification{Jsonrpc: "2.0", Method: method, Params: params})
+}
+
+func (s *Server) send(msg interface{}) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	framing.WriteMessage(s.out, data)
+}
+
+func decode(raw json.RawMessage, params interface{}) error {
+	if len(raw) == 0 {
+		return &requestError{ERROR_INVALID_PARAMS, "Missing params"}
+	}
+	if err := json.Unmarshal(raw, params); err != nil {
+		return &requestError{ERROR_INVALID_PARAMS, fmt.Sprintf("Invalid params: %s", err.Error())}
+	}
+	return nil
+}
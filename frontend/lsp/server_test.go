@@ -0,0 +1,328 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caelondev/hydor/framing"
+	"github.com/caelondev/hydor/frontend/tokens"
+)
+
+const uri = "file:///main.hd"
+
+// incoming is a response or notification from the server.
+type incoming struct {
+	Id     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *responseError  `json:"error"`
+}
+
+// client drives a Server over pipes the way an editor would. The server
+// answers each message before reading the next, so messages arrive in
+// order.
+type client struct {
+	t        *testing.T
+	in       *io.PipeWriter
+	id       int
+	messages chan *incoming
+	served   chan error
+}
+
+func newClient(t *testing.T) *client {
+	inReader, inWriter := io.Pipe()
+	outReader, outWriter := io.Pipe()
+	c := &client{
+		t:        t,
+		in:       inWriter,
+		messages: make(chan *incoming, 16),
+		served:   make(chan error, 1),
+	}
+
+	go func() {
+		c.served <- NewServer(inReader, outWriter).Serve()
+		outWriter.Close()
+	}()
+	go func() {
+		defer close(c.messages)
+		r := bufio.NewReader(outReader)
+		for {
+			body, err := framing.ReadMessage(r)
+			if err != nil {
+				return
+			}
+			var m incoming
+			if err := json.Unmarshal(body, &m); err != nil {
+				t.Errorf("server sent malformed JSON: %s", body)
+				return
+			}
+			c.messages <- &m
+		}
+	}()
+
+	t.Cleanup(func() {
+		inWriter.Close()
+		outReader.Close()
+	})
+	return c
+}
+
+func (c *client) write(msg map[string]interface{}) {
+	c.t.Helper()
+	msg["jsonrpc"] = "2.0"
+	data, err := json.Marshal(msg)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if err := framing.WriteMessage(c.in, data); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *client) next() *incoming {
+	c.t.Helper()
+	select {
+	case m, ok := <-c.messages:
+		if !ok {
+			c.t.Fatal("server closed the stream")
+		}
+		return m
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("timed out waiting for the server")
+	}
+	return nil
+}
+
+// call sends a request and decodes its result into result, which may be
+// nil. It returns the error the server answered with, if any.
+func (c *client) call(method string, params interface{}, result interface{}) *responseError {
+	c.t.Helper()
+	c.id++
+	c.write(map[string]interface{}{"id": c.id, "method": method, "params": params})
+	m := c.next()
+	if string(m.Id) != strconv.Itoa(c.id) {
+		c.t.Fatalf("%s: got a reply to %s", method, m.Id)
+	}
+	if m.Error == nil && result != nil {
+		if err := json.Unmarshal(m.Result, result); err != nil {
+			c.t.Fatalf("%s result %s: %v", method, m.Result, err)
+		}
+	}
+	return m.Error
+}
+
+func (c *client) notify(method string, params interface{}) {
+	c.t.Helper()
+	c.write(map[string]interface{}{"method": method, "params": params})
+}
+
+// diagnostics reads the diagnostics published after a document changes.
+func (c *client) diagnostics() []diagnostic {
+	c.t.Helper()
+	m := c.next()
+	if m.Method != "textDocument/publishDiagnostics" {
+		c.t.Fatalf("got %s, want published diagnostics", m.Method)
+	}
+	var params publishDiagnosticsParams
+	if err := json.Unmarshal(m.Params, &params); err != nil {
+		c.t.Fatal(err)
+	}
+	if params.Uri != uri {
+		c.t.Errorf("diagnostics for %s, want %s", params.Uri, uri)
+	}
+	return params.Diagnostics
+}
+
+func (c *client) open(text string) []diagnostic {
+	c.t.Helper()
+	c.notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri, "languageId": "hydor", "version": 1, "text": text},
+	})
+	return c.diagnostics()
+}
+
+func (c *client) change(text string) []diagnostic {
+	c.t.Helper()
+	c.notify("textDocument/didChange", map[string]interface{}{
+		"textDocument":   map[string]interface{}{"uri": uri, "version": 2},
+		"contentChanges": []map[string]string{{"text": text}},
+	})
+	return c.diagnostics()
+}
+
+func at(line, character int) map[string]interface{} {
+	return map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri},
+		"position":     position{line, character},
+	}
+}
+
+const source = `// demo
+try { 1 / 0 } catch (e) {
+  /* inner */ try { throw e.message } catch (f) { f.kind + e.kind }
+} finally { "x" }`
+
+func TestSession(t *testing.T) {
+	c := newClient(t)
+
+	var init struct {
+		Capabilities serverCapabilities
+	}
+	if err := c.call("initialize", map[string]interface{}{}, &init); err != nil {
+		t.Fatal(err.Message)
+	}
+	if init.Capabilities.TextDocumentSync != TEXT_SYNC_FULL || !init.Capabilities.HoverProvider {
+		t.Errorf("capabilities = %+v", init.Capabilities)
+	}
+	c.notify("initialized", map[string]interface{}{})
+
+	if diags := c.open(source); len(diags) != 0 {
+		t.Errorf("diagnostics for a valid document: %+v", diags)
+	}
+
+	hovers := []struct {
+		line, character int
+		want            string
+	}{
+		{2, 34, "`message`: string"},
+		{1, 0, "`try { body } catch (name) { handler } finally { cleanup }`"},
+		{2, 50, "`f`: error\n\nThe error caught by the try on line 3."},
+		{1, 6, "`1`: number"},
+	}
+	for _, h := range hovers {
+		var got *hover
+		if err := c.call("textDocument/hover", at(h.line, h.character), &got); err != nil {
+			t.Fatal(err.Message)
+		}
+		if got == nil || !strings.HasPrefix(got.Contents.Value, h.want) {
+			t.Errorf("hover at %d:%d = %+v, want %q", h.line, h.character, got, h.want)
+		}
+	}
+	var none *hover
+	c.call("textDocument/hover", at(0, 3), &none)
+	if none != nil {
+		t.Errorf("hover inside a comment = %+v, want nothing", none)
+	}
+
+	// The e in e.kind refers to the outer catch variable.
+	var def *location
+	c.call("textDocument/definition", at(2, 59), &def)
+	if def == nil || def.Range.Start != (position{1, 21}) || def.Range.End != (position{1, 22}) {
+		t.Errorf("definition = %+v, want the outer e", def)
+	}
+
+	var symbols []documentSymbol
+	c.call("textDocument/documentSymbol", map[string]interface{}{"textDocument": map[string]string{"uri": uri}}, &symbols)
+	if len(symbols) != 1 || symbols[0].Name != "e" || len(symbols[0].Children) != 1 || symbols[0].Children[0].Name != "f" {
+		t.Errorf("symbols = %+v, want f nested in e", symbols)
+	}
+
+	var tokens semanticTokens
+	c.call("textDocument/semanticTokens/full", map[string]interface{}{"textDocument": map[string]string{"uri": uri}}, &tokens)
+	if len(tokens.Data)%5 != 0 || len(tokens.Data) < 5 {
+		t.Fatalf("semantic tokens %v are not groups of five", tokens.Data)
+	}
+	if first := tokens.Data[:5]; first[0] != 0 || first[1] != 0 || first[2] != 7 || first[3] != TYPE_COMMENT {
+		t.Errorf("first semantic token %v, want the comment", first)
+	}
+
+	if err := c.call("shutdown", nil, nil); err != nil {
+		t.Fatal(err.Message)
+	}
+	c.notify("exit", nil)
+	if err := <-c.served; err != nil {
+		t.Errorf("Serve: %v", err)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	c := newClient(t)
+	c.call("initialize", map[string]interface{}{}, nil)
+	c.open("1")
+
+	tests := []struct {
+		text       string
+		start, end position
+		message    string
+	}{
+		{`1 + "abc`, position{0, 4}, position{0, 8}, "Unterminated non-multiline string"},
+		{"1 +", position{0, 3}, position{0, 3}, "Expected expression"},
+		{"try { x } catch (e) { y }", position{0, 6}, position{0, 7}, "Undefined variable 'x'"},
+		// Columns count UTF-16 code units.
+		{"\"😀\" + z", position{0, 7}, position{0, 8}, "Undefined variable 'z'"},
+	}
+	for _, tt := range tests {
+		diags := c.change(tt.text)
+		if len(diags) != 1 {
+			t.Errorf("%q: %d diagnostics, want 1", tt.text, len(diags))
+			continue
+		}
+		d := diags[0]
+		if d.Message != tt.message || d.Range.Start != tt.start || d.Range.End != tt.end || d.Severity != SEVERITY_ERROR {
+			t.Errorf("%q: diagnostic %+v, want %q at %v-%v", tt.text, d, tt.message, tt.start, tt.end)
+		}
+	}
+
+	if diags := c.change("1 + 2"); len(diags) != 0 {
+		t.Errorf("fixed document still has diagnostics: %+v", diags)
+	}
+}
+
+func TestRequestErrors(t *testing.T) {
+	c := newClient(t)
+	c.call("initialize", map[string]interface{}{}, nil)
+
+	if err := c.call("bogus", nil, nil); err == nil || err.Code != ERROR_METHOD_NOT_FOUND {
+		t.Errorf("unknown method: error %+v, want method not found", err)
+	}
+	if err := c.call("textDocument/hover", at(0, 0), nil); err == nil {
+		t.Error("hover on an unopened document succeeded")
+	}
+	if err := c.call("textDocument/hover", "nonsense", nil); err == nil || err.Code != ERROR_INVALID_PARAMS {
+		t.Errorf("malformed params: error %+v, want invalid params", err)
+	}
+
+	// $/ notifications are optional and ignored, so the next reply is for
+	// the request that follows.
+	c.notify("$/cancelRequest", map[string]int{"id": 1})
+	if err := c.call("shutdown", nil, nil); err != nil {
+		t.Fatal(err.Message)
+	}
+}
+
+func TestExitWithoutShutdown(t *testing.T) {
+	c := newClient(t)
+	c.notify("exit", nil)
+	if err := <-c.served; err != errExitBeforeShutdown {
+		t.Errorf("Serve returned %v, want %v", err, errExitBeforeShutdown)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	d := newDocument(uri, `try { e } catch (e) { try { e } catch (e) { e } finally { e } } finally { e }`)
+
+	// Each use of e names the declaration at the given offset, or none.
+	want := map[int]int{6: -1, 28: 17, 44: 39, 58: 17, 74: -1}
+	for _, tok := range d.tokens {
+		if tok.Type != tokens.TOKEN_IDENTIFIER || tok.declares {
+			continue
+		}
+		decl, ok := want[tok.Start]
+		if !ok {
+			t.Fatalf("unexpected identifier at %d", tok.Start)
+		}
+		got := -1
+		if tok.binding != nil {
+			got = d.tokens[tok.binding.decl].Start
+		}
+		if got != decl {
+			t.Errorf("e at %d resolves to %d, want %d", tok.Start, got, decl)
+		}
+	}
+}
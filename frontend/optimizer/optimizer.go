@@ -0,0 +1,184 @@
+package optimizer
+
+import "github.com/caelondev/hydor/frontend/bytecode"
+
+type Level int
+
+const (
+	// O0 leaves the compiler's output untouched.
+	O0 Level = iota
+	// O1 folds constants and runs the peephole pass.
+	O1
+)
+
+type instruction struct {
+	op      bytecode.OpCode
+	operand []byte
+	line    int
+	// offset is where the instruction started before optimizing.
+	offset int
+}
+
+// fusions maps an instruction followed by OP_NOT onto the single opcode
+// with the same meaning.
+var fusions = map[bytecode.OpCode]bytecode.OpCode{
+	bytecode.OP_EQUAL:   bytecode.OP_NOT_EQUAL,
+	bytecode.OP_LESS:    bytecode.OP_GREATER_EQUAL,
+	bytecode.OP_GREATER: bytecode.OP_LESS_EQUAL,
+}
+
+// Optimize rewrites bc in place. The chunk must already have passed
+// verification so every instruction decodes cleanly.
+func Optimize(bc *bytecode.Bytecode, level Level) {
+	if level < O1 {
+		return
+	}
+
+	instructions := decode(bc)
+	thread(instructions)
+	instructions = peephole(instructions, labels(bc))
+	relocate(bc, instructions)
+
+	bc.Code = bc.Code[:0]
+	bc.Lines = bc.Lines[:0]
+	for _, in := range instructions {
+		bc.Write(byte(in.op), in.line)
+		for _, b := range in.operand {
+			bc.Write(b, in.line)
+		}
+	}
+}
+
+// labels returns the offsets that jumps, handlers and locals refer to. Control can
+// arrive at them from elsewhere, so they must not be fused into the
+// instruction before them.
+func labels(bc *bytecode.Bytecode) map[int]bool {
+	labels := map[int]bool{}
+	for offset := 0; offset < len(bc.Code); {
+		op := bytecode.OpCode(bc.Code[offset])
+		if bytecode.IsJump(op) {
+			labels[bc.JumpTarget(offset)] = true
+		}
+		offset += 1 + bytecode.OperandWidth(op)
+	}
+	for _, h := range bc.Handlers {
+		labels[h.Start] = true
+		labels[h.End] = true
+		labels[h.Target] = true
+	}
+	for _, l := range bc.Locals {
+		labels[l.Start] = true
+		labels[l.End] = true
+	}
+	return labels
+}
+
+// relocate rewrites jump operands, handler offsets and local ranges for the
+// instructions' new positions.
+func relocate(bc *bytecode.Bytecode, instructions []instruction) {
+	moved := make(map[int]int, len(instructions)+1)
+	end := 0
+	for _, in := range instructions {
+		moved[in.offset] = end
+		end += 1 + len(in.operand)
+	}
+	moved[len(bc.Code)] = end
+
+	for i := range instructions {
+		in := &instructions[i]
+		if !bytecode.IsJump(in.op) {
+			continue
+		}
+		target := in.offset + 3 + bytecode.ReadUint16(in.operand, 0)
+		jump := moved[target] - moved[in.offset] - 3
+		in.operand[0] = byte(jump)
+		in.operand[1] = byte(jump >> 8)
+	}
+
+	for i := range bc.Handlers {
+		h := &bc.Handlers[i]
+		h.Start, h.End, h.Target = moved[h.Start], moved[h.End], moved[h.Target]
+	}
+	for i := range bc.Locals {
+		l := &bc.Locals[i]
+		l.Start, l.End = moved[l.Start], moved[l.End]
+	}
+}
+
+// thread points each jump that lands on an unconditional OP_JUMP at that
+// jump's final destination. OP_JUMP only moves the instruction pointer, so
+// skipping it changes nothing else. Jumps only go forward, so every chain
+// ends.
+func thread(instructions []instruction) {
+	at := make(map[int]*instruction, len(instructions))
+	for i := range instructions {
+		at[instructions[i].offset] = &instructions[i]
+	}
+
+	for i := range instructions {
+		in := &instructions[i]
+		if !bytecode.IsJump(in.op) {
+			continue
+		}
+		target := in.offset + 3 + bytecode.ReadUint16(in.operand, 0)
+		for next, ok := at[target]; ok && next.op == bytecode.OP_JUMP; next, ok = at[target] {
+			target = next.offset + 3 + bytecode.ReadUint16(next.operand, 0)
+		}
+		jump := target - in.offset - 3
+		in.operand[0] = byte(jump)
+		in.operand[1] = byte(jump >> 8)
+	}
+}
+
+func decode(bc *bytecode.Bytecode) []instruction {
+	lines := make([]int, 0, len(bc.Code))
+	for _, run := range bc.Lines {
+		for i := 0; i < run.Count; i++ {
+			lines = append(lines, run.Line)
+		}
+	}
+
+	instructions := []instruction{}
+	for offset := 0; offset < len(bc.Code); {
+		op := bytecode.OpCode(bc.Code[offset])
+		width := bytecode.OperandWidth(op)
+		instructions = append(instructions, instruction{
+			op:      op,
+			operand: append([]byte(nil), bc.Code[offset+1:offset+1+width]...),
+			line:    lines[offset],
+			offset:  offset,
+		})
+		offset += 1 + width
+	}
+	return instructions
+}
+
+// peephole fuses adjacent instructions. A fused instruction takes the line
+// of the instruction that could raise a runtime error, so error reports
+// point at the same line as unoptimized code. Instructions at a label are
+// never fused away.
+func peephole(in []instruction, labels map[int]bool) []instruction {
+	out := make([]instruction, 0, len(in))
+
+	for _, next := range in {
+		if len(out) == 0 || labels[next.offset] {
+			out = append(out, next)
+			continue
+		}
+		last := &out[len(out)-1]
+
+		if fused, ok := fusions[last.op]; ok && next.op == bytecode.OP_NOT {
+			last.op = fused
+			continue
+		}
+
+		if last.op == bytecode.OP_CONSTANT && next.op == bytecode.OP_ADD {
+			last.op = bytecode.OP_ADD_CONSTANT
+			last.line = next.line
+			continue
+		}
+
+		out = append(out, next)
+	}
+	return out
+}
@@ -4,20 +4,19 @@ import (
 	"fmt"
 	"strconv"
 
-	"github.com/caelondev/hydor/frontend/bytecode"
+	"github.com/caelondev/hydor/frontend/ast"
 	"github.com/caelondev/hydor/frontend/lexer"
 	"github.com/caelondev/hydor/frontend/tokens"
 	"github.com/caelondev/hydor/runtime/value"
 )
 
-const UINT8_MAX = 255
-
 type Precedence int
-type ParseFn func(*Parser)
+type PrefixFn func(*Parser) ast.Expr
+type InfixFn func(p *Parser, left ast.Expr) ast.Expr
 
 type ParseRule struct {
-	prefix     ParseFn
-	infix      ParseFn
+	prefix     PrefixFn
+	infix      InfixFn
 	precedence Precedence
 }
 
@@ -35,6 +34,8 @@ const (
 	PREC_PRIMARY
 )
 
+// parseRules is filled once in init and only read afterwards, so parsers
+// running on different goroutines can share it.
 var parseRules map[tokens.TokenType]ParseRule
 
 func init() {
@@ -44,7 +45,7 @@ func init() {
 		tokens.TOKEN_LEFT_BRACE:    {nil, nil, PREC_NONE},
 		tokens.TOKEN_RIGHT_BRACE:   {nil, nil, PREC_NONE},
 		tokens.TOKEN_COMMA:         {nil, nil, PREC_NONE},
-		tokens.TOKEN_DOT:           {nil, nil, PREC_NONE},
+		tokens.TOKEN_DOT:           {nil, parseDot, PREC_CALL},
 		tokens.TOKEN_MINUS:         {parseUnary, parseBinary, PREC_TERM},
 		tokens.TOKEN_PLUS:          {nil, parseBinary, PREC_TERM},
 		tokens.TOKEN_SEMICOLON:     {nil, nil, PREC_NONE},
@@ -59,13 +60,15 @@ func init() {
 		tokens.TOKEN_GREATER_EQUAL: {nil, parseBinary, PREC_COMPARISON},
 		tokens.TOKEN_LESS:          {nil, parseBinary, PREC_COMPARISON},
 		tokens.TOKEN_LESS_EQUAL:    {nil, parseBinary, PREC_COMPARISON},
-		tokens.TOKEN_IDENTIFIER:    {nil, nil, PREC_NONE},
+		tokens.TOKEN_IDENTIFIER:    {parseVariable, nil, PREC_NONE},
 		tokens.TOKEN_STRING:        {parseString, nil, PREC_NONE},
 		tokens.TOKEN_NUMBER:        {parseNumber, nil, PREC_NONE},
 		tokens.TOKEN_AND:           {nil, nil, PREC_NONE},
+		tokens.TOKEN_CATCH:         {nil, nil, PREC_NONE},
 		tokens.TOKEN_CLASS:         {nil, nil, PREC_NONE},
 		tokens.TOKEN_ELSE:          {nil, nil, PREC_NONE},
 		tokens.TOKEN_FALSE:         {parseLiteral, nil, PREC_NONE},
+		tokens.TOKEN_FINALLY:       {nil, nil, PREC_NONE},
 		tokens.TOKEN_FOR:           {nil, nil, PREC_NONE},
 		tokens.TOKEN_FUNCTION:      {nil, nil, PREC_NONE},
 		tokens.TOKEN_IF:            {nil, nil, PREC_NONE},
@@ -75,9 +78,12 @@ func init() {
 		tokens.TOKEN_RETURN:        {nil, nil, PREC_NONE},
 		tokens.TOKEN_SUPER:         {nil, nil, PREC_NONE},
 		tokens.TOKEN_THIS:          {nil, nil, PREC_NONE},
+		tokens.TOKEN_THROW:         {parseThrow, nil, PREC_NONE},
 		tokens.TOKEN_TRUE:          {parseLiteral, nil, PREC_NONE},
+		tokens.TOKEN_TRY:           {parseTry, nil, PREC_NONE},
 		tokens.TOKEN_VAR:           {nil, nil, PREC_NONE},
 		tokens.TOKEN_WHILE:         {nil, nil, PREC_NONE},
+		tokens.TOKEN_COMMENT:       {nil, nil, PREC_NONE},
 		tokens.TOKEN_ERROR:         {nil, nil, PREC_NONE},
 		tokens.TOKEN_EOF:           {nil, nil, PREC_NONE},
 	}
@@ -87,25 +93,29 @@ type Parser struct {
 	lexer               *lexer.Tokenizer
 	current, previous   tokens.Token
 	hadError, panicMode bool
-	compilingChunk      *bytecode.Bytecode
+
+	// err is the first error found. Later ones are usually knock-on
+	// effects of it, so only the first is reported.
+	err *ast.Error
 }
 
 func NewParser() *Parser {
 	return &Parser{}
 }
 
-func (p *Parser) Compile(source string, lexer *lexer.Tokenizer, chunk *bytecode.Bytecode) bool {
+// Parse builds the syntax tree of the source lexer reads. On a syntax
+// error it still returns the tree as far as it got, along with the error.
+func (p *Parser) Parse(lexer *lexer.Tokenizer) (*ast.Program, *ast.Error) {
 	p.lexer = lexer
-	p.compilingChunk = chunk
 	p.hadError = false
 	p.panicMode = false
+	p.err = nil
 
 	p.advance()
-	p.expression()
-	p.consume(tokens.TOKEN_EOF, "Expected end of file")
-	p.endCompiler()
+	program := &ast.Program{Expr: p.expression()}
+	program.EOF = p.consume(tokens.TOKEN_EOF, "Expected end of file")
 
-	return !p.hadError
+	return program, p.err
 }
 
 func (p *Parser) advance() {
@@ -119,12 +129,23 @@ func (p *Parser) advance() {
 	}
 }
 
-func (p *Parser) consume(tt tokens.TokenType, msg string) {
+func (p *Parser) match(tt tokens.TokenType) bool {
+	if p.current.Type != tt {
+		return false
+	}
+	p.advance()
+	return true
+}
+
+// consume returns the expected token, or on an error the token found in
+// its place.
+func (p *Parser) consume(tt tokens.TokenType, msg string) tokens.Token {
 	if p.current.Type == tt {
 		p.advance()
-		return
+		return p.previous
 	}
 	p.errorAtCurrent(msg)
+	return p.current
 }
 
 func (p *Parser) error(msg string) {
@@ -141,136 +162,129 @@ func (p *Parser) errorAt(t *tokens.Token, msg string) {
 	}
 	p.panicMode = true
 	p.hadError = true
-
-	fmt.Printf("[line %d] Error", t.Line)
-	if t.Type == tokens.TOKEN_EOF {
-		fmt.Printf(" at end")
-	} else if t.Type != tokens.TOKEN_ERROR {
-		fmt.Printf(" at '%s'", t.Lexeme)
+	p.err = &ast.Error{At: *t, Message: msg, Offset: t.Start}
+	if t.Type == tokens.TOKEN_ERROR {
+		p.err.Offset = p.previous.Start
 	}
-	fmt.Printf(": %s\n", msg)
 }
 
-func (p *Parser) expression() {
-	p.parsePrecedence(PREC_ASSIGNMENT)
+func (p *Parser) expression() ast.Expr {
+	return p.parsePrecedence(PREC_ASSIGNMENT)
 }
 
-func (p *Parser) parsePrecedence(precedence Precedence) {
+func (p *Parser) parsePrecedence(precedence Precedence) ast.Expr {
 	p.advance()
 	prefix := parseRules[p.previous.Type].prefix
 	if prefix == nil {
 		p.error("Expected expression")
-		return
+		return nil
 	}
-	prefix(p)
+	expr := prefix(p)
 
 	for precedence <= parseRules[p.current.Type].precedence {
 		p.advance()
 		infix := parseRules[p.previous.Type].infix
-		infix(p)
+		expr = infix(p, expr)
 	}
+	return expr
 }
 
-func (p *Parser) emitByte(b byte) {
-	p.compilingChunk.Write(b, p.previous.Line)
+// ---- Parse functions ----
+
+func parseString(p *Parser) ast.Expr {
+	str := value.NewString(p.previous.Lexeme)
+	return &ast.Literal{Token: p.previous, Value: value.ObjVal(str.AsObj())}
 }
 
-func (p *Parser) emitBytes(b1, b2 byte) {
-	p.emitByte(b1)
-	p.emitByte(b2)
+func parseNumber(p *Parser) ast.Expr {
+	val, _ := strconv.ParseFloat(p.previous.Lexeme, 64)
+	return &ast.Literal{Token: p.previous, Value: value.NumberVal(val)}
 }
 
-func (p *Parser) emitReturn() {
-	p.emitByte(byte(bytecode.OP_RETURN))
+func parseUnary(p *Parser) ast.Expr {
+	expr := &ast.Unary{Operator: p.previous}
+	expr.Operand = p.parsePrecedence(PREC_parseUnary)
+	return expr
 }
 
-func (p *Parser) emitConstant(v value.Value) {
-	p.emitBytes(byte(bytecode.OP_CONSTANT), p.makeConstant(v))
+func parseBinary(p *Parser, left ast.Expr) ast.Expr {
+	expr := &ast.Binary{Left: left, Operator: p.previous}
+	rule := parseRules[expr.Operator.Type]
+	expr.Right = p.parsePrecedence(rule.precedence + 1)
+	return expr
 }
 
-func (p *Parser) makeConstant(v value.Value) byte {
-	idx := p.compilingChunk.AddConstant(v)
-	if idx > UINT8_MAX {
-		p.error("Too many constants")
-		return 0
+func parseLiteral(p *Parser) ast.Expr {
+	var v value.Value
+	switch p.previous.Type {
+	case tokens.TOKEN_FALSE:
+		v = value.BoolVal(false)
+	case tokens.TOKEN_TRUE:
+		v = value.BoolVal(true)
+	case tokens.TOKEN_NIL:
+		v = value.NilVal()
 	}
-	return byte(idx)
+	return &ast.Literal{Token: p.previous, Value: v}
 }
 
-func (p *Parser) endCompiler() {
-	p.emitReturn()
+func parseGrouping(p *Parser) ast.Expr {
+	group := &ast.Grouping{LeftParen: p.previous}
+	group.Expr = p.expression()
+	group.RightParen = p.consume(tokens.TOKEN_RIGHT_PAREN, "Expected ')' after parseGrouping")
+	return group
 }
 
-// ---- Parse functions ----
-
-func parseString(p *Parser) {
-	str := value.NewString(p.previous.Lexeme)
-	p.emitConstant(value.ObjVal(str.AsObj()))
+func parseVariable(p *Parser) ast.Expr {
+	return &ast.Variable{Name: p.previous}
 }
 
-func parseNumber(p *Parser) {
-	val, _ := strconv.ParseFloat(p.previous.Lexeme, 64)
-	p.emitConstant(value.NumberVal(val))
+func parseDot(p *Parser, left ast.Expr) ast.Expr {
+	dot := p.previous
+	name := p.consume(tokens.TOKEN_IDENTIFIER, "Expected property name after '.'")
+	return &ast.Property{Object: left, Dot: dot, Name: name}
 }
 
-func parseUnary(p *Parser) {
-	op := p.previous.Type
-	p.parsePrecedence(PREC_parseUnary)
+func parseThrow(p *Parser) ast.Expr {
+	expr := &ast.Throw{Keyword: p.previous}
+	expr.Value = p.expression()
+	return expr
+}
 
-	switch op {
-	case tokens.TOKEN_MINUS:
-		p.emitByte(byte(bytecode.OP_NEGATE))
-	case tokens.TOKEN_BANG:
-		p.emitByte(byte(bytecode.OP_NOT))
+// parseTry parses
+//
+//	try { body } catch (name) { handler } finally { cleanup }
+//
+// where either the catch or the finally clause may be left out.
+func parseTry(p *Parser) ast.Expr {
+	expr := &ast.Try{Keyword: p.previous}
+	expr.Body = p.block("try")
+
+	if p.current.Type != tokens.TOKEN_CATCH && p.current.Type != tokens.TOKEN_FINALLY {
+		p.errorAtCurrent("Expected 'catch' or 'finally' after try block")
+		return expr
 	}
-}
 
-func parseBinary(p *Parser) {
-	op := p.previous.Type
-	rule := parseRules[op]
-	p.parsePrecedence(rule.precedence + 1)
-	switch op {
-	case tokens.TOKEN_PLUS:
-		p.emitByte(byte(bytecode.OP_ADD))
-	case tokens.TOKEN_MINUS:
-		p.emitByte(byte(bytecode.OP_SUBTRACT))
-	case tokens.TOKEN_STAR:
-		p.emitByte(byte(bytecode.OP_MULTIPLY))
-	case tokens.TOKEN_SLASH:
-		p.emitByte(byte(bytecode.OP_DIVIDE))
-	case tokens.TOKEN_PERCENT:
-		p.emitByte(byte(bytecode.OP_MODULO))
-
-	// !(a == b)
-	case tokens.TOKEN_BANG_EQUAL:
-		p.emitBytes(byte(bytecode.OP_EQUAL), byte(bytecode.OP_NOT))
-	case tokens.TOKEN_EQUAL_EQUAL:
-		p.emitByte(byte(bytecode.OP_EQUAL))
-	case tokens.TOKEN_GREATER:
-		p.emitByte(byte(bytecode.OP_GREATER))
-	// !(a < b)
-	case tokens.TOKEN_GREATER_EQUAL:
-		p.emitBytes(byte(bytecode.OP_LESS), byte(bytecode.OP_NOT))
-	case tokens.TOKEN_LESS:
-		p.emitByte(byte(bytecode.OP_LESS))
-	// !(a > b)
-	case tokens.TOKEN_LESS_EQUAL:
-		p.emitBytes(byte(bytecode.OP_GREATER), byte(bytecode.OP_NOT))
+	if p.match(tokens.TOKEN_CATCH) {
+		clause := &ast.Catch{Keyword: p.previous}
+		p.consume(tokens.TOKEN_LEFT_PAREN, "Expected '(' after 'catch'")
+		clause.Name = p.consume(tokens.TOKEN_IDENTIFIER, "Expected error variable name")
+		clause.RightParen = p.consume(tokens.TOKEN_RIGHT_PAREN, "Expected ')' after error variable name")
+		clause.Body = p.block("catch")
+		expr.Catch = clause
 	}
-}
 
-func parseLiteral(p *Parser) {
-	switch p.previous.Type {
-	case tokens.TOKEN_FALSE:
-		p.emitByte(byte(bytecode.OP_FALSE))
-	case tokens.TOKEN_TRUE:
-		p.emitByte(byte(bytecode.OP_TRUE))
-	case tokens.TOKEN_NIL:
-		p.emitByte(byte(bytecode.OP_NIL))
+	if p.match(tokens.TOKEN_FINALLY) {
+		expr.Finally = &ast.Finally{Keyword: p.previous}
+		expr.Finally.Body = p.block("finally")
 	}
+	return expr
 }
 
-func parseGrouping(p *Parser) {
-	p.expression()
-	p.consume(tokens.TOKEN_RIGHT_PAREN, "Expected ')' after parseGrouping")
+// block parses a braced expression following the keyword it belongs to.
+func (p *Parser) block(keyword string) *ast.Block {
+	b := &ast.Block{}
+	b.LeftBrace = p.consume(tokens.TOKEN_LEFT_BRACE, fmt.Sprintf("Expected '{' after '%s'", keyword))
+	b.Expr = p.expression()
+	b.RightBrace = p.consume(tokens.TOKEN_RIGHT_BRACE, fmt.Sprintf("Expected '}' after %s block", keyword))
+	return b
 }
@@ -0,0 +1,134 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/caelondev/hydor/frontend/ast"
+	"github.com/caelondev/hydor/frontend/lexer"
+)
+
+// show prints e as an S-expression, with "_" for a missing child.
+func show(e ast.Expr) string {
+	switch e := e.(type) {
+	case nil:
+		return "_"
+	case *ast.Literal:
+		return e.Token.Lexeme
+	case *ast.Variable:
+		return e.Name.Lexeme
+	case *ast.Grouping:
+		return fmt.Sprintf("(group %s)", show(e.Expr))
+	case *ast.Unary:
+		return fmt.Sprintf("(%s %s)", e.Operator.Lexeme, show(e.Operand))
+	case *ast.Binary:
+		return fmt.Sprintf("(%s %s %s)", e.Operator.Lexeme, show(e.Left), show(e.Right))
+	case *ast.Property:
+		return fmt.Sprintf("(. %s %s)", show(e.Object), e.Name.Lexeme)
+	case *ast.Throw:
+		return fmt.Sprintf("(throw %s)", show(e.Value))
+	case *ast.Try:
+		var b strings.Builder
+		fmt.Fprintf(&b, "(try %s", showBlock(e.Body))
+		if e.Catch != nil {
+			fmt.Fprintf(&b, " (catch %s %s)", e.Catch.Name.Lexeme, showBlock(e.Catch.Body))
+		}
+		if e.Finally != nil {
+			fmt.Fprintf(&b, " (finally %s)", showBlock(e.Finally.Body))
+		}
+		return b.String() + ")"
+	}
+	return fmt.Sprintf("<%T>", e)
+}
+
+func showBlock(b *ast.Block) string {
+	if b == nil {
+		return "_"
+	}
+	return "{" + show(b.Expr) + "}"
+}
+
+func parse(source string) (*ast.Program, *ast.Error) {
+	return NewParser().Parse(lexer.NewTokenizer(source))
+}
+
+func TestParse(t *testing.T) {
+	tests := map[string]string{
+		`1`:                                 `1`,
+		`1 + 2 * 3`:                         `(+ 1 (* 2 3))`,
+		`(1 + 2) * 3`:                       `(* (group (+ 1 2)) 3)`,
+		`1 - 2 - 3`:                         `(- (- 1 2) 3)`,
+		`-1 % 2`:                            `(% (- 1) 2)`,
+		`!!true == false`:                   `(== (! (! true)) false)`,
+		`1 < 2 == 3 >= 4`:                   `(== (< 1 2) (>= 3 4))`,
+		`1 + 2 != 3 - 4`:                    `(!= (+ 1 2) (- 3 4))`,
+		`"a" + nil`:                         `(+ a nil)`,
+		`throw 1 + 2`:                       `(throw (+ 1 2))`,
+		`try { 1 } catch (e) { e.message }`: `(try {1} (catch e {(. e message)}))`,
+		`try { 1 } finally { 2 }`:           `(try {1} (finally {2}))`,
+		`try { throw 1 } catch (e) { e } finally { nil }`: `(try {(throw 1)} (catch e {e}) (finally {nil}))`,
+		`1 + try { 2 } catch (e) { 3 }`:                   `(+ 1 (try {2} (catch e {3})))`,
+		`(try { 1 } catch (e) { e }).kind`:                `(. (group (try {1} (catch e {e}))) kind)`,
+	}
+
+	for source, want := range tests {
+		program, err := parse(source)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", source, err)
+			continue
+		}
+		if got := show(program.Expr); got != want {
+			t.Errorf("%q:\n got %s\nwant %s", source, got, want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+		// partial is the tree built up to the error, if worth checking.
+		// Past the error the parser only keeps going to find the end of
+		// the tree, so what it builds there is unspecified.
+		partial string
+	}{
+		{``, `[line 1] Error at end: Expected expression`, `_`},
+		{`1 +`, `[line 1] Error at end: Expected expression`, `(+ 1 _)`},
+		{`1 2`, `[line 1] Error at '2': Expected end of file`, `1`},
+		{`(1`, `[line 1] Error at end: Expected ')' after parseGrouping`, `(group 1)`},
+		{`1 + $`, `[line 1] Error: Unknown character found '$'`, `(+ 1 _)`},
+		{`e.`, `[line 1] Error at end: Expected property name after '.'`, `(. e )`},
+		{`try { 1 }`, `[line 1] Error at end: Expected 'catch' or 'finally' after try block`, `(try {1})`},
+		{`try { 1 } catch { 2 }`, `[line 1] Error at '{': Expected '(' after 'catch'`, ``},
+		{`try 1`, `[line 1] Error at '1': Expected '{' after 'try'`, ``},
+		{"try {\n1\n", `[line 3] Error at end: Expected '}' after try block`, `(try {1})`},
+	}
+
+	for _, tt := range tests {
+		program, err := parse(tt.source)
+		if err == nil {
+			t.Errorf("%q: parsed without error", tt.source)
+			continue
+		}
+		if err.Error() != tt.want {
+			t.Errorf("%q: error\n got %s\nwant %s", tt.source, err.Error(), tt.want)
+		}
+		if got := show(program.Expr); tt.partial != "" && got != tt.partial {
+			t.Errorf("%q: partial tree\n got %s\nwant %s", tt.source, got, tt.partial)
+		}
+	}
+}
+
+func TestPositions(t *testing.T) {
+	program, err := parse("(1 +\n  2)\n  .kind")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos := program.Expr.Pos(); pos.Lexeme != "(" || pos.Line != 1 {
+		t.Errorf("Pos = %q on line %d, want '(' on line 1", pos.Lexeme, pos.Line)
+	}
+	if end := program.Expr.End(); end.Lexeme != "kind" || end.Line != 3 {
+		t.Errorf("End = %q on line %d, want 'kind' on line 3", end.Lexeme, end.Line)
+	}
+}
@@ -35,9 +35,11 @@ const (
 
   // KEYWORDS ---
   TOKEN_AND
+	TOKEN_CATCH
 	TOKEN_CLASS
 	TOKEN_ELSE
 	TOKEN_FALSE
+	TOKEN_FINALLY
   TOKEN_FOR
 	TOKEN_FUNCTION
 	TOKEN_IF
@@ -47,20 +49,25 @@ const (
 	TOKEN_RETURN
 	TOKEN_SUPER
 	TOKEN_THIS
+	TOKEN_THROW
   TOKEN_TRUE
+	TOKEN_TRY
 	TOKEN_VAR
 	TOKEN_WHILE
 
 	// SPECIAL TOKENS ---
+	TOKEN_COMMENT
   TOKEN_ERROR
 	TOKEN_EOF
 )
 
 var RESERVED_KEYWORDS = map[string]TokenType{
 	"and":      TOKEN_AND,
+	"catch":    TOKEN_CATCH,
 	"class":    TOKEN_CLASS,
 	"else":     TOKEN_ELSE,
 	"false":    TOKEN_FALSE,
+	"finally":  TOKEN_FINALLY,
 	"for":      TOKEN_FOR,
 	"fn":      TOKEN_FUNCTION,
 	"if":       TOKEN_IF,
@@ -70,7 +77,65 @@ var RESERVED_KEYWORDS = map[string]TokenType{
 	"return":   TOKEN_RETURN,
 	"super":    TOKEN_SUPER,
 	"this":     TOKEN_THIS,
+	"throw":    TOKEN_THROW,
 	"true":     TOKEN_TRUE,
+	"try":      TOKEN_TRY,
 	"var":      TOKEN_VAR,
 	"while":    TOKEN_WHILE,
 }
+
+var tokenNames = map[TokenType]string{
+	TOKEN_LEFT_PAREN:    "LEFT_PAREN",
+	TOKEN_RIGHT_PAREN:   "RIGHT_PAREN",
+	TOKEN_LEFT_BRACE:    "LEFT_BRACE",
+	TOKEN_RIGHT_BRACE:   "RIGHT_BRACE",
+	TOKEN_COMMA:         "COMMA",
+	TOKEN_DOT:           "DOT",
+	TOKEN_MINUS:         "MINUS",
+	TOKEN_PLUS:          "PLUS",
+	TOKEN_SEMICOLON:     "SEMICOLON",
+	TOKEN_SLASH:         "SLASH",
+	TOKEN_STAR:          "STAR",
+	TOKEN_PERCENT:       "PERCENT",
+	TOKEN_BANG:          "BANG",
+	TOKEN_BANG_EQUAL:    "BANG_EQUAL",
+	TOKEN_EQUAL:         "EQUAL",
+	TOKEN_EQUAL_EQUAL:   "EQUAL_EQUAL",
+	TOKEN_GREATER:       "GREATER",
+	TOKEN_GREATER_EQUAL: "GREATER_EQUAL",
+	TOKEN_LESS:          "LESS",
+	TOKEN_LESS_EQUAL:    "LESS_EQUAL",
+	TOKEN_IDENTIFIER:    "IDENTIFIER",
+	TOKEN_STRING:        "STRING",
+	TOKEN_NUMBER:        "NUMBER",
+	TOKEN_AND:           "AND",
+	TOKEN_CATCH:         "CATCH",
+	TOKEN_CLASS:         "CLASS",
+	TOKEN_ELSE:          "ELSE",
+	TOKEN_FALSE:         "FALSE",
+	TOKEN_FINALLY:       "FINALLY",
+	TOKEN_FOR:           "FOR",
+	TOKEN_FUNCTION:      "FUNCTION",
+	TOKEN_IF:            "IF",
+	TOKEN_NIL:           "NIL",
+	TOKEN_OR:            "OR",
+	TOKEN_PRINT:         "PRINT",
+	TOKEN_RETURN:        "RETURN",
+	TOKEN_SUPER:         "SUPER",
+	TOKEN_THIS:          "THIS",
+	TOKEN_THROW:         "THROW",
+	TOKEN_TRUE:          "TRUE",
+	TOKEN_TRY:           "TRY",
+	TOKEN_VAR:           "VAR",
+	TOKEN_WHILE:         "WHILE",
+	TOKEN_COMMENT:       "COMMENT",
+	TOKEN_ERROR:         "ERROR",
+	TOKEN_EOF:           "EOF",
+}
+
+func (tt TokenType) String() string {
+	if name, ok := tokenNames[tt]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
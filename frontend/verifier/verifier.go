@@ -0,0 +1,265 @@
+package verifier
+
+import (
+	"fmt"
+
+	"github.com/caelondev/hydor/frontend/bytecode"
+)
+
+// VerifyError describes the first problem found in a chunk.
+type VerifyError struct {
+	Offset  int
+	Message string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("offset %04d: %s", e.Offset, e.Message)
+}
+
+// Info holds facts the verifier proved about a chunk.
+type Info struct {
+	// MaxStack is the deepest the value stack can get while running.
+	MaxStack int
+}
+
+// Verify checks that bc is safe to execute: every opcode is known, every
+// operand lies inside the code and references a valid constant, every jump
+// lands on an instruction boundary, the stack depth is the same however an
+// instruction is reached and never drops below zero, and execution cannot
+// run off the end of the code without returning. Handlers must cover whole
+// instructions, and every instruction they protect must leave the stack at
+// least as deep as the handler cuts it back to.
+func Verify(bc *bytecode.Bytecode) (*Info, error) {
+	v := &verifier{
+		bc:     bc,
+		depths: make([]int, len(bc.Code)),
+	}
+	for i := range v.depths {
+		v.depths[i] = -1
+	}
+
+	if len(bc.Code) == 0 {
+		return nil, &VerifyError{0, "empty chunk has no return"}
+	}
+	if err := v.checkLines(); err != nil {
+		return nil, err
+	}
+	if err := v.findBoundaries(); err != nil {
+		return nil, err
+	}
+	if err := v.checkHandlers(); err != nil {
+		return nil, err
+	}
+	if err := v.checkLocals(); err != nil {
+		return nil, err
+	}
+	if err := v.walk(); err != nil {
+		return nil, err
+	}
+	if err := v.checkHandlerDepths(); err != nil {
+		return nil, err
+	}
+
+	return &Info{MaxStack: v.maxStack}, nil
+}
+
+type verifier struct {
+	bc         *bytecode.Bytecode
+	boundaries []bool
+	depths     []int
+	maxStack   int
+}
+
+func (v *verifier) checkLines() error {
+	total := 0
+	for _, run := range v.bc.Lines {
+		if run.Count <= 0 {
+			return &VerifyError{total, "line table has an empty run"}
+		}
+		total += run.Count
+	}
+	if total != len(v.bc.Code) {
+		return &VerifyError{0, fmt.Sprintf("line table covers %d bytes but code has %d", total, len(v.bc.Code))}
+	}
+	return nil
+}
+
+// findBoundaries decodes the code linearly, marking where each instruction
+// starts and rejecting unknown opcodes and truncated or invalid operands.
+func (v *verifier) findBoundaries() error {
+	code := v.bc.Code
+	v.boundaries = make([]bool, len(code))
+
+	for offset := 0; offset < len(code); {
+		op := bytecode.OpCode(code[offset])
+		width := bytecode.OperandWidth(op)
+		if width < 0 {
+			return &VerifyError{offset, fmt.Sprintf("unknown opcode %d", code[offset])}
+		}
+		if offset+width >= len(code) && width > 0 {
+			return &VerifyError{offset, fmt.Sprintf("%s operand runs past end of code", op)}
+		}
+
+		if bytecode.HasConstantOperand(op) {
+			index := v.bc.ConstantIndex(offset)
+			if index >= len(v.bc.Constants.Values) {
+				return &VerifyError{offset, fmt.Sprintf("constant index %d out of range (pool has %d entries)",
+					index, len(v.bc.Constants.Values))}
+			}
+			isProperty := op == bytecode.OP_GET_PROPERTY || op == bytecode.OP_GET_PROPERTY_LONG
+			if isProperty && !v.bc.Constants.Values[index].IsString() {
+				return &VerifyError{offset, fmt.Sprintf("property name constant %d is not a string", index)}
+			}
+		}
+
+		v.boundaries[offset] = true
+		offset += 1 + width
+	}
+	return nil
+}
+
+// walk follows every reachable path through the code, tracking the stack
+// depth on entry to each instruction.
+func (v *verifier) walk() error {
+	code := v.bc.Code
+	work := []int{0}
+	v.depths[0] = 0
+
+	// A handler is entered with its depth plus the error it catches.
+	for _, h := range v.bc.Handlers {
+		visited, err := v.merge(h.Start, h.Target, h.Depth+1)
+		if err != nil {
+			return err
+		}
+		if !visited {
+			work = append(work, h.Target)
+		}
+	}
+
+	for len(work) > 0 {
+		offset := work[len(work)-1]
+		work = work[:len(work)-1]
+		depth := v.depths[offset]
+
+		for {
+			op := bytecode.OpCode(code[offset])
+			effect := bytecode.Effect(op)
+
+			if depth < effect.Pops {
+				return &VerifyError{offset, fmt.Sprintf("%s needs %d stack values but only %d are available",
+					op, effect.Pops, depth)}
+			}
+			if op == bytecode.OP_GET_LOCAL && int(code[offset+1]) >= depth {
+				return &VerifyError{offset, fmt.Sprintf("local slot %d out of range (stack depth %d)",
+					code[offset+1], depth)}
+			}
+			depth += effect.Pushes - effect.Pops
+			if depth > v.maxStack {
+				v.maxStack = depth
+			}
+
+			if op == bytecode.OP_RETURN || op == bytecode.OP_THROW {
+				break
+			}
+
+			if bytecode.IsJump(op) {
+				visited, err := v.merge(offset, v.bc.JumpTarget(offset), depth)
+				if err != nil {
+					return err
+				}
+				if !visited {
+					work = append(work, v.bc.JumpTarget(offset))
+				}
+				if op == bytecode.OP_JUMP {
+					break
+				}
+			}
+
+			next := offset + 1 + bytecode.OperandWidth(op)
+			if next >= len(code) {
+				return &VerifyError{offset, "execution falls off the end of the code without a return"}
+			}
+
+			merged, err := v.merge(offset, next, depth)
+			if err != nil {
+				return err
+			}
+			if merged {
+				break
+			}
+			offset = next
+		}
+	}
+	return nil
+}
+
+// merge records the stack depth on entry to target. It returns true if
+// target was already visited, in which case the walk along this path can
+// stop.
+func (v *verifier) merge(from, target, depth int) (bool, error) {
+	if target < 0 || target >= len(v.bc.Code) || !v.boundaries[target] {
+		return false, &VerifyError{from, fmt.Sprintf("jump target %04d is not an instruction boundary", target)}
+	}
+
+	if v.depths[target] < 0 {
+		v.depths[target] = depth
+		return false, nil
+	}
+	if v.depths[target] != depth {
+		return false, &VerifyError{from, fmt.Sprintf("stack depth %d at %04d does not match earlier depth %d",
+			depth, target, v.depths[target])}
+	}
+	return true, nil
+}
+
+// checkHandlers rejects handlers whose range or target does not line up with
+// instruction boundaries.
+func (v *verifier) checkHandlers() error {
+	code := v.bc.Code
+	onBoundary := func(offset int) bool {
+		return offset >= 0 && offset < len(code) && v.boundaries[offset]
+	}
+
+	for i, h := range v.bc.Handlers {
+		switch {
+		case h.Start >= h.End || !onBoundary(h.Start) || (h.End != len(code) && !onBoundary(h.End)):
+			return &VerifyError{h.Start, fmt.Sprintf("handler %d range [%04d, %04d) is not a run of whole instructions",
+				i, h.Start, h.End)}
+		case !onBoundary(h.Target):
+			return &VerifyError{h.Start, fmt.Sprintf("handler %d target %04d is not an instruction boundary", i, h.Target)}
+		case h.Depth < 0:
+			return &VerifyError{h.Start, fmt.Sprintf("handler %d has negative depth %d", i, h.Depth)}
+		}
+	}
+	return nil
+}
+
+// checkHandlerDepths makes sure no protected instruction can pop the stack
+// below the depth its handler cuts back to, which would leave the handler
+// reading stale slots.
+func (v *verifier) checkHandlerDepths() error {
+	for i, h := range v.bc.Handlers {
+		for offset := h.Start; offset < h.End; offset++ {
+			if v.depths[offset] < 0 {
+				continue
+			}
+			lowest := v.depths[offset] - bytecode.Effect(bytecode.OpCode(v.bc.Code[offset])).Pops
+			if lowest < h.Depth {
+				return &VerifyError{offset, fmt.Sprintf("stack depth %d is below handler %d depth %d",
+					lowest, i, h.Depth)}
+			}
+		}
+	}
+	return nil
+}
+
+// checkLocals rejects local debug information that points outside the code.
+func (v *verifier) checkLocals() error {
+	for _, l := range v.bc.Locals {
+		if l.Slot < 0 || l.Start < 0 || l.Start > l.End || l.End > len(v.bc.Code) {
+			return &VerifyError{l.Start, fmt.Sprintf("local '%s' range [%04d, %04d) is outside the code",
+				l.Name, l.Start, l.End)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package verifier
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/caelondev/hydor/frontend/bytecode"
+	"github.com/caelondev/hydor/runtime/value"
+)
+
+const (
+	CONSTANT     = byte(bytecode.OP_CONSTANT)
+	NIL          = byte(bytecode.OP_NIL)
+	TRUE         = byte(bytecode.OP_TRUE)
+	ADD          = byte(bytecode.OP_ADD)
+	POP          = byte(bytecode.OP_POP)
+	GET_LOCAL    = byte(bytecode.OP_GET_LOCAL)
+	GET_PROPERTY = byte(bytecode.OP_GET_PROPERTY)
+	JUMP         = byte(bytecode.OP_JUMP)
+	JUMP_IF      = byte(bytecode.OP_JUMP_IF_FALSE)
+	THROW        = byte(bytecode.OP_THROW)
+	RETURN       = byte(bytecode.OP_RETURN)
+)
+
+// chunk builds a chunk with code all on line 1 and a pool holding the
+// number 1 and the string "kind".
+func chunk(code ...byte) *bytecode.Bytecode {
+	bc := bytecode.NewBytecode("")
+	bc.AddConstant(value.NumberVal(1))
+	bc.AddConstant(value.ObjVal(value.NewString("kind").AsObj()))
+	for _, b := range code {
+		bc.Write(b, 1)
+	}
+	return bc
+}
+
+func TestVerifyAccepts(t *testing.T) {
+	// The handler is entered with the error pushed above its depth.
+	handler := chunk(NIL, CONSTANT, 0, THROW, POP, NIL, RETURN)
+	handler.Handlers = []bytecode.Handler{{Start: 1, End: 4, Target: 4, Depth: 1}}
+
+	tests := map[string]struct {
+		bc       *bytecode.Bytecode
+		maxStack int
+	}{
+		"constant": {chunk(CONSTANT, 0, RETURN), 1},
+		"sum":      {chunk(CONSTANT, 0, CONSTANT, 0, CONSTANT, 0, ADD, ADD, RETURN), 3},
+		// The jump lands on the next instruction either way.
+		"branch":  {chunk(TRUE, JUMP_IF, 0, 0, POP, TRUE, RETURN), 1},
+		"handler": {handler, 2},
+	}
+
+	for name, tt := range tests {
+		info, err := Verify(tt.bc)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if info.MaxStack != tt.maxStack {
+			t.Errorf("%s: MaxStack = %d, want %d", name, info.MaxStack, tt.maxStack)
+		}
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	withLines := chunk(CONSTANT, 0, RETURN)
+	withLines.Lines[0].Count++
+
+	badHandler := chunk(CONSTANT, 0, THROW, NIL, RETURN)
+	badHandler.Handlers = []bytecode.Handler{{Start: 0, End: 1, Target: 3, Depth: 0}}
+
+	badLocal := chunk(NIL, RETURN)
+	badLocal.Locals = []bytecode.Local{{Name: "e", Slot: 0, Start: 0, End: 9}}
+
+	tests := map[string]struct {
+		bc   *bytecode.Bytecode
+		want string
+	}{
+		"empty":             {chunk(), "empty chunk"},
+		"line table":        {withLines, "line table covers"},
+		"unknown opcode":    {chunk(200, RETURN), "unknown opcode 200"},
+		"truncated operand": {chunk(NIL, RETURN, CONSTANT), "runs past end"},
+		"constant range":    {chunk(CONSTANT, 7, RETURN), "constant index 7 out of range"},
+		"property name":     {chunk(NIL, GET_PROPERTY, 0, RETURN), "not a string"},
+		"underflow":         {chunk(CONSTANT, 0, ADD, RETURN), "needs 2 stack values"},
+		"no return":         {chunk(CONSTANT, 0), "falls off the end"},
+		"mid-instruction":   {chunk(JUMP, 1, 0, CONSTANT, 0, RETURN), "not an instruction boundary"},
+		"depth mismatch":    {chunk(TRUE, JUMP_IF, 1, 0, NIL, NIL, RETURN), "does not match"},
+		"local slot":        {chunk(GET_LOCAL, 3, RETURN), "local slot 3 out of range"},
+		"handler range":     {badHandler, "handler 0 range"},
+		"local range":       {badLocal, "outside the code"},
+	}
+
+	for name, tt := range tests {
+		_, err := Verify(tt.bc)
+		if err == nil {
+			t.Errorf("%s: verified, want an error containing %q", name, tt.want)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %q does not contain %q", name, err.Error(), tt.want)
+		}
+	}
+}
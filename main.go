@@ -2,28 +2,829 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/caelondev/hydor/color"
 	"github.com/caelondev/hydor/frontend/bytecode"
+	"github.com/caelondev/hydor/frontend/compiler"
+	"github.com/caelondev/hydor/frontend/debug"
+	"github.com/caelondev/hydor/frontend/formatter"
 	"github.com/caelondev/hydor/frontend/lexer"
-	"github.com/caelondev/hydor/frontend/parser"
+	"github.com/caelondev/hydor/frontend/lint"
+	"github.com/caelondev/hydor/frontend/lsp"
+	"github.com/caelondev/hydor/frontend/optimizer"
+	"github.com/caelondev/hydor/frontend/tokens"
+	"github.com/caelondev/hydor/frontend/verifier"
 	"github.com/caelondev/hydor/result"
+	"github.com/caelondev/hydor/runtime/coverage"
+	"github.com/caelondev/hydor/runtime/debugger"
+	"github.com/caelondev/hydor/runtime/debugger/dap"
+	"github.com/caelondev/hydor/runtime/profiler"
+	"github.com/caelondev/hydor/runtime/testrunner"
+	"github.com/caelondev/hydor/runtime/value"
 	"github.com/caelondev/hydor/runtime/vm"
 )
 
+const (
+	EXIT_UNFORMATTED   = 1
+	EXIT_LINT_ERROR    = 1
+	EXIT_TEST_FAILED   = 1
+	EXIT_USAGE         = 64
+	EXIT_COMPILE_ERROR = 65
+	EXIT_RUNTIME_ERROR = 64
+	EXIT_IO_ERROR      = 74
+	EXIT_ABORTED       = 75
+)
+
+const usage = `Usage: hydor [flags] [command] [file] [-- args...]
+
+Commands:
+  run <file>      Compile and run a script (default when a file is given)
+  repl            Start the interactive REPL (default with no arguments)
+  disasm <file>   Compile a script and print its bytecode
+  tokens <file>   Print the token stream of a script
+  check <file>    Compile a script without running it
+  build <file>    Compile a script to a bytecode file (.hdc)
+  debug <file>    Run a script under the interactive debugger, at -O0
+                  unless -O1 is given
+  fmt <files...>  Print scripts in canonical style
+  lint <files...> Report suspicious code in scripts. Rules are configured
+                  by the nearest .hydorlint.json and silenced for a line
+                  with a '// hydor:ignore RULE' comment
+  test [paths...] Run the tests in *_test.hd files under each path
+                  (default: the current directory)
+  dap             Serve the Debug Adapter Protocol on stdin and stdout
+  lsp             Serve the Language Server Protocol on stdin and stdout
+
+Compiled .hdc files can be passed to run, disasm, check and debug in place
+of source files. A .hdc file whose source has changed since it was built
+is rejected.
+
+Flags:
+  -e <source>     Evaluate source and exit
+  -o <file>       Output path for build (default: <file>.hdc)
+  --check         With fmt, list files that are not formatted and exit
+                  with status 1 if there are any
+  --write         With fmt, rewrite files in place instead of printing
+  --format F      With test, report results as text (default), tap or
+                  junit
+  -O0, -O1        Optimization level: -O0 disables constant folding and
+                  the peephole pass (default: -O1)
+  --trace         Print the stack and each instruction while executing
+  --trace-format  Trace output format: text (default) or json
+  --trace-lines   Only trace lines in an inclusive range, e.g. 10-20
+  --trace-func    Only trace instructions inside the named function
+  --trace-out     Write the trace to a file instead of stderr
+  --no-color      Disable colored diagnostics
+  --max-stack N   Limit the value stack to N slots
+  --max-frames N  Limit the call depth to N frames
+  --max-instructions N
+                  Abort after executing N instructions
+  --timeout D     Abort after running for duration D, e.g. 500ms or 2s
+  --max-heap SIZE Limit heap allocations, e.g. 65536, 512K or 16M
+  --sandbox       Cap the heap at 64M unless --max-heap is lower. This
+                  limits memory only and does not isolate the script
+  --profile FILE  With run, write a CPU profile of the script to FILE in
+                  pprof format, for 'go tool pprof'
+  --line-counts   With run, print how many instructions each line
+                  executed, hottest first, to stderr
+  --coverage FILE With test, write the line coverage of the test files
+                  to FILE in LCOV format
+  --coverage-html FILE
+                  With test, write the line coverage as an HTML page
+
+Arguments after '--' are passed to the script run by run, debug or -e. The
+script sees their count as argc and each one as a string in arg1 to argN.
+`
+
+type options struct {
+	eval       string
+	evalSet    bool
+	trace      *vm.TraceOptions
+	traceOut   string
+	output     string
+	check      bool
+	write      bool
+	format     testrunner.Format
+	optimize   optimizer.Level
+	levelSet   bool
+	maxStack   int
+	maxFrames  int
+	maxInstr   int64
+	timeout    time.Duration
+	maxHeap    int64
+	sandbox    bool
+	profile    string
+	lineCounts bool
+	// coverage and coverageHTML are where test writes its LCOV and HTML
+	// coverage reports.
+	coverage     string
+	coverageHTML string
+	noColor      bool
+	scriptArgs   []string
+}
+
 func main() {
-	if len(os.Args) == 1 {
-		runRepl()
-	} else if len(os.Args) == 2 {
-		runFile(os.Args[1])
-	} else {
-		fmt.Fprintln(os.Stderr, "Usage: hydor [script]")
-		os.Exit(64)
+	os.Exit(runCLI(os.Args[1:]))
+}
+
+func runCLI(args []string) int {
+	opts, positional, err := parseArgs(args)
+	if err != nil {
+		if err == flag.ErrHelp {
+			fmt.Fprint(os.Stdout, usage)
+			return 0
+		}
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprint(os.Stderr, usage)
+		return EXIT_USAGE
+	}
+
+	color.Enabled = !opts.noColor && color.Detect(os.Stderr)
+
+	if opts.traceOut != "" {
+		out, err := os.Create(opts.traceOut)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot create trace file '%s', Error: %s\n", opts.traceOut, err.Error())
+			return EXIT_IO_ERROR
+		}
+		defer out.Close()
+		opts.trace.Writer = out
+	}
+
+	if opts.evalSet {
+		if len(positional) != 0 {
+			return usageError("-e cannot be combined with a command or file")
+		}
+		if opts.profiling() {
+			return runProfiled("", []byte(opts.eval), opts)
+		}
+		return exitCode(run("", opts.eval, opts))
+	}
+
+	if len(positional) == 0 {
+		if opts.scriptArgs != nil {
+			return usageError("Arguments after '--' need a script to run")
+		}
+		runRepl(opts)
+		return 0
+	}
+
+	command, rest := positional[0], positional[1:]
+	if opts.scriptArgs != nil && !runsScript(command) {
+		return usageError(fmt.Sprintf("%s does not take arguments after '--'", command))
+	}
+	switch command {
+	case "repl":
+		if len(rest) != 0 {
+			return usageError("repl takes no arguments")
+		}
+		runRepl(opts)
+		return 0
+	case "dap":
+		if len(rest) != 0 {
+			return usageError("dap takes no arguments")
+		}
+		// Diagnostics travel inside protocol messages, where escape
+		// codes would only get in the way.
+		color.Enabled = false
+		if err := dap.NewServer(os.Stdin, os.Stdout).Serve(); err != nil {
+			fmt.Fprintf(os.Stderr, "DAP session failed, Error: %s\n", err.Error())
+			return EXIT_IO_ERROR
+		}
+		return 0
+	case "lsp":
+		if len(rest) != 0 {
+			return usageError("lsp takes no arguments")
+		}
+		if err := lsp.NewServer(os.Stdin, os.Stdout).Serve(); err != nil {
+			fmt.Fprintf(os.Stderr, "LSP session failed, Error: %s\n", err.Error())
+			return EXIT_IO_ERROR
+		}
+		return 0
+	case "fmt":
+		if len(rest) == 0 {
+			return usageError("fmt expects at least one file")
+		}
+		if opts.check && opts.write {
+			return usageError("--check cannot be combined with --write")
+		}
+		return formatFiles(rest, opts)
+	case "lint":
+		if len(rest) == 0 {
+			return usageError("lint expects at least one file")
+		}
+		return lintFiles(rest)
+	case "test":
+		if len(rest) == 0 {
+			rest = []string{"."}
+		}
+		return runTests(rest, opts)
+	case "run", "disasm", "tokens", "check", "build", "debug":
+		if len(rest) != 1 {
+			return usageError(fmt.Sprintf("%s expects exactly one file", command))
+		}
+		return runCommand(command, rest[0], opts)
+	default:
+		if len(rest) != 0 {
+			return usageError(fmt.Sprintf("Unknown command '%s'", command))
+		}
+		return runCommand("run", command, opts)
+	}
+}
+
+// runsScript reports whether command runs a script, which can then be
+// given the arguments after '--'. Any name that is not a command is a
+// script to run.
+func runsScript(command string) bool {
+	switch command {
+	case "repl", "dap", "lsp", "fmt", "lint", "test", "disasm", "tokens", "check", "build":
+		return false
+	}
+	return true
+}
+
+// parseArgs accepts flags anywhere before a `--` terminator, so both
+// `hydor --trace run x.hd` and `hydor run x.hd --trace` work.
+func parseArgs(args []string) (*options, []string, error) {
+	opts := &options{
+		optimize:  optimizer.O1,
+		maxStack:  vm.DEFAULT_MAX_STACK,
+		maxFrames: vm.DEFAULT_MAX_FRAMES,
+	}
+
+	for i, arg := range args {
+		if arg == "--" {
+			opts.scriptArgs = args[i+1:]
+			args = args[:i]
+			break
+		}
+	}
+
+	fs := flag.NewFlagSet("hydor", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.Func("e", "evaluate source and exit", func(src string) error {
+		opts.eval = src
+		opts.evalSet = true
+		return nil
+	})
+	trace := &vm.TraceOptions{Writer: os.Stderr}
+	traced := false
+	fs.BoolFunc("trace", "trace execution", func(string) error {
+		traced = true
+		return nil
+	})
+	fs.Func("trace-format", "trace output format", func(format string) error {
+		traced = true
+		switch format {
+		case "text":
+			trace.Format = vm.TRACE_TEXT
+		case "json":
+			trace.Format = vm.TRACE_JSON
+		default:
+			return fmt.Errorf("Unknown trace format '%s'", format)
+		}
+		return nil
+	})
+	fs.Func("trace-lines", "trace line range", func(span string) error {
+		traced = true
+		return parseLineRange(span, trace)
+	})
+	fs.Func("trace-func", "trace function", func(name string) error {
+		traced = true
+		trace.Function = name
+		return nil
+	})
+	fs.Func("trace-out", "trace output file", func(path string) error {
+		traced = true
+		opts.traceOut = path
+		return nil
+	})
+	fs.StringVar(&opts.output, "o", "", "build output path")
+	fs.BoolVar(&opts.check, "check", false, "check formatting")
+	fs.BoolVar(&opts.write, "write", false, "rewrite formatted files")
+	fs.Func("format", "test output format", func(name string) error {
+		format, err := testrunner.ParseFormat(name)
+		opts.format = format
+		return err
+	})
+	fs.BoolFunc("O0", "disable optimizations", func(string) error {
+		opts.optimize = optimizer.O0
+		opts.levelSet = true
+		return nil
+	})
+	fs.BoolFunc("O1", "enable optimizations", func(string) error {
+		opts.optimize = optimizer.O1
+		opts.levelSet = true
+		return nil
+	})
+	fs.Func("max-stack", "value stack limit", func(size string) error {
+		n, err := strconv.Atoi(size)
+		if err == nil && n < 1 {
+			err = fmt.Errorf("must be at least 1")
+		}
+		opts.maxStack = n
+		return err
+	})
+	fs.Func("max-frames", "call depth limit", func(depth string) error {
+		n, err := strconv.Atoi(depth)
+		if err == nil && n < 1 {
+			err = fmt.Errorf("must be at least 1")
+		}
+		opts.maxFrames = n
+		return err
+	})
+	fs.Int64Var(&opts.maxInstr, "max-instructions", 0, "instruction budget")
+	fs.DurationVar(&opts.timeout, "timeout", 0, "wall-clock limit")
+	fs.Func("max-heap", "heap limit", func(size string) error {
+		n, err := parseSize(size)
+		opts.maxHeap = n
+		return err
+	})
+	fs.BoolVar(&opts.sandbox, "sandbox", false, "cap the heap for untrusted scripts")
+	fs.StringVar(&opts.profile, "profile", "", "CPU profile output path")
+	fs.BoolVar(&opts.lineCounts, "line-counts", false, "print per-line instruction counts")
+	fs.StringVar(&opts.coverage, "coverage", "", "LCOV coverage output path")
+	fs.StringVar(&opts.coverageHTML, "coverage-html", "", "HTML coverage output path")
+	fs.BoolVar(&opts.noColor, "no-color", false, "disable colored output")
+
+	positional := []string{}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+
+	if traced {
+		opts.trace = trace
+	}
+	return opts, positional, nil
+}
+
+func parseLineRange(span string, trace *vm.TraceOptions) error {
+	from, to, found := strings.Cut(span, "-")
+	var err error
+
+	if trace.FromLine, err = strconv.Atoi(from); err != nil {
+		return fmt.Errorf("Invalid line range '%s'", span)
+	}
+	trace.ToLine = trace.FromLine
+	if found {
+		if trace.ToLine, err = strconv.Atoi(to); err != nil {
+			return fmt.Errorf("Invalid line range '%s'", span)
+		}
+	}
+	return nil
+}
+
+// parseSize reads a byte count with an optional K, M or G suffix.
+func parseSize(size string) (int64, error) {
+	multiplier := int64(1)
+	switch strings.ToUpper(size[len(size)-min(len(size), 1):]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	digits := size
+	if multiplier != 1 {
+		digits = size[:len(size)-1]
+	}
+
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size '%s'", size)
+	}
+	return n * multiplier, nil
+}
+
+func usageError(msg string) int {
+	fmt.Fprintln(os.Stderr, msg)
+	fmt.Fprint(os.Stderr, usage)
+	return EXIT_USAGE
+}
+
+func runCommand(command, path string, opts *options) int {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot open file '%s', Error: %s\n", path, err.Error())
+		return EXIT_IO_ERROR
+	}
+
+	compiled := bytecode.IsCompiled(source)
+
+	switch command {
+	case "disasm":
+		chunk, status := load(path, source, opts)
+		if status != 0 {
+			return status
+		}
+		debug.DisassembleBytecode(chunk, path)
+		return 0
+	case "tokens":
+		if compiled {
+			fmt.Fprintf(os.Stderr, "'%s' is a compiled file and has no tokens\n", path)
+			return EXIT_USAGE
+		}
+		return printTokens(string(source))
+	case "check":
+		_, status := load(path, source, opts)
+		return status
+	case "build":
+		if compiled {
+			fmt.Fprintf(os.Stderr, "'%s' is already compiled\n", path)
+			return EXIT_USAGE
+		}
+		return build(path, string(source), opts)
+	case "debug":
+		// As with DAP launches, folding would merge lines the debugger
+		// should stop on, so debug compiles at -O0 unless -O0 or -O1 was
+		// given explicitly.
+		if !opts.levelSet {
+			opts.optimize = optimizer.O0
+		}
+		chunk, status := load(path, source, opts)
+		if status != 0 {
+			return status
+		}
+		text := ""
+		if !compiled {
+			text = string(source)
+		}
+		console := debugger.NewConsole(text, os.Stdin, os.Stdout)
+		machine := newVM(opts)
+		machine.Hook = console.Debugger()
+		return exitCode(machine.Interpret(chunk))
+	default:
+		if opts.profiling() {
+			return runProfiled(path, source, opts)
+		}
+		if compiled {
+			chunk, status := load(path, source, opts)
+			if status != 0 {
+				return status
+			}
+			return exitCode(newVM(opts).Interpret(chunk))
+		}
+		return exitCode(run(path, string(source), opts))
+	}
+}
+
+func (opts *options) profiling() bool {
+	return opts.profile != "" || opts.lineCounts
+}
+
+// runProfiled runs a script with a profiler attached, then writes the
+// reports --profile and --line-counts asked for.
+func runProfiled(path string, source []byte, opts *options) int {
+	chunk, status := load(path, source, opts)
+	if status != 0 {
+		return status
+	}
+
+	// Create the profile first so a bad path fails before the script runs.
+	var out *os.File
+	if opts.profile != "" {
+		var err error
+		if out, err = os.Create(opts.profile); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot create profile '%s', Error: %s\n", opts.profile, err.Error())
+			return EXIT_IO_ERROR
+		}
+		defer out.Close()
+	}
+
+	prof := profiler.New()
+	machine := newVM(opts)
+	machine.Hook = prof
+	prof.Start()
+	res := machine.Interpret(chunk)
+	prof.Stop()
+
+	if opts.lineCounts {
+		text := ""
+		if !bytecode.IsCompiled(source) {
+			text = string(source)
+		}
+		prof.WriteLineCounts(os.Stderr, text)
+	}
+	if out != nil {
+		if err := prof.WriteProfile(out); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot write profile '%s', Error: %s\n", opts.profile, err.Error())
+			return EXIT_IO_ERROR
+		}
 	}
+	return exitCode(res)
 }
 
-func runRepl() {
+// load returns the chunk for either a source file or a compiled .hdc file.
+func load(path string, source []byte, opts *options) (*bytecode.Bytecode, int) {
+	if bytecode.IsCompiled(source) {
+		if opts.scriptArgs != nil {
+			fmt.Fprintf(os.Stderr, "'%s' is a compiled file and cannot take arguments after '--'\n", path)
+			return nil, EXIT_USAGE
+		}
+		chunk, hash, err := bytecode.Unmarshal(source)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s %s\n", color.Red("Load Error:"), err.Error())
+			return nil, EXIT_COMPILE_ERROR
+		}
+		if stale(path, chunk, hash) {
+			fmt.Fprintf(os.Stderr, "%s '%s' has changed since '%s' was built, rebuild it\n",
+				color.Red("Load Error:"), chunk.File, path)
+			return nil, EXIT_COMPILE_ERROR
+		}
+		if _, err := verifier.Verify(chunk); err != nil {
+			fmt.Fprintf(os.Stderr, "%s %s\n", color.Red("Verify Error:"), err.Error())
+			return nil, EXIT_COMPILE_ERROR
+		}
+		return chunk, 0
+	}
+
+	chunk, ok := compile(path, string(source), opts)
+	if !ok {
+		return nil, EXIT_COMPILE_ERROR
+	}
+	return chunk, 0
+}
+
+// stale reports whether the source the chunk in the .hdc file at path was
+// built from has changed since. build records the source relative to the
+// .hdc file, so the check finds it from any directory. A source file that
+// is not present is not checked, so .hdc files can be shipped on their own.
+func stale(path string, chunk *bytecode.Bytecode, hash bytecode.SourceHash) bool {
+	if chunk.File == "" {
+		return false
+	}
+	file := chunk.File
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(filepath.Dir(path), file)
+	}
+	source, err := os.ReadFile(file)
+	if err != nil {
+		return false
+	}
+	return bytecode.HashSource(string(source)) != hash
+}
+
+// sourceName gives the path of the source relative to the directory of the
+// .hdc file built from it, falling back to an absolute path.
+func sourceName(path, output string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	dir, err := filepath.Abs(filepath.Dir(output))
+	if err != nil {
+		return abs
+	}
+	if rel, err := filepath.Rel(dir, abs); err == nil {
+		return rel
+	}
+	return abs
+}
+
+func build(path, source string, opts *options) int {
+	// The arguments are compiled in as constants, so a compiled file has
+	// none to offer and a script that reads them does not build.
+	chunk, ok := compiler.Compile(source, compiler.Options{File: path, Optimize: opts.optimize})
+	if !ok {
+		return EXIT_COMPILE_ERROR
+	}
+
+	output := opts.output
+	if output == "" {
+		output = strings.TrimSuffix(path, filepath.Ext(path)) + ".hdc"
+	}
+	chunk.File = sourceName(path, output)
+
+	data, err := bytecode.Marshal(chunk, bytecode.HashSource(source))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot serialize '%s', Error: %s\n", path, err.Error())
+		return EXIT_COMPILE_ERROR
+	}
+
+	if err := os.WriteFile(output, data, 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot write file '%s', Error: %s\n", output, err.Error())
+		return EXIT_IO_ERROR
+	}
+	return 0
+}
+
+// formatFiles prints each file in canonical style, or with --write
+// rewrites the ones that change, or with --check lists them.
+func formatFiles(paths []string, opts *options) int {
+	status := 0
+	for _, path := range paths {
+		source, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot open file '%s', Error: %s\n", path, err.Error())
+			status = EXIT_IO_ERROR
+			continue
+		}
+		if bytecode.IsCompiled(source) {
+			fmt.Fprintf(os.Stderr, "'%s' is a compiled file and cannot be formatted\n", path)
+			status = EXIT_USAGE
+			continue
+		}
+
+		formatted, err := formatter.Format(string(source))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err.Error())
+			status = EXIT_COMPILE_ERROR
+			continue
+		}
+
+		changed := formatted != string(source)
+		switch {
+		case opts.check:
+			if changed {
+				fmt.Println(path)
+				status = max(status, EXIT_UNFORMATTED)
+			}
+		case opts.write:
+			if !changed {
+				continue
+			}
+			if err := os.WriteFile(path, []byte(formatted), 0o644); err != nil {
+				fmt.Fprintf(os.Stderr, "Cannot write file '%s', Error: %s\n", path, err.Error())
+				status = EXIT_IO_ERROR
+			}
+		default:
+			fmt.Print(formatted)
+		}
+	}
+	return status
+}
+
+// lintFiles prints every finding in each file. It fails if any finding is
+// an error, or if a file cannot be read or parsed.
+func lintFiles(paths []string) int {
+	status := 0
+	configs := map[string]*lint.Config{}
+	for _, path := range paths {
+		source, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot open file '%s', Error: %s\n", path, err.Error())
+			status = EXIT_IO_ERROR
+			continue
+		}
+		if bytecode.IsCompiled(source) {
+			fmt.Fprintf(os.Stderr, "'%s' is a compiled file and cannot be linted\n", path)
+			status = EXIT_USAGE
+			continue
+		}
+
+		var config *lint.Config
+		if configPath, ok := lint.FindConfig(filepath.Dir(path)); ok {
+			if config, ok = configs[configPath]; !ok {
+				config, err = lint.LoadConfig(configPath)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Invalid lint config, Error: %s\n", err.Error())
+					return EXIT_USAGE
+				}
+				configs[configPath] = config
+			}
+		}
+
+		diagnostics, err := lint.Lint(string(source), config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err.Error())
+			status = EXIT_COMPILE_ERROR
+			continue
+		}
+		for _, d := range diagnostics {
+			fmt.Printf("%s:%s\n", path, d)
+			if d.Severity == lint.SEVERITY_ERROR {
+				status = max(status, EXIT_LINT_ERROR)
+			}
+		}
+	}
+	return status
+}
+
+// runTests runs every test under paths and reports them together. It
+// fails if any test fails or any test file cannot be read or split into
+// tests.
+func runTests(paths []string, opts *options) int {
+	files, err := testrunner.Discover(paths)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot find tests, Error: %s\n", err.Error())
+		return EXIT_IO_ERROR
+	}
+
+	// Create the reports first so a bad path fails before the tests run.
+	lcov, status := createReport(opts.coverage)
+	if status != 0 {
+		return status
+	}
+	defer lcov.Close()
+	html, status := createReport(opts.coverageHTML)
+	if status != 0 {
+		return status
+	}
+	defer html.Close()
+
+	var cov *vm.Coverage
+	if opts.coverage != "" || opts.coverageHTML != "" {
+		cov = vm.NewCoverage()
+	}
+	report := coverage.New()
+
+	runner := &testrunner.Runner{
+		Optimize: opts.optimize,
+		NewVM: func() *vm.VM {
+			machine := newVM(opts)
+			machine.Coverage = cov
+			return machine
+		},
+	}
+	results := []*testrunner.Result{}
+	for _, file := range files {
+		source, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot open file '%s', Error: %s\n", file, err.Error())
+			return EXIT_IO_ERROR
+		}
+		report.SetSource(file, string(source))
+
+		cases, err := testrunner.Parse(file, string(source))
+		if err != nil {
+			results = append(results, testrunner.Broken(file, err))
+			continue
+		}
+		for _, c := range cases {
+			results = append(results, runner.Run(c))
+		}
+	}
+
+	if err := testrunner.Write(os.Stdout, opts.format, results); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot write test report, Error: %s\n", err.Error())
+		return EXIT_IO_ERROR
+	}
+	if cov != nil {
+		report.Add(cov)
+		if status := writeCoverage(report, lcov, html); status != 0 {
+			return status
+		}
+	}
+	for _, r := range results {
+		if !r.Passed {
+			return EXIT_TEST_FAILED
+		}
+	}
+	return 0
+}
+
+// createReport creates the coverage report at path, or returns nil when
+// path is empty.
+func createReport(path string) (*os.File, int) {
+	if path == "" {
+		return nil, 0
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot create coverage report '%s', Error: %s\n", path, err.Error())
+		return nil, EXIT_IO_ERROR
+	}
+	return out, 0
+}
+
+// writeCoverage writes report to whichever of lcov and html is set and
+// prints a summary to stderr, away from the test report on stdout.
+func writeCoverage(report *coverage.Report, lcov, html *os.File) int {
+	if lcov != nil {
+		if err := report.WriteLCOV(lcov); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot write coverage report '%s', Error: %s\n", lcov.Name(), err.Error())
+			return EXIT_IO_ERROR
+		}
+	}
+	if html != nil {
+		if err := report.WriteHTML(html); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot write coverage report '%s', Error: %s\n", html.Name(), err.Error())
+			return EXIT_IO_ERROR
+		}
+	}
+
+	hit, found := report.Summary()
+	fmt.Fprintf(os.Stderr, "coverage: %.1f%% of %d lines\n", coverage.Percent(hit, found), found)
+	return 0
+}
+
+func runRepl(opts *options) {
 	scanner := bufio.NewScanner(os.Stdin)
 
 	fmt.Println("Hydor REPL - Type '/exit' to quit")
@@ -42,37 +843,80 @@ func runRepl() {
 			break
 		}
 
-		run(line)
+		run("", line, opts)
 	}
 }
 
-func runFile(path string) {
-	source, err := os.ReadFile(path)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Cannot open file '%s', Error: %s", path,  err.Error())
-	}
+func printTokens(source string) int {
+	tokenizer := lexer.NewTokenizer(source)
+	status := 0
+	line := -1
 
-	returnValue := run(string(source))
+	for {
+		token := tokenizer.ScanToken()
+		if token.Line != line {
+			fmt.Printf("%4d ", token.Line)
+			line = token.Line
+		} else {
+			fmt.Printf("   | ")
+		}
+		fmt.Printf("%-14s '%s'\n", token.Type, token.Lexeme)
 
-	if returnValue == result.INTERPRET_COMPILE_ERROR {
-		os.Exit(65)
+		if token.Type == tokens.TOKEN_ERROR {
+			status = EXIT_COMPILE_ERROR
+		}
+		if token.Type == tokens.TOKEN_EOF {
+			return status
+		}
 	}
+}
 
-	if returnValue == result.INTERPRET_RUNTIME_ERROR {
-		os.Exit(64)
+func compile(path, source string, opts *options) (*bytecode.Bytecode, bool) {
+	return compiler.Compile(source, compiler.Options{File: path, Optimize: opts.optimize, Bindings: opts.bindings()})
+}
+
+// bindings exposes the arguments after '--' to the script: argc is how
+// many there are and arg1 to argN are each one as a string.
+func (opts *options) bindings() map[string]value.Value {
+	bindings := map[string]value.Value{"argc": value.NumberVal(float64(len(opts.scriptArgs)))}
+	for i, arg := range opts.scriptArgs {
+		bindings[fmt.Sprintf("arg%d", i+1)] = value.ObjVal(value.NewString(arg).AsObj())
 	}
+	return bindings
 }
 
-func run(source string) result.InterpretResult {
-	tokenizer := lexer.NewTokenizer(source)
-	bytecode := bytecode.NewBytecode(source)
-	parser := parser.NewParser()
-	vm := vm.NewVM()
-	
-	if !parser.Compile(source, tokenizer, bytecode) {
+func run(path, source string, opts *options) result.InterpretResult {
+	chunk, ok := compile(path, source, opts)
+	if !ok {
 		return result.INTERPRET_COMPILE_ERROR
 	}
 
-	result := vm.Interpret(bytecode)
-	return result
+	return newVM(opts).Interpret(chunk)
+}
+
+func newVM(opts *options) *vm.VM {
+	machine := vm.NewVM()
+	machine.Trace = opts.trace
+	machine.MaxStack = opts.maxStack
+	machine.MaxFrames = opts.maxFrames
+	machine.MaxInstructions = opts.maxInstr
+	machine.Timeout = opts.timeout
+	machine.MaxHeap = opts.maxHeap
+	if opts.sandbox {
+		machine.Sandbox()
+	}
+	return machine
+}
+
+func exitCode(res result.InterpretResult) int {
+	switch res {
+	case result.INTERPRET_COMPILE_ERROR, result.INTERPRET_INVALID_BYTECODE:
+		return EXIT_COMPILE_ERROR
+	case result.INTERPRET_RUNTIME_ERROR:
+		return EXIT_RUNTIME_ERROR
+	case result.INTERPRET_ABORTED:
+		return EXIT_ABORTED
+	default:
+		return 0
+	}
 }
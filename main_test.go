@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/caelondev/hydor/frontend/optimizer"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		args       []string
+		positional []string
+		scriptArgs []string
+		check      func(*options) bool
+		err        string
+	}{
+		{args: []string{"-O0", "run", "x.hd"}, positional: []string{"run", "x.hd"},
+			check: func(o *options) bool { return o.optimize == optimizer.O0 }},
+		{args: []string{"run", "x.hd", "-O0", "--max-stack", "8"}, positional: []string{"run", "x.hd"},
+			check: func(o *options) bool { return o.optimize == optimizer.O0 && o.maxStack == 8 }},
+		{args: []string{"--trace", "x.hd", "--trace-lines", "2-4"}, positional: []string{"x.hd"},
+			check: func(o *options) bool { return o.trace != nil && o.trace.FromLine == 2 && o.trace.ToLine == 4 }},
+		{args: []string{"run", "x.hd", "--", "a", "--trace", "-O0"}, positional: []string{"run", "x.hd"},
+			scriptArgs: []string{"a", "--trace", "-O0"},
+			check:      func(o *options) bool { return o.trace == nil && o.optimize == optimizer.O1 }},
+		{args: []string{"-e", "1", "--"}, scriptArgs: []string{},
+			check: func(o *options) bool { return o.evalSet && o.eval == "1" }},
+		{args: []string{"--max-heap", "16K", "x.hd"}, positional: []string{"x.hd"},
+			check: func(o *options) bool { return o.maxHeap == 16<<10 }},
+		{args: []string{"--max-stack", "0", "x.hd"}, err: "must be at least 1"},
+		{args: []string{"--max-stack", "many"}, err: "invalid value"},
+		{args: []string{"--max-frames", "0", "x.hd"}, err: "must be at least 1"},
+		{args: []string{"--max-frames", "-3"}, err: "must be at least 1"},
+		{args: []string{"x.hd", "--max-frames", "4"}, positional: []string{"x.hd"},
+			check: func(o *options) bool { return o.maxFrames == 4 }},
+		{args: []string{"--max-heap", "1X"}, err: "Invalid size '1X'"},
+		{args: []string{"--trace-format", "xml"}, err: "Unknown trace format 'xml'"},
+		{args: []string{"--trace-lines", "a-b"}, err: "Invalid line range 'a-b'"},
+		{args: []string{"--format", "csv", "test"}, err: "csv"},
+		{args: []string{"--timeout", "soon"}, err: "invalid value"},
+		{args: []string{"--unknown"}, err: "flag provided but not defined"},
+	}
+	for _, test := range tests {
+		opts, positional, err := parseArgs(test.args)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: error %v, want one containing %q", test.args, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.args, err)
+			continue
+		}
+		if !slices.Equal(positional, test.positional) {
+			t.Errorf("%q: positional %q, want %q", test.args, positional, test.positional)
+		}
+		if !slices.Equal(opts.scriptArgs, test.scriptArgs) || (opts.scriptArgs == nil) != (test.scriptArgs == nil) {
+			t.Errorf("%q: script arguments %q, want %q", test.args, opts.scriptArgs, test.scriptArgs)
+		}
+		if test.check != nil && !test.check(opts) {
+			t.Errorf("%q: options %+v", test.args, opts)
+		}
+	}
+}
+
+func TestScriptArguments(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "args.hd"), []byte("arg1 + \" \" + arg2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args []string
+		out  string
+		exit int
+	}{
+		{[]string{"run", "args.hd", "--", "a", "--trace"}, "a --trace\n", 0},
+		{[]string{"args.hd", "--", "b", "c"}, "b c\n", 0},
+		{[]string{"-e", "argc", "--", "1", "2", "3"}, "3\n", 0},
+		{[]string{"-e", "argc"}, "0\n", 0},
+		{[]string{"args.hd", "--", "only"}, "[line 1] Error at 'arg2': Undefined variable 'arg2'\n", EXIT_COMPILE_ERROR},
+		{[]string{"check", "args.hd", "--", "a"}, "check does not take arguments after '--'\n", EXIT_USAGE},
+		{[]string{"--", "a"}, "Arguments after '--' need a script to run\n", EXIT_USAGE},
+	}
+	for _, test := range tests {
+		out, exit := runHydor(t, dir, test.args...)
+		if exit != test.exit || !strings.HasPrefix(out, test.out) {
+			t.Errorf("%q exited with %d printing %q, want %d with %q", test.args, exit, out, test.exit, test.out)
+		}
+	}
+}
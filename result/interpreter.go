@@ -6,4 +6,6 @@ const (
 	INTERPRET_OK InterpretResult = iota
 	INTERPRET_COMPILE_ERROR
 	INTERPRET_RUNTIME_ERROR
+	INTERPRET_INVALID_BYTECODE
+	INTERPRET_ABORTED
 )
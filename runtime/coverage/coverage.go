@@ -0,0 +1,131 @@
+// Package coverage turns the instruction counts a vm.Coverage gathers into
+// line coverage of the source files they came from, and writes it as LCOV
+// for other tools or as an HTML page to read.
+package coverage
+
+import (
+	"sort"
+
+	"github.com/caelondev/hydor/frontend/bytecode"
+	"github.com/caelondev/hydor/frontend/debug"
+	"github.com/caelondev/hydor/runtime/vm"
+)
+
+// Report is line coverage merged from any number of runs and files.
+type Report struct {
+	files map[string]*File
+}
+
+// File is the coverage of one source file.
+type File struct {
+	Name string
+	// Source is the file's text, used by the HTML report. It may be empty.
+	Source string
+	// Lines maps every line that compiled to code to how often it ran,
+	// which is the count of its most executed instruction.
+	Lines map[int]int64
+}
+
+func New() *Report {
+	return &Report{files: map[string]*File{}}
+}
+
+func (r *Report) file(name string) *File {
+	f, ok := r.files[name]
+	if !ok {
+		f = &File{Name: name, Lines: map[int]int64{}}
+		r.files[name] = f
+	}
+	return f
+}
+
+// Add merges the counts in c. Each chunk counts towards the file it was
+// compiled from, so chunks compiled from the same file, as each test in a
+// file is, add up.
+func (r *Report) Add(c *vm.Coverage) {
+	for _, chunk := range c.Chunks() {
+		f := r.file(chunk.File)
+		counts := c.Counts(chunk)
+		lines := map[int]int64{}
+
+		offset := 0
+		for offset < len(chunk.Code) {
+			op := bytecode.OpCode(chunk.Code[offset])
+			// The final return belongs to the end of the file rather than
+			// to any code on that line, such as the last test of a file.
+			if op != bytecode.OP_RETURN {
+				line := debug.GetLine(chunk, offset)
+				lines[line] = max(lines[line], counts[offset])
+			}
+
+			width := bytecode.OperandWidth(op)
+			if width < 0 {
+				break
+			}
+			offset += 1 + width
+		}
+
+		for line, n := range lines {
+			if line > 0 {
+				f.Lines[line] += n
+			}
+		}
+	}
+}
+
+// SetSource records the text of the named file for the HTML report.
+func (r *Report) SetSource(name, source string) {
+	r.file(name).Source = source
+}
+
+// Files returns the files with coverage, sorted by name. Files that only
+// have a source recorded are left out.
+func (r *Report) Files() []*File {
+	files := make([]*File, 0, len(r.files))
+	for _, f := range r.files {
+		if len(f.Lines) > 0 {
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files
+}
+
+// Summary returns how many lines ran at least once and how many lines
+// hold code, across every file.
+func (r *Report) Summary() (hit, found int) {
+	for _, f := range r.files {
+		h, n := f.Summary()
+		hit += h
+		found += n
+	}
+	return hit, found
+}
+
+// Summary returns how many of f's lines ran and how many hold code.
+func (f *File) Summary() (hit, found int) {
+	for _, n := range f.Lines {
+		if n > 0 {
+			hit++
+		}
+	}
+	return hit, len(f.Lines)
+}
+
+// sortedLines returns the lines of f that hold code in ascending order.
+func (f *File) sortedLines() []int {
+	lines := make([]int, 0, len(f.Lines))
+	for line := range f.Lines {
+		lines = append(lines, line)
+	}
+	sort.Ints(lines)
+	return lines
+}
+
+// Percent is hit as a percentage of found, or 100 when found is zero.
+func Percent(hit, found int) float64 {
+	if found == 0 {
+		return 100
+	}
+	return 100 * float64(hit) / float64(found)
+}
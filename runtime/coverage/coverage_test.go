@@ -0,0 +1,160 @@
+package coverage
+
+import (
+	"io"
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/caelondev/hydor/frontend/compiler"
+	"github.com/caelondev/hydor/frontend/optimizer"
+	"github.com/caelondev/hydor/result"
+	"github.com/caelondev/hydor/runtime/vm"
+)
+
+const source = `1 +
+  try {
+    2
+  } catch (e) {
+    3 < 4
+  }
+`
+
+// run compiles source as file and runs it times times, counting into cov.
+func run(t *testing.T, cov *vm.Coverage, file, source string, times int) {
+	t.Helper()
+	chunk, ok := compiler.Compile(source, compiler.Options{File: file, Optimize: optimizer.O0, Errors: io.Discard})
+	if !ok {
+		t.Fatalf("%q does not compile", source)
+	}
+	for i := 0; i < times; i++ {
+		machine := vm.NewVM()
+		machine.Stdout = io.Discard
+		machine.Coverage = cov
+		if res := machine.Interpret(chunk); res != result.INTERPRET_OK {
+			t.Fatalf("%q: result %d", source, res)
+		}
+	}
+}
+
+func TestAdd(t *testing.T) {
+	cov := vm.NewCoverage()
+	run(t, cov, "main.hd", source, 2)
+	report := New()
+	report.Add(cov)
+
+	files := report.Files()
+	if len(files) != 1 || files[0].Name != "main.hd" {
+		t.Fatalf("files = %+v, want main.hd", files)
+	}
+	// The catch never runs. Line 6 holds the end of the handler, which is
+	// skipped, and the addition, which is not.
+	want := map[int]int64{1: 2, 3: 2, 4: 2, 5: 0, 6: 2}
+	if !maps.Equal(files[0].Lines, want) {
+		t.Errorf("lines = %v, want %v", files[0].Lines, want)
+	}
+	if hit, found := report.Summary(); hit != 4 || found != 5 {
+		t.Errorf("summary %d/%d, want 4/5", hit, found)
+	}
+}
+
+// TestMerge adds up chunks compiled from parts of the same file, the way
+// each test in a test file is compiled, and keeps other files apart.
+func TestMerge(t *testing.T) {
+	cov := vm.NewCoverage()
+	run(t, cov, "a_test.hd", "1 ==\n  1\n\n", 1)
+	run(t, cov, "a_test.hd", "\n\ntry { 2 } catch (e) { 3 }", 3)
+	report := New()
+	report.Add(cov)
+
+	other := vm.NewCoverage()
+	run(t, other, "b_test.hd", "\n4", 1)
+	run(t, other, "a_test.hd", "1 ==\n  1\n\n", 1)
+	report.Add(other)
+
+	files := report.Files()
+	if len(files) != 2 || files[0].Name != "a_test.hd" || files[1].Name != "b_test.hd" {
+		t.Fatalf("files = %+v, want a_test.hd then b_test.hd", files)
+	}
+	if want := map[int]int64{1: 2, 2: 2, 3: 3}; !maps.Equal(files[0].Lines, want) {
+		t.Errorf("a_test.hd lines = %v, want %v", files[0].Lines, want)
+	}
+	if want := map[int]int64{2: 1}; !maps.Equal(files[1].Lines, want) {
+		t.Errorf("b_test.hd lines = %v, want %v", files[1].Lines, want)
+	}
+}
+
+func TestWriteLCOV(t *testing.T) {
+	cov := vm.NewCoverage()
+	run(t, cov, "main.hd", source, 1)
+	run(t, cov, "other.hd", "7", 1)
+	report := New()
+	report.Add(cov)
+
+	var out strings.Builder
+	if err := report.WriteLCOV(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := `SF:main.hd
+DA:1,1
+DA:3,1
+DA:4,1
+DA:5,0
+DA:6,1
+LF:5
+LH:4
+end_of_record
+SF:other.hd
+DA:1,1
+LF:1
+LH:1
+end_of_record
+`
+	if out.String() != want {
+		t.Errorf("LCOV:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestWriteHTML(t *testing.T) {
+	cov := vm.NewCoverage()
+	run(t, cov, "main.hd", source, 1)
+	report := New()
+	report.Add(cov)
+	report.SetSource("main.hd", source)
+	report.SetSource("unrun.hd", "1")
+
+	var out strings.Builder
+	if err := report.WriteHTML(&out); err != nil {
+		t.Fatal(err)
+	}
+	page := out.String()
+	for _, want := range []string{
+		"<p>80.0% of 5 lines covered</p>",
+		`<td><a href="#file0">main.hd</a></td><td>4 / 5</td><td>80.0%</td>`,
+		`<tr class="covered"><td class="number">1</td><td class="count">1</td><td class="text">1 &#43;</td></tr>`,
+		`<tr class=""><td class="number">2</td><td class="count"></td><td class="text">  try {</td></tr>`,
+		`<tr class="uncovered"><td class="number">5</td><td class="count">0</td><td class="text">    3 &lt; 4</td></tr>`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page lacks %s", want)
+		}
+	}
+	if strings.Contains(page, "unrun.hd") {
+		t.Error("page lists a file that never ran")
+	}
+}
+
+func TestWriteHTMLWithoutSource(t *testing.T) {
+	cov := vm.NewCoverage()
+	run(t, cov, "main.hd", source, 1)
+	report := New()
+	report.Add(cov)
+
+	var out strings.Builder
+	if err := report.WriteHTML(&out); err != nil {
+		t.Fatal(err)
+	}
+	if rows := strings.Count(out.String(), `<td class="number">`); rows != 5 {
+		t.Errorf("%d source rows, want one per line of code", rows)
+	}
+}
@@ -0,0 +1,120 @@
+package coverage
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+)
+
+// htmlFile is a File laid out for the page.
+type htmlFile struct {
+	Id      string
+	Name    string
+	Hit     int
+	Found   int
+	Percent string
+	Lines   []htmlLine
+}
+
+// htmlLine is one line of source. Class is "covered" or "uncovered" for a
+// line holding code and empty otherwise.
+type htmlLine struct {
+	Number int
+	Count  string
+	Class  string
+	Text   string
+}
+
+var page = template.Must(template.New("coverage").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Hydor coverage</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table.summary td, table.summary th { padding: 0.2em 1em; text-align: left; }
+table.source { border-collapse: collapse; font-family: monospace; white-space: pre; }
+table.source td { padding: 0 0.5em; }
+td.number, td.count { color: #888; text-align: right; }
+tr.covered td.text { background: #dfd; }
+tr.uncovered td.text { background: #fdd; }
+</style>
+</head>
+<body>
+<h1>Hydor coverage</h1>
+<p>{{.Percent}} of {{.Found}} lines covered</p>
+<table class="summary">
+<tr><th>File</th><th>Lines</th><th>Coverage</th></tr>
+{{range .Files}}<tr><td><a href="#{{.Id}}">{{.Name}}</a></td><td>{{.Hit}} / {{.Found}}</td><td>{{.Percent}}</td></tr>
+{{end}}</table>
+{{range .Files}}
+<h2 id="{{.Id}}">{{.Name}}</h2>
+<table class="source">
+{{range .Lines}}<tr class="{{.Class}}"><td class="number">{{.Number}}</td><td class="count">{{.Count}}</td><td class="text">{{.Text}}</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
+
+// WriteHTML writes the report as a single self-contained HTML page that
+// shows each file's source with covered lines in green, uncovered lines in
+// red and the execution count beside each.
+func (r *Report) WriteHTML(w io.Writer) error {
+	hit, found := r.Summary()
+	data := struct {
+		Percent string
+		Found   int
+		Files   []htmlFile
+	}{percent(hit, found), found, nil}
+
+	for i, f := range r.Files() {
+		hit, found := f.Summary()
+		data.Files = append(data.Files, htmlFile{
+			Id:      fmt.Sprintf("file%d", i),
+			Name:    f.Name,
+			Hit:     hit,
+			Found:   found,
+			Percent: percent(hit, found),
+			Lines:   f.htmlLines(),
+		})
+	}
+	return page.Execute(w, data)
+}
+
+func percent(hit, found int) string {
+	return fmt.Sprintf("%.1f%%", Percent(hit, found))
+}
+
+// htmlLines pairs each line of f's source with its coverage. Without a
+// source only the lines holding code are listed.
+func (f *File) htmlLines() []htmlLine {
+	text := strings.Split(strings.TrimSuffix(f.Source, "\n"), "\n")
+	if f.Source == "" {
+		text = nil
+	}
+	last := len(text)
+	for line := range f.Lines {
+		last = max(last, line)
+	}
+
+	lines := []htmlLine{}
+	for number := 1; number <= last; number++ {
+		l := htmlLine{Number: number}
+		if number <= len(text) {
+			l.Text = text[number-1]
+		}
+		if n, ok := f.Lines[number]; ok {
+			l.Count = fmt.Sprint(n)
+			l.Class = "uncovered"
+			if n > 0 {
+				l.Class = "covered"
+			}
+		} else if text == nil {
+			continue
+		}
+		lines = append(lines, l)
+	}
+	return lines
+}
@@ -0,0 +1,23 @@
+package coverage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// WriteLCOV writes the report in the LCOV tracefile format read by
+// genhtml, editors and coverage services: one record per file giving each
+// line's execution count.
+func (r *Report) WriteLCOV(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	for _, f := range r.Files() {
+		fmt.Fprintf(out, "SF:%s\n", f.Name)
+		for _, line := range f.sortedLines() {
+			fmt.Fprintf(out, "DA:%d,%d\n", line, f.Lines[line])
+		}
+		hit, found := f.Summary()
+		fmt.Fprintf(out, "LF:%d\nLH:%d\nend_of_record\n", found, hit)
+	}
+	return out.Flush()
+}
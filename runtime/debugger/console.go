@@ -0,0 +1,183 @@
+package debugger
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// LIST_CONTEXT is how many source lines list shows either side of the
+// current line.
+const LIST_CONTEXT = 3
+
+const consoleHelp = `Commands:
+  break, b <line>     Set a breakpoint
+  clear <line>        Remove a breakpoint
+  breakpoints         List breakpoints
+  continue, c         Run to the next breakpoint or watch
+  step, s             Run to the next line, entering calls
+  next, n             Run to the next line in this frame
+  finish, f           Run until the current frame returns
+  backtrace, bt       Show the call stack
+  stack               Show the value stack
+  locals              Show variables in scope
+  print, p <expr>     Evaluate an expression in the paused frame
+  watch <name>        Pause when a variable changes
+  unwatch <name>      Remove a watch
+  list, l             Show the source around the current line
+  quit, q             Stop the program and exit
+`
+
+// Console drives a Debugger from a line-oriented terminal session. The
+// program starts paused on its first instruction.
+type Console struct {
+	debugger *Debugger
+	source   []string
+	in       *bufio.Scanner
+	out      io.Writer
+}
+
+// NewConsole reads commands from in and writes to out. source is the
+// program's text, used to show lines; it may be empty for compiled files.
+func NewConsole(source string, in io.Reader, out io.Writer) *Console {
+	c := &Console{
+		in:  bufio.NewScanner(in),
+		out: out,
+	}
+	if source != "" {
+		c.source = strings.Split(source, "\n")
+	}
+
+	c.debugger = New(c.pause)
+	c.debugger.StopOnEntry = true
+	return c
+}
+
+// Debugger returns the debugger to attach as the VM's Hook.
+func (c *Console) Debugger() *Debugger {
+	return c.debugger
+}
+
+func (c *Console) pause(d *Debugger, reason StopReason) bool {
+	frame := d.Frames()[0]
+	switch reason {
+	case STOP_WATCH:
+		change := d.Change()
+		fmt.Fprintf(c.out, "Watch '%s' changed at %s: %s -> %s\n",
+			change.Name, location(frame), change.Before, change.After)
+	default:
+		fmt.Fprintf(c.out, "Paused on %s at %s\n", reason, location(frame))
+	}
+	c.showLine(frame.Line)
+
+	for {
+		fmt.Fprint(c.out, "(hdb) ")
+		if !c.in.Scan() {
+			fmt.Fprintln(c.out)
+			return false
+		}
+
+		command, arg, _ := strings.Cut(strings.TrimSpace(c.in.Text()), " ")
+		arg = strings.TrimSpace(arg)
+
+		switch command {
+		case "":
+		case "help", "h":
+			fmt.Fprint(c.out, consoleHelp)
+		case "break", "b":
+			if line, ok := c.lineArg(arg); ok {
+				d.SetBreakpoint(line)
+				fmt.Fprintf(c.out, "Breakpoint set on line %d\n", line)
+			}
+		case "clear":
+			if line, ok := c.lineArg(arg); ok {
+				d.ClearBreakpoint(line)
+			}
+		case "breakpoints":
+			for _, line := range d.Breakpoints() {
+				fmt.Fprintf(c.out, "  line %d\n", line)
+			}
+		case "continue", "c":
+			d.Continue()
+			return true
+		case "step", "s":
+			d.StepIn()
+			return true
+		case "next", "n":
+			d.StepOver()
+			return true
+		case "finish", "f":
+			d.StepOut()
+			return true
+		case "backtrace", "bt":
+			for i, f := range d.Frames() {
+				fmt.Fprintf(c.out, "#%d %s at %s\n", i, f.Function, location(f))
+			}
+		case "stack":
+			for _, v := range d.Stack() {
+				fmt.Fprintf(c.out, "[ %s ]\n", Describe(v))
+			}
+		case "locals":
+			for _, v := range d.Locals(0) {
+				fmt.Fprintf(c.out, "%s = %s\n", v.Name, Describe(v.Value))
+			}
+		case "print", "p":
+			v, err := d.Evaluate(0, arg)
+			if err != nil {
+				fmt.Fprintln(c.out, err)
+			} else {
+				fmt.Fprintln(c.out, Describe(v))
+			}
+		case "watch":
+			if arg == "" {
+				fmt.Fprintln(c.out, "watch expects a variable name")
+			} else {
+				d.Watch(arg)
+			}
+		case "unwatch":
+			if !d.Unwatch(arg) {
+				fmt.Fprintf(c.out, "No watch on '%s'\n", arg)
+			}
+		case "list", "l":
+			c.list(frame.Line)
+		case "quit", "q":
+			return false
+		default:
+			fmt.Fprintf(c.out, "Unknown command '%s'. Type 'help' for a list.\n", command)
+		}
+	}
+}
+
+func (c *Console) lineArg(arg string) (int, bool) {
+	line, err := strconv.Atoi(arg)
+	if err != nil || line < 1 {
+		fmt.Fprintf(c.out, "Invalid line number '%s'\n", arg)
+		return 0, false
+	}
+	return line, true
+}
+
+func (c *Console) showLine(line int) {
+	if line >= 1 && line <= len(c.source) {
+		fmt.Fprintf(c.out, "%4d | %s\n", line, c.source[line-1])
+	}
+}
+
+func (c *Console) list(current int) {
+	for line := max(current-LIST_CONTEXT, 1); line <= min(current+LIST_CONTEXT, len(c.source)); line++ {
+		marker := " "
+		if line == current {
+			marker = ">"
+		}
+		fmt.Fprintf(c.out, "%s%4d | %s\n", marker, line, c.source[line-1])
+	}
+}
+
+func location(f Frame) string {
+	if f.File == "" {
+		return fmt.Sprintf("line %d", f.Line)
+	}
+	return fmt.Sprintf("%s:%d", f.File, f.Line)
+}
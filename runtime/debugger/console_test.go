@@ -0,0 +1,131 @@
+package debugger
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/caelondev/hydor/frontend/compiler"
+	"github.com/caelondev/hydor/frontend/optimizer"
+	"github.com/caelondev/hydor/result"
+	"github.com/caelondev/hydor/runtime/vm"
+)
+
+const source = `"<" +
+  try {
+    throw "boom"
+  } catch (e) {
+    try {
+      throw e.message + "!"
+    } catch (f) {
+      f.message
+    }
+  }`
+
+// session runs source at -O0 under a Console fed commands, one per line,
+// and returns what the console wrote and what the program printed.
+func session(t *testing.T, commands string) (result.InterpretResult, string, string) {
+	t.Helper()
+	var errors strings.Builder
+	chunk, ok := compiler.Compile(source, compiler.Options{File: "main.hd", Optimize: optimizer.O0, Errors: &errors})
+	if !ok {
+		t.Fatal(errors.String())
+	}
+
+	var console, stdout strings.Builder
+	c := NewConsole(source, strings.NewReader(commands), &console)
+	machine := vm.NewVM()
+	machine.Stdout = &stdout
+	machine.Stderr = io.Discard
+	machine.Hook = c.Debugger()
+	res := machine.Interpret(chunk)
+	return res, console.String(), stdout.String()
+}
+
+// expectInOrder checks that each of want appears in out after the one
+// before it.
+func expectInOrder(t *testing.T, out string, want ...string) {
+	t.Helper()
+	rest := out
+	for _, w := range want {
+		i := strings.Index(rest, w)
+		if i < 0 {
+			t.Errorf("console output lacks %q after the earlier lines:\n%s", w, out)
+			return
+		}
+		rest = rest[i+len(w):]
+	}
+}
+
+func TestConsoleBreakpoints(t *testing.T) {
+	res, out, stdout := session(t, "b 6\nb 9\nb x\nclear 9\nbreakpoints\nc\nlocals\nc\n")
+	if res != result.INTERPRET_OK || stdout != "<boom!\n" {
+		t.Errorf("result %d printing %q", res, stdout)
+	}
+	expectInOrder(t, out,
+		"Paused on entry at main.hd:1\n   1 | \"<\" +\n",
+		"Breakpoint set on line 6\n",
+		"Invalid line number 'x'\n",
+		"(hdb)   line 6\n(hdb) ",
+		"Paused on breakpoint at main.hd:6\n   6 |       throw e.message + \"!\"\n",
+		"(hdb) e = Error: boom\n",
+	)
+	if strings.Count(out, "Paused on") != 2 {
+		t.Errorf("want a pause on entry and one on line 6:\n%s", out)
+	}
+}
+
+func TestConsoleStepping(t *testing.T) {
+	res, out, stdout := session(t, "s\nn\nbt\nf\n")
+	if res != result.INTERPRET_OK || stdout != "<boom!\n" {
+		t.Errorf("result %d printing %q", res, stdout)
+	}
+	// With no calls to enter, step and next both go to the next line run,
+	// and finish runs out of the script's only frame to the end.
+	expectInOrder(t, out,
+		"Paused on entry at main.hd:1\n",
+		"Paused on step at main.hd:3\n",
+		"Paused on step at main.hd:6\n",
+		"#0 script at main.hd:6\n",
+	)
+	if strings.Count(out, "Paused on") != 3 {
+		t.Errorf("finish paused again:\n%s", out)
+	}
+}
+
+func TestConsoleWatch(t *testing.T) {
+	res, out, _ := session(t, "watch f\nwatch\nc\nunwatch f\nunwatch g\nc\n")
+	if res != result.INTERPRET_OK {
+		t.Errorf("result %d", res)
+	}
+	expectInOrder(t, out,
+		"watch expects a variable name\n",
+		"Watch 'f' changed at main.hd:8: <not in scope> -> Error: boom!\n   8 |       f.message\n",
+		"No watch on 'g'\n",
+	)
+	if strings.Count(out, "Watch 'f' changed") != 1 {
+		t.Errorf("an unwatched variable paused again:\n%s", out)
+	}
+}
+
+func TestConsoleEvaluate(t *testing.T) {
+	res, out, stdout := session(t, "b 8\nc\np e.message + f.message\np nope\nprint 1 / 0\nstack\nq\n")
+	if res != result.INTERPRET_ABORTED || stdout != "" {
+		t.Errorf("quitting gave result %d printing %q", res, stdout)
+	}
+	expectInOrder(t, out,
+		"Paused on breakpoint at main.hd:8\n",
+		"(hdb) \"boomboom!\"\n",
+		"Undefined variable 'nope'\n",
+		"Cannot divide 1 by zero",
+		"(hdb) [ \"<\" ]\n[ Error: boom ]\n[ Error: boom! ]\n",
+	)
+}
+
+func TestConsoleEndOfInput(t *testing.T) {
+	res, out, _ := session(t, "frobnicate\n")
+	if res != result.INTERPRET_ABORTED {
+		t.Errorf("result %d, want the run to stop when input ends", res)
+	}
+	expectInOrder(t, out, "Unknown command 'frobnicate'. Type 'help' for a list.\n", "(hdb) \n")
+}
@@ -0,0 +1,539 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/caelondev/hydor/framing"
+	"github.com/caelondev/hydor/frontend/bytecode"
+	"github.com/caelondev/hydor/frontend/compiler"
+	"github.com/caelondev/hydor/frontend/optimizer"
+	"github.com/caelondev/hydor/result"
+	"github.com/caelondev/hydor/runtime/debugger"
+	"github.com/caelondev/hydor/runtime/value"
+	"github.com/caelondev/hydor/runtime/vm"
+)
+
+var errNotPaused = errors.New("The program is not paused")
+
+// Server speaks the Debug Adapter Protocol for a single program over a
+// pair of streams, normally stdin and stdout. Requests are handled one at a
+// time while the program runs on its own goroutine.
+type Server struct {
+	in  *bufio.Reader
+	out io.Writer
+
+	writeMu sync.Mutex
+	seq     int
+
+	program   string
+	chunk     *bytecode.Bytecode
+	codeLines []int
+	debugger  *debugger.Debugger
+	machine   *vm.VM
+	started   bool
+	exited    chan struct{}
+	resume    chan bool
+	stopping  chan struct{}
+	stopOnce  sync.Once
+
+	// mu guards the pause state. Inspecting the program is only safe while
+	// paused, when its goroutine is blocked waiting on resume.
+	mu      sync.Mutex
+	paused  bool
+	handles []func() []variable
+}
+
+func NewServer(in io.Reader, out io.Writer) *Server {
+	return &Server{
+		in:       bufio.NewReader(in),
+		out:      out,
+		exited:   make(chan struct{}),
+		resume:   make(chan bool),
+		stopping: make(chan struct{}),
+	}
+}
+
+// Serve handles requests until the client disconnects or the input ends.
+// The program, if still running, is stopped before Serve returns.
+func (s *Server) Serve() error {
+	defer s.stopProgram()
+
+	for {
+		body, err := framing.ReadMessage(s.in)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var req request
+		if err := json.Unmarshal(body, &req); err != nil {
+			return fmt.Errorf("malformed message: %w", err)
+		}
+		if req.Type != "request" {
+			continue
+		}
+		if !s.handle(&req) {
+			return nil
+		}
+	}
+}
+
+// handle answers one request, reporting false once the session is over.
+func (s *Server) handle(req *request) bool {
+	var body interface{}
+	var err error
+
+	switch req.Command {
+	case "initialize":
+		body = capabilities{
+			SupportsConfigurationDoneRequest: true,
+			SupportsEvaluateForHovers:        true,
+			SupportsTerminateRequest:         true,
+		}
+	case "launch":
+		err = s.launch(req.Arguments)
+	case "configurationDone":
+	case "setBreakpoints":
+		body, err = s.setBreakpoints(req.Arguments)
+	case "threads":
+		body = map[string]interface{}{"threads": []thread{{THREAD_ID, "main"}}}
+	case "stackTrace":
+		body, err = s.stackTrace()
+	case "scopes":
+		body, err = s.scopes(req.Arguments)
+	case "variables":
+		body, err = s.variables(req.Arguments)
+	case "evaluate":
+		body, err = s.evaluate(req.Arguments)
+	case "continue":
+		err = s.resumeWith((*debugger.Debugger).Continue)
+		body = map[string]interface{}{"allThreadsContinued": true}
+	case "next":
+		err = s.resumeWith((*debugger.Debugger).StepOver)
+	case "stepIn":
+		err = s.resumeWith((*debugger.Debugger).StepIn)
+	case "stepOut":
+		err = s.resumeWith((*debugger.Debugger).StepOut)
+	case "terminate":
+		s.stopProgram()
+	case "disconnect":
+		s.stopProgram()
+		s.respond(req, nil, nil)
+		return false
+	default:
+		err = fmt.Errorf("Unsupported request '%s'", req.Command)
+	}
+
+	s.respond(req, body, err)
+	if err != nil {
+		return true
+	}
+
+	switch req.Command {
+	case "launch":
+		s.send(event{Type: "event", Event: "initialized"})
+	case "configurationDone":
+		s.start()
+	}
+	return true
+}
+
+func (s *Server) respond(req *request, body interface{}, err error) {
+	res := response{
+		Type:       "response",
+		RequestSeq: req.Seq,
+		Success:    err == nil,
+		Command:    req.Command,
+		Body:       body,
+	}
+	if err != nil {
+		res.Message = err.Error()
+		res.Body = nil
+	}
+	s.send(res)
+}
+
+func (s *Server) event(name string, body interface{}) {
+	s.send(event{Type: "event", Event: name, Body: body})
+}
+
+// send numbers and writes a message. Responses and events come from both
+// the request loop and the program's goroutine, so writes are serialized.
+func (s *Server) send(msg interface{}) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.seq++
+	switch m := msg.(type) {
+	case response:
+		m.Seq = s.seq
+		msg = m
+	case event:
+		m.Seq = s.seq
+		msg = m
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	framing.WriteMessage(s.out, data)
+}
+
+func decode(raw json.RawMessage, args interface{}) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(raw, args); err != nil {
+		return fmt.Errorf("Invalid arguments: %s", err.Error())
+	}
+	return nil
+}
+
+func (s *Server) launch(raw json.RawMessage) error {
+	var args launchArguments
+	if err := decode(raw, &args); err != nil {
+		return err
+	}
+	if s.chunk != nil {
+		return errors.New("A program is already running")
+	}
+
+	data, err := os.ReadFile(args.Program)
+	if err != nil {
+		return fmt.Errorf("Cannot open file '%s', Error: %s", args.Program, err.Error())
+	}
+
+	var chunk *bytecode.Bytecode
+	if bytecode.IsCompiled(data) {
+		if chunk, _, err = bytecode.Unmarshal(data); err != nil {
+			return fmt.Errorf("Load Error: %s", err.Error())
+		}
+	} else {
+		// Debug builds skip folding so every expression keeps its line.
+		var diagnostics strings.Builder
+		var ok bool
+		chunk, ok = compiler.Compile(string(data), compiler.Options{
+			File:     args.Program,
+			Optimize: optimizer.O0,
+			Errors:   &diagnostics,
+		})
+		if !ok {
+			return errors.New(strings.TrimSpace(diagnostics.String()))
+		}
+	}
+
+	s.program = args.Program
+	s.chunk = chunk
+	s.codeLines = codeLines(chunk)
+
+	s.debugger = debugger.New(s.pause)
+	s.debugger.StopOnEntry = args.StopOnEntry
+
+	s.machine = vm.NewVM()
+	s.machine.Stdout = &output{s, "stdout"}
+	s.machine.Stderr = &output{s, "stderr"}
+	if !args.NoDebug {
+		s.machine.Hook = s.debugger
+	}
+	return nil
+}
+
+// codeLines lists, in order, the source lines that have instructions.
+func codeLines(chunk *bytecode.Bytecode) []int {
+	seen := map[int]bool{}
+	lines := []int{}
+	for _, run := range chunk.Lines {
+		if !seen[run.Line] {
+			seen[run.Line] = true
+			lines = append(lines, run.Line)
+		}
+	}
+	sort.Ints(lines)
+	return lines
+}
+
+// start runs the launched program once configuration is done.
+func (s *Server) start() {
+	if s.chunk == nil || s.started {
+		return
+	}
+	s.started = true
+
+	go func() {
+		defer close(s.exited)
+
+		exitCode := 0
+		if s.machine.Interpret(s.chunk) != result.INTERPRET_OK {
+			exitCode = 1
+		}
+		s.event("exited", map[string]interface{}{"exitCode": exitCode})
+		s.event("terminated", nil)
+	}()
+}
+
+// stopProgram ends the program, if it is running, and waits for it.
+func (s *Server) stopProgram() {
+	if !s.started {
+		return
+	}
+
+	s.stopOnce.Do(func() {
+		s.debugger.Stop()
+		close(s.stopping)
+	})
+	<-s.exited
+}
+
+// pause runs on the program's goroutine and blocks until a request
+// resumes or stops it.
+func (s *Server) pause(d *debugger.Debugger, reason debugger.StopReason) bool {
+	s.mu.Lock()
+	s.paused = true
+	s.handles = s.handles[:0]
+	s.mu.Unlock()
+
+	s.event("stopped", map[string]interface{}{
+		"reason":            stopReason(reason),
+		"threadId":          THREAD_ID,
+		"allThreadsStopped": true,
+	})
+
+	select {
+	case ok := <-s.resume:
+		return ok
+	case <-s.stopping:
+		// Nothing will resume the program now, so requests must stop
+		// treating it as paused.
+		s.mu.Lock()
+		s.paused = false
+		s.mu.Unlock()
+		return false
+	}
+}
+
+func stopReason(reason debugger.StopReason) string {
+	if reason == debugger.STOP_WATCH {
+		return "data breakpoint"
+	}
+	return reason.String()
+}
+
+func (s *Server) resumeWith(step func(*debugger.Debugger)) error {
+	s.mu.Lock()
+	if !s.paused {
+		s.mu.Unlock()
+		return errNotPaused
+	}
+	s.paused = false
+	s.mu.Unlock()
+
+	step(s.debugger)
+	s.resume <- true
+	return nil
+}
+
+func (s *Server) setBreakpoints(raw json.RawMessage) (interface{}, error) {
+	var args setBreakpointsArguments
+	if err := decode(raw, &args); err != nil {
+		return nil, err
+	}
+	if s.chunk == nil {
+		return nil, errors.New("No program has been launched")
+	}
+
+	breakpoints := make([]breakpoint, 0, len(args.Breakpoints))
+	if !samePath(args.Source.Path, s.program) {
+		for _, bp := range args.Breakpoints {
+			breakpoints = append(breakpoints, breakpoint{Line: bp.Line, Message: "Not part of the running program"})
+		}
+		return map[string]interface{}{"breakpoints": breakpoints}, nil
+	}
+
+	s.debugger.ClearBreakpoints()
+	for _, bp := range args.Breakpoints {
+		// A breakpoint on a line without code moves to the next line
+		// that has some.
+		i := sort.SearchInts(s.codeLines, bp.Line)
+		if i == len(s.codeLines) {
+			breakpoints = append(breakpoints, breakpoint{Line: bp.Line, Message: "No code on or after this line"})
+			continue
+		}
+		s.debugger.SetBreakpoint(s.codeLines[i])
+		breakpoints = append(breakpoints, breakpoint{Verified: true, Line: s.codeLines[i]})
+	}
+	return map[string]interface{}{"breakpoints": breakpoints}, nil
+}
+
+func samePath(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+func (s *Server) stackTrace() (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.paused {
+		return nil, errNotPaused
+	}
+
+	frames := []stackFrame{}
+	for i, f := range s.debugger.Frames() {
+		frame := stackFrame{Id: i + 1, Name: f.Function, Line: f.Line, Column: 1}
+		if f.File != "" {
+			frame.Source = &source{Name: filepath.Base(f.File), Path: f.File}
+		}
+		frames = append(frames, frame)
+	}
+	return map[string]interface{}{"stackFrames": frames, "totalFrames": len(frames)}, nil
+}
+
+// frameIndex converts a DAP frame id, which counts from one, to a
+// debugger frame index.
+func (s *Server) frameIndex(id int) (int, error) {
+	index := id - 1
+	if index < 0 || index >= len(s.debugger.Frames()) {
+		return 0, fmt.Errorf("Unknown frame %d", id)
+	}
+	return index, nil
+}
+
+func (s *Server) scopes(raw json.RawMessage) (interface{}, error) {
+	var args frameArguments
+	if err := decode(raw, &args); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.paused {
+		return nil, errNotPaused
+	}
+	index, err := s.frameIndex(args.FrameId)
+	if err != nil {
+		return nil, err
+	}
+
+	scopes := []scope{{
+		Name: "Locals",
+		VariablesReference: s.reference(func() []variable {
+			vars := []variable{}
+			for _, v := range s.debugger.Locals(index) {
+				vars = append(vars, s.variable(v.Name, v.Value))
+			}
+			return vars
+		}),
+	}}
+	if index == 0 {
+		scopes = append(scopes, scope{
+			Name: "Stack",
+			VariablesReference: s.reference(func() []variable {
+				vars := []variable{}
+				for i, v := range s.debugger.Stack() {
+					vars = append(vars, s.variable(strconv.Itoa(i), v))
+				}
+				return vars
+			}),
+		})
+	}
+	return map[string]interface{}{"scopes": scopes}, nil
+}
+
+func (s *Server) variables(raw json.RawMessage) (interface{}, error) {
+	var args variablesArguments
+	if err := decode(raw, &args); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.paused {
+		return nil, errNotPaused
+	}
+	if args.VariablesReference < 1 || args.VariablesReference > len(s.handles) {
+		return nil, fmt.Errorf("Unknown variables reference %d", args.VariablesReference)
+	}
+	return map[string]interface{}{"variables": s.handles[args.VariablesReference-1]()}, nil
+}
+
+func (s *Server) evaluate(raw json.RawMessage) (interface{}, error) {
+	var args evaluateArguments
+	if err := decode(raw, &args); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.paused {
+		return nil, errNotPaused
+	}
+	index := 0
+	if args.FrameId != 0 {
+		var err error
+		if index, err = s.frameIndex(args.FrameId); err != nil {
+			return nil, err
+		}
+	}
+
+	v, err := s.debugger.Evaluate(index, args.Expression)
+	if err != nil {
+		return nil, err
+	}
+	res := s.variable("", v)
+	return map[string]interface{}{
+		"result":             res.Value,
+		"type":               res.Type,
+		"variablesReference": res.VariablesReference,
+	}, nil
+}
+
+// reference registers a lazily expanded set of variables and returns its
+// reference. References last until the program resumes.
+func (s *Server) reference(expand func() []variable) int {
+	s.handles = append(s.handles, expand)
+	return len(s.handles)
+}
+
+// variable describes v, making errors expandable into their fields.
+func (s *Server) variable(name string, v value.Value) variable {
+	out := variable{Name: name, Value: debugger.Describe(v), Type: value.ValueTypeName(v)}
+	if !v.IsError() {
+		return out
+	}
+
+	err := v.AsError()
+	out.VariablesReference = s.reference(func() []variable {
+		var trace strings.Builder
+		vm.PrintTrace(&trace, err.Trace)
+		return []variable{
+			{Name: "message", Value: strconv.Quote(err.Message), Type: "string"},
+			{Name: "kind", Value: strconv.Quote(err.Kind), Type: "string"},
+			{Name: "trace", Value: strconv.Quote(strings.TrimSuffix(trace.String(), "\n")), Type: "string"},
+		}
+	})
+	return out
+}
+
+// output forwards program output to the client as output events.
+type output struct {
+	server   *Server
+	category string
+}
+
+func (o *output) Write(p []byte) (int, error) {
+	o.server.event("output", map[string]interface{}{"category": o.category, "output": string(p)})
+	return len(p), nil
+}
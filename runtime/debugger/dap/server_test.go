@@ -0,0 +1,335 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caelondev/hydor/framing"
+)
+
+// message is any response or event, with the body left for the test to
+// decode.
+type message struct {
+	Type    string          `json:"type"`
+	Event   string          `json:"event"`
+	Command string          `json:"command"`
+	Success bool            `json:"success"`
+	Message string          `json:"message"`
+	Body    json.RawMessage `json:"body"`
+}
+
+// client drives a Server over pipes the way an editor would.
+type client struct {
+	t        *testing.T
+	in       *io.PipeWriter
+	seq      int
+	messages chan *message
+	// pending holds messages read while waiting for others. The program
+	// runs alongside the request loop, so its events can overtake the
+	// response to the request that resumed it.
+	pending []*message
+	served  chan error
+}
+
+func newClient(t *testing.T) *client {
+	inReader, inWriter := io.Pipe()
+	outReader, outWriter := io.Pipe()
+	c := &client{
+		t:        t,
+		in:       inWriter,
+		messages: make(chan *message, 64),
+		served:   make(chan error, 1),
+	}
+
+	go func() {
+		c.served <- NewServer(inReader, outWriter).Serve()
+		outWriter.Close()
+	}()
+	go func() {
+		defer close(c.messages)
+		r := bufio.NewReader(outReader)
+		for {
+			body, err := framing.ReadMessage(r)
+			if err != nil {
+				return
+			}
+			var m message
+			if err := json.Unmarshal(body, &m); err != nil {
+				t.Errorf("server sent malformed JSON: %s", body)
+				return
+			}
+			c.messages <- &m
+		}
+	}()
+
+	t.Cleanup(func() {
+		inWriter.Close()
+		outReader.Close()
+	})
+	return c
+}
+
+func (c *client) send(command string, args interface{}) {
+	c.t.Helper()
+	c.seq++
+	data, err := json.Marshal(map[string]interface{}{
+		"seq": c.seq, "type": "request", "command": command, "arguments": args,
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if err := framing.WriteMessage(c.in, data); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// until returns the first message, pending or new, that satisfies match,
+// failing the test if the server goes quiet first.
+func (c *client) until(what string, match func(*message) bool) *message {
+	c.t.Helper()
+	for i, m := range c.pending {
+		if match(m) {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return m
+		}
+	}
+	for {
+		select {
+		case m, ok := <-c.messages:
+			if !ok {
+				c.t.Fatalf("server closed the stream while waiting for %s", what)
+			}
+			if match(m) {
+				return m
+			}
+			c.pending = append(c.pending, m)
+		case <-time.After(5 * time.Second):
+			c.t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// request sends a request and returns its response.
+func (c *client) request(command string, args interface{}) *message {
+	c.t.Helper()
+	c.send(command, args)
+	return c.until(command+" response", func(m *message) bool {
+		return m.Type == "response" && m.Command == command
+	})
+}
+
+// event returns the next event called name.
+func (c *client) event(name string) *message {
+	c.t.Helper()
+	return c.until(name+" event", func(m *message) bool {
+		return m.Type == "event" && m.Event == name
+	})
+}
+
+func decodeBody(t *testing.T, m *message, body interface{}) {
+	t.Helper()
+	if !m.Success && m.Type == "response" {
+		t.Fatalf("%s failed: %s", m.Command, m.Message)
+	}
+	if err := json.Unmarshal(m.Body, body); err != nil {
+		t.Fatalf("%s body %s: %v", m.Command, m.Body, err)
+	}
+}
+
+func writeProgram(t *testing.T, source string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "main.hd")
+	if err := os.WriteFile(path, []byte(source), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const program = `1 +
+  try {
+    2 * "x"
+  } catch (e) {
+    e.kind +
+      "!"
+  }
+`
+
+func TestBreakpointSession(t *testing.T) {
+	path := writeProgram(t, program)
+	c := newClient(t)
+
+	var caps capabilities
+	decodeBody(t, c.request("initialize", nil), &caps)
+	if !caps.SupportsConfigurationDoneRequest {
+		t.Error("configurationDone is not advertised")
+	}
+	if res := c.request("launch", map[string]interface{}{"program": path}); !res.Success {
+		t.Fatalf("launch failed: %s", res.Message)
+	}
+	c.event("initialized")
+
+	var bps struct{ Breakpoints []breakpoint }
+	decodeBody(t, c.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]string{"path": path},
+		"breakpoints": []map[string]int{{"line": 5}, {"line": 99}},
+	}), &bps)
+	if len(bps.Breakpoints) != 2 || !bps.Breakpoints[0].Verified || bps.Breakpoints[1].Verified {
+		t.Fatalf("breakpoints = %+v, want line 5 verified and line 99 not", bps.Breakpoints)
+	}
+
+	c.request("configurationDone", nil)
+	var stopped struct{ Reason string }
+	decodeBody(t, c.event("stopped"), &stopped)
+	if stopped.Reason != "breakpoint" {
+		t.Errorf("stopped for %q, want breakpoint", stopped.Reason)
+	}
+
+	var trace struct{ StackFrames []stackFrame }
+	decodeBody(t, c.request("stackTrace", map[string]int{"threadId": THREAD_ID}), &trace)
+	if len(trace.StackFrames) != 1 || trace.StackFrames[0].Line != 5 {
+		t.Fatalf("stack = %+v, want one frame on line 5", trace.StackFrames)
+	}
+	frame := trace.StackFrames[0].Id
+
+	var scopes struct{ Scopes []scope }
+	decodeBody(t, c.request("scopes", map[string]int{"frameId": frame}), &scopes)
+	if len(scopes.Scopes) == 0 || scopes.Scopes[0].Name != "Locals" {
+		t.Fatalf("scopes = %+v, want Locals first", scopes.Scopes)
+	}
+
+	var locals struct{ Variables []variable }
+	decodeBody(t, c.request("variables", map[string]int{"variablesReference": scopes.Scopes[0].VariablesReference}), &locals)
+	if len(locals.Variables) != 1 || locals.Variables[0].Name != "e" || locals.Variables[0].Type != "error" {
+		t.Fatalf("locals = %+v, want the error e", locals.Variables)
+	}
+	if !strings.HasPrefix(locals.Variables[0].Value, "TypeError: Cannot multiply") {
+		t.Errorf("e = %q", locals.Variables[0].Value)
+	}
+
+	var fields struct{ Variables []variable }
+	decodeBody(t, c.request("variables", map[string]int{"variablesReference": locals.Variables[0].VariablesReference}), &fields)
+	names := []string{}
+	for _, v := range fields.Variables {
+		names = append(names, v.Name)
+	}
+	if strings.Join(names, ",") != "message,kind,trace" {
+		t.Errorf("error fields = %v, want message, kind and trace", names)
+	}
+
+	var eval struct{ Result string }
+	decodeBody(t, c.request("evaluate", map[string]interface{}{"expression": "e.kind", "frameId": frame}), &eval)
+	if eval.Result != `"TypeError"` {
+		t.Errorf("e.kind evaluated to %s", eval.Result)
+	}
+
+	c.request("next", map[string]int{"threadId": THREAD_ID})
+	decodeBody(t, c.event("stopped"), &stopped)
+	if stopped.Reason != "step" {
+		t.Errorf("stopped for %q after next, want step", stopped.Reason)
+	}
+
+	c.request("continue", map[string]int{"threadId": THREAD_ID})
+	var out struct{ Category, Output string }
+	decodeBody(t, c.event("output"), &out)
+	if out.Category != "stderr" || !strings.HasPrefix(out.Output, "Runtime Error: Cannot add") {
+		t.Errorf("output = %+v, want the runtime error on stderr", out)
+	}
+	var exited struct{ ExitCode int }
+	decodeBody(t, c.event("exited"), &exited)
+	if exited.ExitCode != 1 {
+		t.Errorf("exit code %d, want 1", exited.ExitCode)
+	}
+	c.event("terminated")
+
+	c.request("disconnect", nil)
+	if err := <-c.served; err != nil {
+		t.Errorf("Serve: %v", err)
+	}
+}
+
+func TestNoDebug(t *testing.T) {
+	path := writeProgram(t, "1 +\n  2")
+	c := newClient(t)
+
+	c.request("initialize", nil)
+	c.request("launch", map[string]interface{}{"program": path, "noDebug": true})
+	c.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]string{"path": path},
+		"breakpoints": []map[string]int{{"line": 1}},
+	})
+	c.request("configurationDone", nil)
+
+	// Output arrives in pieces as the program writes it.
+	var stdout strings.Builder
+	exit := c.until("exited event", func(m *message) bool {
+		if m.Event == "output" {
+			var out struct{ Category, Output string }
+			decodeBody(t, m, &out)
+			if out.Category == "stdout" {
+				stdout.WriteString(out.Output)
+			}
+		}
+		return m.Event == "exited"
+	})
+	if stdout.String() != "3\n" {
+		t.Errorf("stdout = %q, want 3", stdout.String())
+	}
+	var exited struct{ ExitCode int }
+	decodeBody(t, exit, &exited)
+	if exited.ExitCode != 0 {
+		t.Errorf("exit code %d, want 0", exited.ExitCode)
+	}
+}
+
+func TestStopOnEntryAndTerminate(t *testing.T) {
+	path := writeProgram(t, program)
+	c := newClient(t)
+
+	c.request("initialize", nil)
+	c.request("launch", map[string]interface{}{"program": path, "stopOnEntry": true})
+	c.request("configurationDone", nil)
+	var stopped struct{ Reason string }
+	decodeBody(t, c.event("stopped"), &stopped)
+	if stopped.Reason != "entry" {
+		t.Errorf("stopped for %q, want entry", stopped.Reason)
+	}
+
+	c.request("terminate", nil)
+	c.event("terminated")
+	if res := c.request("continue", map[string]int{"threadId": THREAD_ID}); res.Success {
+		t.Error("continue succeeded after terminate")
+	}
+}
+
+func TestFailedRequests(t *testing.T) {
+	c := newClient(t)
+
+	tests := []struct {
+		command string
+		args    interface{}
+		want    string
+	}{
+		{"launch", map[string]string{"program": filepath.Join(t.TempDir(), "missing.hd")}, "Cannot open file"},
+		{"launch", map[string]int{"program": 1}, "Invalid arguments"},
+		{"evaluate", map[string]string{"expression": "1"}, errNotPaused.Error()},
+		{"stepIn", nil, errNotPaused.Error()},
+		{"restart", nil, "Unsupported request 'restart'"},
+	}
+	for _, tt := range tests {
+		res := c.request(tt.command, tt.args)
+		if res.Success || !strings.Contains(res.Message, tt.want) {
+			t.Errorf("%s: success %t, message %q, want a failure containing %q", tt.command, res.Success, res.Message, tt.want)
+		}
+	}
+
+	bad := writeProgram(t, "1 +")
+	if res := c.request("launch", map[string]string{"program": bad}); res.Success || !strings.Contains(res.Message, "Expected expression") {
+		t.Errorf("launching a broken program: success %t, message %q", res.Success, res.Message)
+	}
+}
@@ -0,0 +1,407 @@
+package debugger
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/caelondev/hydor/frontend/bytecode"
+	"github.com/caelondev/hydor/frontend/compiler"
+	"github.com/caelondev/hydor/frontend/debug"
+	"github.com/caelondev/hydor/frontend/optimizer"
+	"github.com/caelondev/hydor/result"
+	"github.com/caelondev/hydor/runtime/value"
+	"github.com/caelondev/hydor/runtime/vm"
+)
+
+type StopReason int
+
+const (
+	STOP_ENTRY StopReason = iota
+	STOP_BREAKPOINT
+	STOP_STEP
+	STOP_WATCH
+)
+
+func (r StopReason) String() string {
+	switch r {
+	case STOP_ENTRY:
+		return "entry"
+	case STOP_BREAKPOINT:
+		return "breakpoint"
+	case STOP_STEP:
+		return "step"
+	case STOP_WATCH:
+		return "watch"
+	default:
+		return "unknown"
+	}
+}
+
+type stepMode int
+
+const (
+	modeContinue stepMode = iota
+	modeStepIn
+	modeStepOver
+	modeStepOut
+)
+
+// Handler is called each time execution pauses. It inspects the paused
+// program through the Debugger, picks how to resume with Continue, StepIn,
+// StepOver or StepOut, and returns. Returning false ends the run.
+type Handler func(d *Debugger, reason StopReason) bool
+
+// Debugger pauses a VM at breakpoints, after steps and when a watched
+// variable changes. Attach it by setting it as the VM's Hook. Breakpoints
+// may be changed and Stop called from any goroutine; everything else is for
+// the handler while execution is paused.
+type Debugger struct {
+	// StopOnEntry pauses before the first instruction runs.
+	StopOnEntry bool
+
+	handler Handler
+	vm      *vm.VM
+	stopped atomic.Bool
+
+	mu          sync.Mutex
+	breakpoints map[int]bool
+
+	watches []*watch
+	change  WatchChange
+
+	mode      stepMode
+	fromDepth int
+
+	started   bool
+	lastLine  int
+	lastDepth int
+}
+
+type watch struct {
+	name    string
+	value   value.Value
+	inScope bool
+}
+
+// WatchChange describes the watched variable whose change caused the most
+// recent STOP_WATCH pause.
+type WatchChange struct {
+	Name          string
+	Before, After string
+}
+
+// Frame is one entry of the paused call stack, innermost first.
+type Frame struct {
+	Function string
+	File     string
+	Line     int
+	Offset   int
+}
+
+// Variable is a named value visible in a frame.
+type Variable struct {
+	Name  string
+	Value value.Value
+}
+
+func New(handler Handler) *Debugger {
+	return &Debugger{
+		handler:     handler,
+		breakpoints: map[int]bool{},
+	}
+}
+
+// Before implements vm.Hook.
+func (d *Debugger) Before(machine *vm.VM) bool {
+	if d.stopped.Load() {
+		return false
+	}
+	d.vm = machine
+	line := debug.GetLine(machine.Bytecode, machine.Ip)
+	depth := len(machine.Frames)
+
+	reason, stop := d.check(line, depth)
+	d.lastLine, d.lastDepth = line, depth
+	if !stop {
+		return true
+	}
+
+	d.mode = modeContinue
+	return d.handler(d, reason)
+}
+
+// check decides whether to pause before an instruction on line at the
+// given call depth. Breakpoints and steps only fire on arriving at a line,
+// not on every instruction within it.
+func (d *Debugger) check(line, depth int) (StopReason, bool) {
+	if !d.started {
+		d.started = true
+		d.lastLine = -1
+		for _, w := range d.watches {
+			w.value, w.inScope = d.lookup(w.name)
+		}
+		if d.StopOnEntry {
+			return STOP_ENTRY, true
+		}
+	}
+
+	if d.watchChanged() {
+		return STOP_WATCH, true
+	}
+
+	if line == d.lastLine && depth == d.lastDepth {
+		return 0, false
+	}
+	d.mu.Lock()
+	hit := d.breakpoints[line]
+	d.mu.Unlock()
+	if hit {
+		return STOP_BREAKPOINT, true
+	}
+
+	switch d.mode {
+	case modeStepIn:
+		return STOP_STEP, true
+	case modeStepOver:
+		return STOP_STEP, depth <= d.fromDepth
+	case modeStepOut:
+		return STOP_STEP, depth < d.fromDepth
+	}
+	return 0, false
+}
+
+// Continue resumes until the next breakpoint or watch.
+func (d *Debugger) Continue() {
+	d.mode = modeContinue
+}
+
+// StepIn resumes until execution reaches another line, in any frame.
+func (d *Debugger) StepIn() {
+	d.mode = modeStepIn
+	d.fromDepth = d.lastDepth
+}
+
+// StepOver resumes until another line is reached in the current frame or
+// one of its callers.
+func (d *Debugger) StepOver() {
+	d.mode = modeStepOver
+	d.fromDepth = d.lastDepth
+}
+
+// StepOut resumes until the current frame returns.
+func (d *Debugger) StepOut() {
+	d.mode = modeStepOut
+	d.fromDepth = d.lastDepth
+}
+
+// Stop ends the run before its next instruction.
+func (d *Debugger) Stop() {
+	d.stopped.Store(true)
+}
+
+func (d *Debugger) SetBreakpoint(line int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.breakpoints[line] = true
+}
+
+func (d *Debugger) ClearBreakpoint(line int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.breakpoints, line)
+}
+
+func (d *Debugger) ClearBreakpoints() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.breakpoints = map[int]bool{}
+}
+
+// Breakpoints returns the lines with a breakpoint, in order.
+func (d *Debugger) Breakpoints() []int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	lines := make([]int, 0, len(d.breakpoints))
+	for line := range d.breakpoints {
+		lines = append(lines, line)
+	}
+	sort.Ints(lines)
+	return lines
+}
+
+// Watch pauses execution whenever the variable called name changes value
+// or enters or leaves scope.
+func (d *Debugger) Watch(name string) {
+	for _, w := range d.watches {
+		if w.name == name {
+			return
+		}
+	}
+	w := &watch{name: name}
+	if d.vm != nil {
+		w.value, w.inScope = d.lookup(name)
+	}
+	d.watches = append(d.watches, w)
+}
+
+// Unwatch removes a watch, reporting whether one existed.
+func (d *Debugger) Unwatch(name string) bool {
+	for i, w := range d.watches {
+		if w.name == name {
+			d.watches = append(d.watches[:i], d.watches[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Debugger) Watches() []string {
+	names := make([]string, len(d.watches))
+	for i, w := range d.watches {
+		names[i] = w.name
+	}
+	return names
+}
+
+// Change returns what triggered the most recent STOP_WATCH pause.
+func (d *Debugger) Change() WatchChange {
+	return d.change
+}
+
+func (d *Debugger) watchChanged() bool {
+	for _, w := range d.watches {
+		v, inScope := d.lookup(w.name)
+		if inScope == w.inScope && (!inScope || value.ValuesEqual(v, w.value)) {
+			continue
+		}
+
+		d.change = WatchChange{
+			Name:   w.name,
+			Before: describeWatch(w.value, w.inScope),
+			After:  describeWatch(v, inScope),
+		}
+		w.value, w.inScope = v, inScope
+		return true
+	}
+	return false
+}
+
+func describeWatch(v value.Value, inScope bool) string {
+	if !inScope {
+		return "<not in scope>"
+	}
+	return Describe(v)
+}
+
+// lookup finds the innermost variable called name in the paused frame.
+func (d *Debugger) lookup(name string) (value.Value, bool) {
+	found, ok := value.Value{}, false
+	for _, v := range d.Locals(0) {
+		if v.Name == name {
+			found, ok = v.Value, true
+		}
+	}
+	return found, ok
+}
+
+// frameAt returns the frame at index, counting outwards from the innermost,
+// and the offset of the instruction it is executing.
+func (d *Debugger) frameAt(index int) (*vm.CallFrame, int) {
+	frames := d.vm.Frames
+	if index < 0 || index >= len(frames) {
+		return nil, 0
+	}
+	frame := &frames[len(frames)-1-index]
+	if index == 0 {
+		return frame, d.vm.Ip
+	}
+	return frame, frame.Ip - 1
+}
+
+// Frames returns the paused call stack, innermost first.
+func (d *Debugger) Frames() []Frame {
+	frames := make([]Frame, 0, len(d.vm.Frames))
+	for i := range d.vm.Frames {
+		frame, ip := d.frameAt(i)
+		frames = append(frames, Frame{
+			Function: frame.Name,
+			File:     frame.Bytecode.File,
+			Line:     debug.GetLine(frame.Bytecode, ip),
+			Offset:   ip,
+		})
+	}
+	return frames
+}
+
+// Locals returns the variables in scope in a frame, outermost first, so a
+// shadowing variable comes after the one it hides.
+func (d *Debugger) Locals(frame int) []Variable {
+	f, ip := d.frameAt(frame)
+	if f == nil {
+		return nil
+	}
+
+	locals := []bytecode.Local{}
+	for _, l := range f.Bytecode.Locals {
+		if l.Start <= ip && ip < l.End && f.Base+l.Slot < d.vm.StackTop {
+			locals = append(locals, l)
+		}
+	}
+	sort.SliceStable(locals, func(i, j int) bool { return locals[i].Slot < locals[j].Slot })
+
+	vars := make([]Variable, len(locals))
+	for i, l := range locals {
+		vars[i] = Variable{l.Name, d.vm.Stack[f.Base+l.Slot]}
+	}
+	return vars
+}
+
+// Stack returns the values on the paused VM's stack, bottom first.
+func (d *Debugger) Stack() []value.Value {
+	return append([]value.Value(nil), d.vm.Stack[:d.vm.StackTop]...)
+}
+
+// Evaluate compiles expr with the frame's variables in scope and runs it on
+// a separate VM, so evaluating cannot disturb the paused program.
+func (d *Debugger) Evaluate(frame int, expr string) (value.Value, error) {
+	bindings := map[string]value.Value{}
+	for _, v := range d.Locals(frame) {
+		bindings[v.Name] = v.Value
+	}
+
+	var diagnostics strings.Builder
+	chunk, ok := compiler.Compile(expr, compiler.Options{
+		Optimize: optimizer.O1,
+		Errors:   &diagnostics,
+		Bindings: bindings,
+	})
+	if !ok {
+		return value.Value{}, errors.New(strings.TrimSpace(diagnostics.String()))
+	}
+
+	machine := vm.NewVM()
+	machine.Stdout = io.Discard
+	machine.Stderr = io.Discard
+	machine.MaxHeap = d.vm.MaxHeap
+	if machine.Interpret(chunk) != result.INTERPRET_OK {
+		return value.Value{}, errors.New(machine.Err().Message)
+	}
+	return machine.Result(), nil
+}
+
+// Describe formats v for display, quoting strings so they stand apart from
+// other values.
+func Describe(v value.Value) string {
+	if v.IsString() {
+		return strconv.Quote(v.AsCString())
+	}
+
+	var out strings.Builder
+	value.FprintValue(&out, v)
+	return out.String()
+}
@@ -0,0 +1,96 @@
+package profiler
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/caelondev/hydor/frontend/bytecode"
+)
+
+// MAX_SOURCE_WIDTH is how many characters of a line WriteLineCounts shows
+// before cutting it short.
+const MAX_SOURCE_WIDTH = 60
+
+// LineCount is how many instructions one source line executed.
+type LineCount struct {
+	File  string
+	Line  int
+	Count int64
+}
+
+// LineCounts totals the instruction counts by source line, hottest first.
+// Lines that never ran are left out. As in coverage reports, the final
+// return is left out too: it belongs to the end of the file rather than to
+// any code, and would otherwise put a blank line after the last one.
+func (p *Profiler) LineCounts() []LineCount {
+	type key struct {
+		file string
+		line int
+	}
+	totals := map[key]int64{}
+
+	for _, chunk := range p.counts.Chunks() {
+		counts := p.counts.Counts(chunk)
+		offset := 0
+		for _, run := range chunk.Lines {
+			for i, n := range counts[offset : offset+run.Count] {
+				if n > 0 && bytecode.OpCode(chunk.Code[offset+i]) != bytecode.OP_RETURN {
+					totals[key{chunk.File, run.Line}] += n
+				}
+			}
+			offset += run.Count
+		}
+	}
+
+	lines := make([]LineCount, 0, len(totals))
+	for k, n := range totals {
+		if n > 0 {
+			lines = append(lines, LineCount{k.file, k.line, n})
+		}
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		a, b := lines[i], lines[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Line < b.Line
+	})
+	return lines
+}
+
+// WriteLineCounts prints the line counts, hottest first, next to the
+// lines of source they belong to. source may be empty when the program
+// was loaded without it, as from a compiled file.
+func (p *Profiler) WriteLineCounts(w io.Writer, source string) error {
+	lines := p.LineCounts()
+	text := strings.Split(source, "\n")
+	total := p.Instructions()
+
+	fmt.Fprintf(w, "%d instructions executed\n", total)
+	fmt.Fprintf(w, "%10s %7s %6s\n", "count", "share", "line")
+	for _, l := range lines {
+		code := ""
+		if source != "" && l.Line >= 1 && l.Line <= len(text) {
+			code = truncate(strings.TrimSpace(text[l.Line-1]))
+		}
+		share := 100 * float64(l.Count) / float64(total)
+		if _, err := fmt.Fprintf(w, "%10d %6.1f%% %6d | %s\n", l.Count, share, l.Line, code); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// truncate cuts code down to MAX_SOURCE_WIDTH characters, marking the cut.
+func truncate(code string) string {
+	runes := []rune(code)
+	if len(runes) <= MAX_SOURCE_WIDTH {
+		return code
+	}
+	return string(runes[:MAX_SOURCE_WIDTH-3]) + "..."
+}
@@ -0,0 +1,190 @@
+package profiler
+
+import (
+	"compress/gzip"
+	"io"
+)
+
+// Field numbers from pprof's profile.proto.
+const (
+	profileSampleType    = 1
+	profileSample        = 2
+	profileLocation      = 4
+	profileFunction      = 5
+	profileStringTable   = 6
+	profileTimeNanos     = 9
+	profileDurationNanos = 10
+	profilePeriodType    = 11
+	profilePeriod        = 12
+
+	valueTypeType = 1
+	valueTypeUnit = 2
+
+	sampleLocationID = 1
+	sampleValue      = 2
+
+	locationID   = 1
+	locationLine = 4
+
+	lineFunctionID = 1
+	lineLine       = 2
+
+	functionID         = 1
+	functionName       = 2
+	functionSystemName = 3
+	functionFilename   = 4
+)
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+// SCRIPT_FILE names chunks that were not compiled from a file, such as
+// code given with -e.
+const SCRIPT_FILE = "<script>"
+
+// WriteProfile writes the samples as a gzipped pprof profile, readable by
+// `go tool pprof`. Each sample counts once and stands for Interval of CPU
+// time.
+func (p *Profiler) WriteProfile(w io.Writer) error {
+	enc := &encoder{strings: map[string]int64{"": 0}, table: []string{""}}
+	functions := map[frame]uint64{}
+	locations := map[frame]uint64{}
+
+	var body, functionsOut, locationsOut protoBuffer
+
+	for _, t := range [][2]string{{"samples", "count"}, {"cpu", "nanoseconds"}} {
+		var vt protoBuffer
+		vt.varintField(valueTypeType, uint64(enc.str(t[0])))
+		vt.varintField(valueTypeUnit, uint64(enc.str(t[1])))
+		body.bytesField(profileSampleType, vt.bytes)
+	}
+
+	for _, key := range p.order {
+		s := p.samples[key]
+		ids := make([]uint64, len(s.stack))
+		for i, f := range s.stack {
+			file := f.file
+			if file == "" {
+				file = SCRIPT_FILE
+			}
+
+			// Functions are told apart by name and file, locations also by
+			// line.
+			fnKey := frame{function: f.function, file: file}
+			fnID, ok := functions[fnKey]
+			if !ok {
+				fnID = uint64(len(functions) + 1)
+				functions[fnKey] = fnID
+				var fn protoBuffer
+				fn.varintField(functionID, fnID)
+				fn.varintField(functionName, uint64(enc.str(f.function)))
+				fn.varintField(functionSystemName, uint64(enc.str(f.function)))
+				fn.varintField(functionFilename, uint64(enc.str(file)))
+				functionsOut.bytesField(profileFunction, fn.bytes)
+			}
+
+			locKey := frame{f.function, file, f.line}
+			locID, ok := locations[locKey]
+			if !ok {
+				locID = uint64(len(locations) + 1)
+				locations[locKey] = locID
+				var line protoBuffer
+				line.varintField(lineFunctionID, fnID)
+				line.varintField(lineLine, uint64(max(f.line, 0)))
+				var loc protoBuffer
+				loc.varintField(locationID, locID)
+				loc.bytesField(locationLine, line.bytes)
+				locationsOut.bytesField(profileLocation, loc.bytes)
+			}
+			ids[i] = locID
+		}
+
+		var smp protoBuffer
+		smp.packedField(sampleLocationID, ids)
+		smp.packedField(sampleValue, []uint64{uint64(s.count), uint64(s.count * p.Interval.Nanoseconds())})
+		body.bytesField(profileSample, smp.bytes)
+	}
+
+	body.bytes = append(body.bytes, locationsOut.bytes...)
+	body.bytes = append(body.bytes, functionsOut.bytes...)
+
+	var period protoBuffer
+	period.varintField(valueTypeType, uint64(enc.str("cpu")))
+	period.varintField(valueTypeUnit, uint64(enc.str("nanoseconds")))
+
+	// The string table must come after every str call above.
+	var tail protoBuffer
+	for _, s := range enc.table {
+		tail.bytesField(profileStringTable, []byte(s))
+	}
+	tail.varintField(profileTimeNanos, uint64(p.started.UnixNano()))
+	tail.varintField(profileDurationNanos, uint64(p.elapsed.Nanoseconds()))
+	tail.bytesField(profilePeriodType, period.bytes)
+	tail.varintField(profilePeriod, uint64(p.Interval.Nanoseconds()))
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(body.bytes); err != nil {
+		return err
+	}
+	if _, err := gz.Write(tail.bytes); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// encoder interns the profile's strings.
+type encoder struct {
+	strings map[string]int64
+	table   []string
+}
+
+func (e *encoder) str(s string) int64 {
+	if i, ok := e.strings[s]; ok {
+		return i
+	}
+	i := int64(len(e.table))
+	e.strings[s] = i
+	e.table = append(e.table, s)
+	return i
+}
+
+// protoBuffer builds a protocol buffer message one field at a time.
+type protoBuffer struct {
+	bytes []byte
+}
+
+func (b *protoBuffer) varint(v uint64) {
+	for v >= 0x80 {
+		b.bytes = append(b.bytes, byte(v)|0x80)
+		v >>= 7
+	}
+	b.bytes = append(b.bytes, byte(v))
+}
+
+func (b *protoBuffer) key(field, wire int) {
+	b.varint(uint64(field)<<3 | uint64(wire))
+}
+
+func (b *protoBuffer) varintField(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	b.key(field, wireVarint)
+	b.varint(v)
+}
+
+func (b *protoBuffer) bytesField(field int, data []byte) {
+	b.key(field, wireBytes)
+	b.varint(uint64(len(data)))
+	b.bytes = append(b.bytes, data...)
+}
+
+func (b *protoBuffer) packedField(field int, values []uint64) {
+	var packed protoBuffer
+	for _, v := range values {
+		packed.varint(v)
+	}
+	b.bytesField(field, packed.bytes)
+}
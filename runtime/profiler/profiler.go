@@ -0,0 +1,161 @@
+// Package profiler measures where a Hydor program spends its time. A
+// Profiler attached as a VM's hook counts every instruction it runs and,
+// on a timer, samples the call stack. The counts give exact per-line
+// execution counts and the samples a CPU profile in pprof's format.
+package profiler
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/caelondev/hydor/frontend/debug"
+	"github.com/caelondev/hydor/runtime/vm"
+)
+
+// DEFAULT_INTERVAL is the time between samples. Hydor programs are short,
+// so it is finer than the 10ms Go's own profiler uses.
+const DEFAULT_INTERVAL = 100 * time.Microsecond
+
+// MAX_CLOCK_STRIDE bounds how many instructions run between looks at the
+// clock. The stride is random so samples cannot fall into step with a
+// repeating sequence of instructions.
+const MAX_CLOCK_STRIDE = 64
+
+// Profiler is a vm.Hook. Start it just before the run and Stop it once
+// the run returns; a Profiler records a single run.
+type Profiler struct {
+	// Interval is the time between samples. Zero means DEFAULT_INTERVAL.
+	Interval time.Duration
+
+	// counts holds how often each instruction ran.
+	counts *vm.Coverage
+
+	samples map[string]*sample
+	order   []string
+
+	// The clock is read when countdown reaches zero, and a sample taken
+	// once it passes next.
+	countdown int
+	next      time.Time
+	started   time.Time
+	elapsed   time.Duration
+	running   bool
+}
+
+// frame is one entry of a sampled call stack.
+type frame struct {
+	function string
+	file     string
+	line     int
+}
+
+// sample is a distinct call stack and how often it was seen.
+type sample struct {
+	stack []frame
+	count int64
+}
+
+func New() *Profiler {
+	return &Profiler{
+		counts:  vm.NewCoverage(),
+		samples: map[string]*sample{},
+	}
+}
+
+// Start begins sampling.
+func (p *Profiler) Start() {
+	if p.Interval <= 0 {
+		p.Interval = DEFAULT_INTERVAL
+	}
+	p.started = time.Now()
+	p.next = p.started.Add(p.Interval)
+	p.countdown = 1 + rand.IntN(MAX_CLOCK_STRIDE)
+	p.running = true
+}
+
+// Stop ends sampling. The results are complete once it returns.
+func (p *Profiler) Stop() {
+	if !p.running {
+		return
+	}
+	p.running = false
+	p.elapsed = time.Since(p.started)
+}
+
+// Before counts the instruction about to run and takes a sample when one
+// is due.
+func (p *Profiler) Before(machine *vm.VM) bool {
+	p.counts.Record(machine.Bytecode, machine.Ip)
+
+	if !p.running {
+		return true
+	}
+	p.countdown--
+	if p.countdown > 0 {
+		return true
+	}
+	p.countdown = 1 + rand.IntN(MAX_CLOCK_STRIDE)
+
+	if now := time.Now(); !now.Before(p.next) {
+		p.sample(machine)
+		p.next = now.Add(p.Interval)
+	}
+	return true
+}
+
+// sample records the current call stack, innermost frame first.
+func (p *Profiler) sample(machine *vm.VM) {
+	stack := make([]frame, 0, len(machine.Frames))
+	for i := len(machine.Frames) - 1; i >= 0; i-- {
+		f := &machine.Frames[i]
+		chunk, ip := f.Bytecode, f.Ip
+		if i == len(machine.Frames)-1 {
+			chunk, ip = machine.Bytecode, machine.Ip
+		} else if ip > 0 {
+			// An outer frame's Ip is where it resumes; the instruction
+			// before it is the one still running.
+			ip--
+		}
+		stack = append(stack, frame{f.Name, chunk.File, debug.GetLine(chunk, ip)})
+	}
+
+	key := stackKey(stack)
+	s, ok := p.samples[key]
+	if !ok {
+		s = &sample{stack: stack}
+		p.samples[key] = s
+		p.order = append(p.order, key)
+	}
+	s.count++
+}
+
+// stackKey identifies a call stack so repeated samples of it are merged.
+func stackKey(stack []frame) string {
+	var key strings.Builder
+	for _, f := range stack {
+		fmt.Fprintf(&key, "%s\x00%s\x00%d\x00", f.function, f.file, f.line)
+	}
+	return key.String()
+}
+
+// Instructions returns how many instructions the profiled run executed.
+func (p *Profiler) Instructions() int64 {
+	total := int64(0)
+	for _, chunk := range p.counts.Chunks() {
+		for _, n := range p.counts.Counts(chunk) {
+			total += n
+		}
+	}
+	return total
+}
+
+// Samples returns how many stack samples were taken.
+func (p *Profiler) Samples() int64 {
+	total := int64(0)
+	for _, s := range p.samples {
+		total += s.count
+	}
+	return total
+}
@@ -0,0 +1,219 @@
+package profiler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caelondev/hydor/frontend/compiler"
+	"github.com/caelondev/hydor/frontend/optimizer"
+	"github.com/caelondev/hydor/result"
+	"github.com/caelondev/hydor/runtime/vm"
+)
+
+const source = `1 +
+  try {
+    2 * "x"
+  } catch (e) {
+    3
+  }`
+
+// profile runs source at -O0 under a profiler that samples at every look
+// at the clock.
+func profile(t *testing.T, source string) *Profiler {
+	t.Helper()
+	var errors strings.Builder
+	chunk, ok := compiler.Compile(source, compiler.Options{File: "main.hd", Optimize: optimizer.O0, Errors: &errors})
+	if !ok {
+		t.Fatal(errors.String())
+	}
+
+	p := New()
+	p.Interval = time.Nanosecond
+	machine := vm.NewVM()
+	machine.Stdout = io.Discard
+	machine.Hook = p
+	p.Start()
+	if res := machine.Interpret(chunk); res != result.INTERPRET_OK {
+		t.Fatalf("result %d", res)
+	}
+	p.Stop()
+
+	if p.Instructions() != machine.Executed() {
+		t.Errorf("counted %d instructions, the VM executed %d", p.Instructions(), machine.Executed())
+	}
+	return p
+}
+
+func TestLineCounts(t *testing.T) {
+	p := profile(t, source)
+	got := map[int]int64{}
+	for _, l := range p.LineCounts() {
+		if l.File != "main.hd" {
+			t.Errorf("line %d is in %q", l.Line, l.File)
+		}
+		got[l.Line] = l.Count
+	}
+	// Line 3 pushes both operands and multiplies, which throws and skips
+	// the jump on line 4. The handler pushes 3 on line 5 and drops the
+	// error and adds on line 6. The final return is not counted.
+	want := map[int]int64{1: 1, 3: 3, 4: 0, 5: 1, 6: 3}
+	for line, n := range want {
+		if got[line] != n {
+			t.Errorf("line %d ran %d instructions, want %d (all: %v)", line, got[line], n, got)
+		}
+	}
+
+	counts := p.LineCounts()
+	if !slices.IsSortedFunc(counts, func(a, b LineCount) int { return int(b.Count - a.Count) }) {
+		t.Errorf("line counts are not hottest first: %v", counts)
+	}
+}
+
+func TestWriteLineCounts(t *testing.T) {
+	p := profile(t, source)
+	var out strings.Builder
+	if err := p.WriteLineCounts(&out, source); err != nil {
+		t.Fatal(err)
+	}
+	report := out.String()
+	if !strings.HasPrefix(report, "9 instructions executed\n") {
+		t.Errorf("report lacks the total:\n%s", report)
+	}
+	if !strings.Contains(report, `      3 | 2 * "x"`) {
+		t.Errorf("report does not show line 3's source:\n%s", report)
+	}
+
+	out.Reset()
+	p.WriteLineCounts(&out, "")
+	if !strings.Contains(out.String(), "      3 | \n") {
+		t.Errorf("report without source:\n%s", out.String())
+	}
+
+	// A long line is cut short, and the return at the end of a file that
+	// ends in a newline is not put on the blank line after it.
+	long := `"` + strings.Repeat("x", 2*MAX_SOURCE_WIDTH) + `"` + "\n"
+	p = profile(t, long)
+	out.Reset()
+	p.WriteLineCounts(&out, long)
+	if want := "      1 | " + long[:MAX_SOURCE_WIDTH-3] + "...\n"; !strings.HasSuffix(out.String(), want) {
+		t.Errorf("report does not cut the line short:\n%s", out.String())
+	}
+	if strings.Contains(out.String(), "      2 |") {
+		t.Errorf("report counts the blank last line:\n%s", out.String())
+	}
+}
+
+func TestWriteProfile(t *testing.T) {
+	// The clock is read at most MAX_CLOCK_STRIDE instructions apart, so
+	// the program must be longer than that to be sure of a sample.
+	p := profile(t, strings.Repeat("1 +\n", 4*MAX_CLOCK_STRIDE)+"1")
+	if p.Samples() == 0 {
+		t.Fatal("no samples taken")
+	}
+
+	var out bytes.Buffer
+	if err := p.WriteProfile(&out); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := decodeFields(t, data)
+	strs := []string{}
+	for _, f := range fields[profileStringTable] {
+		strs = append(strs, string(f.bytes))
+	}
+	if len(strs) == 0 || strs[0] != "" {
+		t.Fatalf("string table %q must start with the empty string", strs)
+	}
+	for _, want := range []string{"samples", "count", "cpu", "nanoseconds", vm.SCRIPT_NAME, "main.hd"} {
+		if !slices.Contains(strs, want) {
+			t.Errorf("string table %q lacks %q", strs, want)
+		}
+	}
+
+	total := uint64(0)
+	for _, s := range fields[profileSample] {
+		values := decodePacked(t, decodeFields(t, s.bytes)[sampleValue][0].bytes)
+		if len(values) != 2 || values[1] != values[0]*uint64(p.Interval) {
+			t.Errorf("sample values %v, want a count and its CPU time", values)
+		}
+		total += values[0]
+	}
+	if total != uint64(p.Samples()) {
+		t.Errorf("profile holds %d samples, the profiler took %d", total, p.Samples())
+	}
+	if len(fields[profileLocation]) == 0 || len(fields[profileFunction]) != 1 {
+		t.Errorf("%d locations and %d functions, want some locations in one function",
+			len(fields[profileLocation]), len(fields[profileFunction]))
+	}
+	if period := fields[profilePeriod]; len(period) != 1 || period[0].varint != uint64(p.Interval) {
+		t.Errorf("period %v, want %d", period, p.Interval)
+	}
+}
+
+// field is a decoded protocol buffer field, holding a varint or bytes.
+type field struct {
+	varint uint64
+	bytes  []byte
+}
+
+func decodeFields(t *testing.T, data []byte) map[int][]field {
+	t.Helper()
+	fields := map[int][]field{}
+	for len(data) > 0 {
+		key, n := readVarint(t, data)
+		data = data[n:]
+		switch key & 7 {
+		case wireVarint:
+			v, n := readVarint(t, data)
+			data = data[n:]
+			fields[int(key>>3)] = append(fields[int(key>>3)], field{varint: v})
+		case wireBytes:
+			size, n := readVarint(t, data)
+			data = data[n:]
+			if uint64(len(data)) < size {
+				t.Fatalf("field %d runs past the end", key>>3)
+			}
+			fields[int(key>>3)] = append(fields[int(key>>3)], field{bytes: data[:size]})
+			data = data[size:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+	return fields
+}
+
+func decodePacked(t *testing.T, data []byte) []uint64 {
+	values := []uint64{}
+	for len(data) > 0 {
+		v, n := readVarint(t, data)
+		values = append(values, v)
+		data = data[n:]
+	}
+	return values
+}
+
+func readVarint(t *testing.T, data []byte) (uint64, int) {
+	t.Helper()
+	v := uint64(0)
+	for i := 0; i < len(data) && i < 10; i++ {
+		v |= uint64(data[i]&0x7f) << (7 * i)
+		if data[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	t.Fatal("malformed varint")
+	return 0, 0
+}
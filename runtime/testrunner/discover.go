@@ -0,0 +1,178 @@
+// Package testrunner runs tests written in Hydor.
+//
+// A test file, named *_test.hd, is a list of test blocks:
+//
+//	test "addition" { 1 + 2 == 3 }
+//
+// Each block holds a single expression and runs in a VM of its own. A test
+// fails when its expression evaluates to false or raises an error that
+// nothing catches, and passes otherwise. A failing `a == b` reports both
+// sides, so it doubles as an equality assertion.
+package testrunner
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/caelondev/hydor/frontend/lexer"
+	"github.com/caelondev/hydor/frontend/tokens"
+)
+
+// FILE_SUFFIX marks the files Discover collects from directories.
+const FILE_SUFFIX = "_test.hd"
+
+// TEST_KEYWORD starts a test block. It is not reserved by the language, so
+// it only has this meaning at the top level of a test file.
+const TEST_KEYWORD = "test"
+
+// Case is a single test block.
+type Case struct {
+	Name string
+	File string
+	// Line is where the test block starts.
+	Line int
+
+	// source is the whole file with everything but the block's body
+	// blanked out, so compiling it reports the file's own lines.
+	source string
+	// body spans the block's expression in source.
+	body [2]int
+}
+
+// SyntaxError is a test file that is not a list of test blocks.
+type SyntaxError struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+}
+
+// Discover expands paths into the test files to run. Directories are
+// searched recursively for files ending in FILE_SUFFIX; files are taken
+// as given. The result is sorted and free of duplicates.
+func Discover(paths []string) ([]string, error) {
+	seen := map[string]bool{}
+	files := []string{}
+	add := func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			files = append(files, path)
+		}
+	}
+
+	for _, root := range paths {
+		info, err := os.Stat(root)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			add(root)
+			continue
+		}
+
+		err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !entry.IsDir() && strings.HasSuffix(path, FILE_SUFFIX) {
+				add(path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+// Parse splits a test file into its test blocks. Blocks are found by
+// matching braces, so a body that does not compile still becomes a Case,
+// which then fails when run.
+func Parse(file, source string) ([]*Case, error) {
+	tokenizer := lexer.NewTokenizer(source)
+	cases := []*Case{}
+	names := map[string]int{}
+
+	for {
+		t := tokenizer.ScanToken()
+		if t.Type == tokens.TOKEN_EOF {
+			return cases, nil
+		}
+		if t.Type == tokens.TOKEN_ERROR {
+			return nil, &SyntaxError{file, t.Line, t.Lexeme}
+		}
+		if t.Type != tokens.TOKEN_IDENTIFIER || t.Lexeme != TEST_KEYWORD {
+			return nil, &SyntaxError{file, t.Line, fmt.Sprintf("Expected '%s' at '%s'", TEST_KEYWORD, t.Lexeme)}
+		}
+
+		name := tokenizer.ScanToken()
+		if name.Type != tokens.TOKEN_STRING {
+			return nil, &SyntaxError{file, name.Line, "Expected the test's name as a string"}
+		}
+		if line, ok := names[name.Lexeme]; ok {
+			return nil, &SyntaxError{file, name.Line, fmt.Sprintf("Test \"%s\" is already declared on line %d", name.Lexeme, line)}
+		}
+		names[name.Lexeme] = t.Line
+
+		open := tokenizer.ScanToken()
+		if open.Type != tokens.TOKEN_LEFT_BRACE {
+			return nil, &SyntaxError{file, open.Line, "Expected '{' before the test's body"}
+		}
+
+		end, err := matchBrace(tokenizer, file, t.Line)
+		if err != nil {
+			return nil, err
+		}
+
+		body := [2]int{open.Start + 1, end}
+		cases = append(cases, &Case{
+			Name:   name.Lexeme,
+			File:   file,
+			Line:   t.Line,
+			source: blank(source, body[0], body[1]),
+			body:   body,
+		})
+	}
+}
+
+// matchBrace scans to the brace closing one that has just been read and
+// returns where it starts.
+func matchBrace(tokenizer *lexer.Tokenizer, file string, line int) (int, error) {
+	depth := 1
+	for {
+		t := tokenizer.ScanToken()
+		switch t.Type {
+		case tokens.TOKEN_LEFT_BRACE:
+			depth++
+		case tokens.TOKEN_RIGHT_BRACE:
+			depth--
+			if depth == 0 {
+				return t.Start, nil
+			}
+		case tokens.TOKEN_EOF:
+			return 0, &SyntaxError{file, line, "Test body is missing its closing '}'"}
+		}
+	}
+}
+
+// blank replaces everything in source outside [start, end) with spaces,
+// keeping line breaks so line numbers stay the same.
+func blank(source string, start, end int) string {
+	out := []byte(source)
+	for i := range out {
+		if (i < start || i >= end) && out[i] != '\n' {
+			out[i] = ' '
+		}
+	}
+	return string(out)
+}
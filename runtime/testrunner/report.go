@@ -0,0 +1,170 @@
+package testrunner
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/caelondev/hydor/color"
+)
+
+type Format int
+
+const (
+	FORMAT_TEXT Format = iota
+	FORMAT_TAP
+	FORMAT_JUNIT
+)
+
+// ParseFormat maps a format's command-line name to the Format.
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "text":
+		return FORMAT_TEXT, nil
+	case "tap":
+		return FORMAT_TAP, nil
+	case "junit":
+		return FORMAT_JUNIT, nil
+	default:
+		return 0, fmt.Errorf("Unknown test output format '%s'", name)
+	}
+}
+
+// Broken is the result standing in for a test file that could not be
+// split into tests, so reports still show it as a failure.
+func Broken(file string, err error) *Result {
+	line := 0
+	message := err.Error()
+	if se, ok := err.(*SyntaxError); ok {
+		line = se.Line
+		message = se.Message
+	}
+	return &Result{
+		Case:    &Case{Name: file, File: file, Line: line},
+		Failure: message,
+		Line:    line,
+	}
+}
+
+// Write reports results in the given format.
+func Write(w io.Writer, format Format, results []*Result) error {
+	switch format {
+	case FORMAT_TAP:
+		return writeTAP(w, results)
+	case FORMAT_JUNIT:
+		return writeJUnit(w, results)
+	default:
+		return writeText(w, results)
+	}
+}
+
+func writeText(w io.Writer, results []*Result) error {
+	failed := 0
+	for _, r := range results {
+		if r.Passed {
+			fmt.Fprintf(w, "ok    %s: %s (%s)\n", r.Case.File, r.Case.Name, r.Duration.Round(time.Microsecond))
+			continue
+		}
+		failed++
+		fmt.Fprintf(w, "%s  %s: %s\n", color.Red("FAIL"), r.Case.File, r.Case.Name)
+		fmt.Fprintf(w, "    %s:%d: %s\n", r.Case.File, r.Line, r.Failure)
+	}
+
+	_, err := fmt.Fprintf(w, "\n%d passed, %d failed\n", len(results)-failed, failed)
+	return err
+}
+
+func writeTAP(w io.Writer, results []*Result) error {
+	fmt.Fprintln(w, "TAP version 13")
+	fmt.Fprintf(w, "1..%d\n", len(results))
+	for i, r := range results {
+		status := "ok"
+		if !r.Passed {
+			status = "not ok"
+		}
+		fmt.Fprintf(w, "%s %d - %s: %s\n", status, i+1, r.Case.File, r.Case.Name)
+		if !r.Passed {
+			fmt.Fprintln(w, "  ---")
+			fmt.Fprintf(w, "  message: %s\n", strconv.Quote(r.Failure))
+			fmt.Fprintf(w, "  at: %s\n", strconv.Quote(fmt.Sprintf("%s:%d", r.Case.File, r.Line)))
+			fmt.Fprintln(w, "  ...")
+		}
+	}
+	return nil
+}
+
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnit groups results into one suite per file, in the order the
+// files first appear.
+func writeJUnit(w io.Writer, results []*Result) error {
+	report := junitSuites{}
+	suites := map[string]int{}
+	durations := []time.Duration{}
+
+	for _, r := range results {
+		i, ok := suites[r.Case.File]
+		if !ok {
+			i = len(report.Suites)
+			suites[r.Case.File] = i
+			report.Suites = append(report.Suites, junitSuite{Name: r.Case.File})
+			durations = append(durations, 0)
+		}
+
+		suite := &report.Suites[i]
+		c := junitCase{Name: r.Case.Name, ClassName: r.Case.File, Time: seconds(r.Duration)}
+		if !r.Passed {
+			suite.Failures++
+			c.Failure = &junitFailure{
+				Message: r.Failure,
+				Text:    fmt.Sprintf("%s:%d: %s", r.Case.File, r.Line, r.Failure),
+			}
+		}
+		suite.Tests++
+		suite.Cases = append(suite.Cases, c)
+		durations[i] += r.Duration
+	}
+	for i := range report.Suites {
+		report.Suites[i].Time = seconds(durations[i])
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
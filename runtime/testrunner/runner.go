@@ -0,0 +1,216 @@
+package testrunner
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caelondev/hydor/frontend/ast"
+	"github.com/caelondev/hydor/frontend/bytecode"
+	"github.com/caelondev/hydor/frontend/compiler"
+	"github.com/caelondev/hydor/frontend/lexer"
+	"github.com/caelondev/hydor/frontend/optimizer"
+	"github.com/caelondev/hydor/frontend/parser"
+	"github.com/caelondev/hydor/frontend/tokens"
+	"github.com/caelondev/hydor/result"
+	"github.com/caelondev/hydor/runtime/value"
+	"github.com/caelondev/hydor/runtime/vm"
+)
+
+// Result is the outcome of running one Case.
+type Result struct {
+	Case   *Case
+	Passed bool
+	// Failure says why the test failed and Line where.
+	Failure  string
+	Line     int
+	Duration time.Duration
+}
+
+// Runner runs test cases, each in a fresh VM.
+type Runner struct {
+	Optimize optimizer.Level
+	// NewVM creates the VM for each test, letting the caller apply limits
+	// or a sandbox. Nil means vm.NewVM.
+	NewVM func() *vm.VM
+}
+
+// failure is why evaluating a test's source went wrong.
+type failure struct {
+	line    int
+	message string
+}
+
+func (r *Runner) Run(c *Case) *Result {
+	started := time.Now()
+	res := &Result{Case: c}
+
+	if f := r.check(c); f != nil {
+		res.Failure = f.message
+		res.Line = f.line
+	} else {
+		res.Passed = true
+	}
+
+	res.Duration = time.Since(started)
+	return res
+}
+
+// check runs c and returns why it failed, or nil if it passed.
+func (r *Runner) check(c *Case) *failure {
+	machine := r.newVM()
+	compared := &operands{next: machine.Hook}
+	machine.Hook = compared
+
+	v, f := r.eval(c, c.source, machine)
+	if f != nil {
+		return f
+	}
+	if !v.IsFalsy() {
+		return nil
+	}
+
+	// The body compiled, so it parses.
+	program, _ := parser.NewParser().Parse(lexer.NewTokenizer(c.source))
+	expr := program.Expr
+	for {
+		group, ok := expr.(*ast.Grouping)
+		if !ok {
+			break
+		}
+		expr = group.Expr
+	}
+
+	if b, ok := expr.(*ast.Binary); ok {
+		if f := r.compare(c, b, compared); f != nil {
+			return f
+		}
+	}
+	return &failure{expr.Pos().Line, "Expected true, got " + describe(v)}
+}
+
+// compare explains a failed `a == b` or `a != b` with the values the test
+// compared. It returns nil for other operators.
+func (r *Runner) compare(c *Case, b *ast.Binary, compared *operands) *failure {
+	op := b.Operator
+	if op.Type != tokens.TOKEN_EQUAL_EQUAL && op.Type != tokens.TOKEN_BANG_EQUAL {
+		return nil
+	}
+
+	actual, expected := compared.left, compared.right
+	if !compared.seen {
+		// The comparison never ran because it was folded into a constant,
+		// so both sides are literals. Evaluating them on a bare VM repeats
+		// nothing the test did and leaves coverage alone.
+		var f *failure
+		actual, f = r.eval(c, blank(c.source, c.body[0], op.Start), vm.NewVM())
+		if f != nil {
+			return nil
+		}
+		expected, f = r.eval(c, blank(c.source, op.Start+len(op.Lexeme), c.body[1]), vm.NewVM())
+		if f != nil {
+			return nil
+		}
+	}
+
+	if op.Type == tokens.TOKEN_EQUAL_EQUAL {
+		return &failure{op.Line, fmt.Sprintf("Expected %s, got %s", describe(expected), describe(actual))}
+	}
+	return &failure{op.Line, fmt.Sprintf("Expected a value other than %s", describe(expected))}
+}
+
+// operands is a hook that keeps the values of the most recent equality
+// test. A test's own comparison is the last instruction before its result
+// is returned, so when the run ends these are the values it compared.
+type operands struct {
+	left, right value.Value
+	// seen is whether nothing but a negation has run since the equality
+	// test whose values are kept.
+	seen bool
+	// next is a hook the VM already had, which still runs.
+	next vm.Hook
+}
+
+func (o *operands) Before(machine *vm.VM) bool {
+	switch bytecode.OpCode(machine.Bytecode.Code[machine.Ip]) {
+	case bytecode.OP_EQUAL, bytecode.OP_NOT_EQUAL:
+		o.left, o.right = machine.Stack[machine.StackTop-2], machine.Stack[machine.StackTop-1]
+		o.seen = true
+	case bytecode.OP_NOT, bytecode.OP_RETURN:
+	default:
+		o.seen = false
+	}
+	return o.next == nil || o.next.Before(machine)
+}
+
+func (r *Runner) newVM() *vm.VM {
+	if r.NewVM == nil {
+		return vm.NewVM()
+	}
+	return r.NewVM()
+}
+
+// eval compiles source, which is c's file blanked down to the part to
+// evaluate, and runs it on machine.
+func (r *Runner) eval(c *Case, source string, machine *vm.VM) (value.Value, *failure) {
+	var compileErr *ast.Error
+	var errors strings.Builder
+	chunk, ok := compiler.Compile(source, compiler.Options{
+		File:     c.File,
+		Optimize: r.Optimize,
+		Errors:   &errors,
+		OnError:  func(err *ast.Error) { compileErr = err },
+	})
+	if !ok {
+		if compileErr == nil {
+			return value.NilVal(), &failure{c.Line, strings.TrimSpace(errors.String())}
+		}
+		return value.NilVal(), compileFailure(c, compileErr)
+	}
+
+	machine.Stdout = io.Discard
+	machine.Stderr = io.Discard
+
+	if machine.Interpret(chunk) == result.INTERPRET_OK {
+		return machine.Result(), nil
+	}
+
+	err := machine.Err()
+	if err == nil {
+		return value.NilVal(), &failure{c.Line, "Run failed"}
+	}
+	line := c.Line
+	if len(err.Trace) > 0 {
+		line = err.Trace[0].Line
+	}
+	if err.Aborted {
+		return value.NilVal(), &failure{line, "Aborted: " + err.Message}
+	}
+	return value.NilVal(), &failure{line, fmt.Sprintf("Uncaught %s: %s", err.Kind, err.Message)}
+}
+
+func compileFailure(c *Case, err *ast.Error) *failure {
+	switch err.At.Type {
+	case tokens.TOKEN_EOF:
+		// Everything after the body is blanked out, so the end of the
+		// source stands for the body's closing brace.
+		return &failure{c.Line, "Compile error at end of body: " + err.Message}
+	case tokens.TOKEN_ERROR:
+		return &failure{err.At.Line, "Compile error: " + err.Message}
+	default:
+		return &failure{err.At.Line, fmt.Sprintf("Compile error at '%s': %s", err.At.Lexeme, err.Message)}
+	}
+}
+
+// describe formats v for a failure message, quoting strings so they stand
+// apart from numbers.
+func describe(v value.Value) string {
+	if v.IsString() {
+		return strconv.Quote(v.AsCString())
+	}
+	var b strings.Builder
+	value.FprintValue(&b, v)
+	return b.String()
+}
@@ -0,0 +1,281 @@
+package testrunner
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caelondev/hydor/frontend/optimizer"
+	"github.com/caelondev/hydor/runtime/vm"
+)
+
+const file = `test "passes" { 1 + 2 == 3 }
+
+test "false" {
+  1 < 0
+}
+
+test "equality" {
+  "a" +
+    "b" == "abc"
+}
+
+test "inequality" { 2 != 2 }
+
+test "throws" {
+  try { 1 } catch (e) { e } +
+    (1 / 0)
+}
+
+test "caught" { try { throw "x" } catch (e) { e.message == "x" } }
+
+test "braces" { try { 1 } finally { 2 } == 1 }
+
+test "does not compile" {
+  1 +
+}
+
+test "undefined" {
+  nope
+}
+`
+
+func TestParse(t *testing.T) {
+	cases, err := Parse("math_test.hd", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	lines := []int{}
+	for _, c := range cases {
+		names = append(names, c.Name)
+		lines = append(lines, c.Line)
+	}
+	wantNames := []string{"passes", "false", "equality", "inequality", "throws", "caught", "braces", "does not compile", "undefined"}
+	if !slices.Equal(names, wantNames) {
+		t.Errorf("names = %q, want %q", names, wantNames)
+	}
+	if wantLines := []int{1, 3, 7, 12, 14, 19, 21, 23, 27}; !slices.Equal(lines, wantLines) {
+		t.Errorf("lines = %v, want %v", lines, wantLines)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := map[string]string{
+		`check "x" { 1 }`:                    "math_test.hd:1: Expected 'test' at 'check'",
+		`test x { 1 }`:                       "math_test.hd:1: Expected the test's name as a string",
+		`test "x" 1`:                         "math_test.hd:1: Expected '{' before the test's body",
+		"test \"x\" {\n 1 ":                  "math_test.hd:1: Test body is missing its closing '}'",
+		"test \"x\" { 1 }\ntest \"x\" { 2 }": "math_test.hd:2: Test \"x\" is already declared on line 1",
+		"test \"x\" { 1 }\n$":                "math_test.hd:2: Unknown character found '$'",
+	}
+	for source, want := range tests {
+		_, err := Parse("math_test.hd", source)
+		if err == nil || err.Error() != want {
+			t.Errorf("%q: error %v, want %s", source, err, want)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	cases, err := Parse("math_test.hd", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]struct {
+		line    int
+		failure string
+	}{
+		"passes":           {},
+		"false":            {4, "Expected true, got false"},
+		"equality":         {9, `Expected "abc", got "ab"`},
+		"inequality":       {12, "Expected a value other than 2"},
+		"throws":           {16, "Uncaught ZeroDivisionError: Cannot divide 1 by zero. Division by zero is undefined."},
+		"caught":           {},
+		"braces":           {},
+		"does not compile": {23, "Compile error at end of body: Expected expression"},
+		"undefined":        {28, "Compile error at 'nope': Undefined variable 'nope'"},
+	}
+
+	// At -O1 the failing comparisons are folded into constants, which
+	// must not lose the values in the failure message.
+	for _, level := range []optimizer.Level{optimizer.O0, optimizer.O1} {
+		runner := &Runner{Optimize: level}
+		for _, c := range cases {
+			res := runner.Run(c)
+			w := want[c.Name]
+			if res.Passed != (w.failure == "") || res.Failure != w.failure || res.Line != w.line {
+				t.Errorf("-O%d %s: passed %t at line %d with %q, want line %d with %q", level, c.Name, res.Passed, res.Line, res.Failure, w.line, w.failure)
+			}
+		}
+	}
+}
+
+func TestFalsy(t *testing.T) {
+	cases, err := Parse("falsy_test.hd", "test \"nil\" { nil }\ntest \"zero\" { 0 }")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner := &Runner{}
+	if res := runner.Run(cases[0]); res.Passed || res.Failure != "Expected true, got nil" || res.Line != 1 {
+		t.Errorf("nil: %+v, want a failure", res)
+	}
+	if res := runner.Run(cases[1]); !res.Passed {
+		t.Errorf("zero: %+v, want a pass", res)
+	}
+}
+
+// TestCompareRunsOnce checks that explaining a failed comparison reuses
+// the values the test compared rather than running either side again.
+func TestCompareRunsOnce(t *testing.T) {
+	cases, err := Parse("once_test.hd", `test "once" { try { throw "x" } catch (e) { e.message } == "y" }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cov := vm.NewCoverage()
+	runner := &Runner{NewVM: func() *vm.VM {
+		machine := vm.NewVM()
+		machine.Coverage = cov
+		return machine
+	}}
+	if res := runner.Run(cases[0]); res.Failure != `Expected "y", got "x"` {
+		t.Errorf("failure %q", res.Failure)
+	}
+	if chunks := cov.Chunks(); len(chunks) != 1 {
+		t.Errorf("%d chunks ran, want only the test's own", len(chunks))
+	}
+}
+
+func TestRunnerVM(t *testing.T) {
+	cases, err := Parse("slow_test.hd", `test "slow" { 1 + 2 + 3 == 6 }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner := &Runner{NewVM: func() *vm.VM {
+		machine := vm.NewVM()
+		machine.MaxInstructions = 2
+		return machine
+	}}
+	res := runner.Run(cases[0])
+	if res.Passed || !strings.HasPrefix(res.Failure, "Aborted: ") {
+		t.Errorf("result %+v, want the budget to abort the test", res)
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"b_test.hd", "a_test.hd", "main.hd", "sub/c_test.hd", "sub/notes.txt"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	explicit := filepath.Join(dir, "main.hd")
+	files, err := Discover([]string{dir, explicit, filepath.Join(dir, "sub")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		filepath.Join(dir, "a_test.hd"),
+		filepath.Join(dir, "b_test.hd"),
+		explicit,
+		filepath.Join(dir, "sub", "c_test.hd"),
+	}
+	if !slices.Equal(files, want) {
+		t.Errorf("Discover = %q, want %q", files, want)
+	}
+
+	if _, err := Discover([]string{filepath.Join(dir, "missing")}); err == nil {
+		t.Error("Discover accepted a missing path")
+	}
+}
+
+func results() []*Result {
+	pass := &Case{Name: "passes", File: "a_test.hd", Line: 1}
+	fail := &Case{Name: "fails", File: "a_test.hd", Line: 3}
+	return []*Result{
+		{Case: pass, Passed: true, Duration: 1500 * time.Microsecond},
+		{Case: fail, Failure: "Expected true, got false", Line: 4},
+		Broken("b_test.hd", &SyntaxError{"b_test.hd", 2, "Expected '{' before the test's body"}),
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	var out strings.Builder
+	if err := Write(&out, FORMAT_TEXT, results()); err != nil {
+		t.Fatal(err)
+	}
+	got := out.String()
+	for _, want := range []string{
+		"ok    a_test.hd: passes (1.5ms)\n",
+		"a_test.hd: fails\n    a_test.hd:4: Expected true, got false\n",
+		"b_test.hd: b_test.hd\n    b_test.hd:2: Expected '{' before the test's body\n",
+		"\n1 passed, 2 failed\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("text report lacks %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestWriteTAP(t *testing.T) {
+	var out strings.Builder
+	if err := Write(&out, FORMAT_TAP, results()); err != nil {
+		t.Fatal(err)
+	}
+	want := `TAP version 13
+1..3
+ok 1 - a_test.hd: passes
+not ok 2 - a_test.hd: fails
+  ---
+  message: "Expected true, got false"
+  at: "a_test.hd:4"
+  ...
+not ok 3 - b_test.hd: b_test.hd
+  ---
+  message: "Expected '{' before the test's body"
+  at: "b_test.hd:2"
+  ...
+`
+	if out.String() != want {
+		t.Errorf("TAP report:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	var out strings.Builder
+	if err := Write(&out, FORMAT_JUNIT, results()); err != nil {
+		t.Fatal(err)
+	}
+
+	var report junitSuites
+	if err := xml.Unmarshal([]byte(out.String()), &report); err != nil {
+		t.Fatalf("JUnit report is not XML: %v\n%s", err, out.String())
+	}
+	if len(report.Suites) != 2 {
+		t.Fatalf("%d suites, want one per file", len(report.Suites))
+	}
+	if s := report.Suites[0]; s.Name != "a_test.hd" || len(s.Cases) != 2 || s.Failures != 1 {
+		t.Errorf("first suite = %+v", s)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for name, want := range map[string]Format{"text": FORMAT_TEXT, "tap": FORMAT_TAP, "junit": FORMAT_JUNIT} {
+		if got, err := ParseFormat(name); err != nil || got != want {
+			t.Errorf("ParseFormat(%q) = %v, %v", name, got, err)
+		}
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Error("ParseFormat accepted an unknown format")
+	}
+}
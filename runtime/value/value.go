@@ -2,6 +2,9 @@ package value
 
 import (
 	"fmt"
+	"io"
+	"math"
+	"os"
 	"unsafe"
 )
 
@@ -18,6 +21,7 @@ type ObjType int
 
 const (
 	OBJ_STRING ObjType = iota
+	OBJ_ERROR
 )
 
 type Obj struct {
@@ -31,13 +35,46 @@ type ObjString struct {
 	Length int
 }
 
+// ObjError is a runtime error as scripts see it, either raised by the VM or
+// thrown by the script. Kind names the class of error, such as "TypeError".
+type ObjError struct {
+	Object  Obj
+	Kind    string
+	Message string
+	// Trace holds the frames active where the error was raised, innermost
+	// first.
+	Trace []TraceFrame
+}
+
+// TraceFrame is one entry of an error's traceback.
+type TraceFrame struct {
+	Function string
+	File     string
+	Line     int
+}
+
+// Value is a NaN-boxed 16-byte word. Numbers are stored as their IEEE 754
+// bits; nil and booleans are encoded as quiet NaNs carrying a tag that no
+// arithmetic result can produce. Objects keep their pointer in obj so the
+// garbage collector can still see it, with bits set to tagObj.
 type Value struct {
-	Type   ValueType
-	Number float64
-	Bool   bool
-	Obj    *Obj
+	bits uint64
+	obj  *Obj
 }
 
+const (
+	qnan = 0x7ffc000000000000
+
+	tagNil   = qnan | 1
+	tagFalse = qnan | 2
+	tagTrue  = qnan | 3
+	tagObj   = qnan | 4
+
+	// canonicalNaN is what every NaN number is stored as, so a NaN that
+	// arrives with an arbitrary payload can never alias a tag.
+	canonicalNaN = 0x7ff8000000000000
+)
+
 type ValueArray struct {
 	Values []Value
 }
@@ -49,40 +86,63 @@ func NewValueArray() *ValueArray {
 }
 
 func NumberVal(n float64) Value {
-	return Value{Type: VAL_NUMBER, Number: n}
+	if n != n {
+		return Value{bits: canonicalNaN}
+	}
+	return Value{bits: math.Float64bits(n)}
 }
 
 func BoolVal(b bool) Value {
-	return Value{Type: VAL_BOOL, Bool: b}
+	if b {
+		return Value{bits: tagTrue}
+	}
+	return Value{bits: tagFalse}
 }
 
 func NilVal() Value {
-	return Value{Type: VAL_NIL}
+	return Value{bits: tagNil}
 }
 
 func ObjVal(obj *Obj) Value {
-	return Value{Type: VAL_OBJ, Obj: obj}
+	return Value{bits: tagObj, obj: obj}
 }
 
-func (v Value) IsBool() bool   { return v.Type == VAL_BOOL }
-func (v Value) IsNil() bool    { return v.Type == VAL_NIL }
-func (v Value) IsNumber() bool { return v.Type == VAL_NUMBER }
-func (v Value) IsObj() bool    { return v.Type == VAL_OBJ }
-func (v Value) IsString() bool { return v.IsObj() && v.Obj.Type == OBJ_STRING }
+func (v Value) Type() ValueType {
+	switch {
+	case v.IsNumber():
+		return VAL_NUMBER
+	case v.bits == tagNil:
+		return VAL_NIL
+	case v.bits == tagObj:
+		return VAL_OBJ
+	default:
+		return VAL_BOOL
+	}
+}
+
+func (v Value) IsBool() bool   { return v.bits == tagTrue || v.bits == tagFalse }
+func (v Value) IsNil() bool    { return v.bits == tagNil }
+func (v Value) IsNumber() bool { return v.bits&qnan != qnan }
+func (v Value) IsObj() bool    { return v.bits == tagObj }
+func (v Value) IsString() bool { return v.IsObj() && v.obj.Type == OBJ_STRING }
+func (v Value) IsError() bool  { return v.IsObj() && v.obj.Type == OBJ_ERROR }
 
 func (v Value) IsFalsy() bool {
-	return v.IsNil() || (v.IsBool() && !v.AsBool())
+	return v.bits == tagNil || v.bits == tagFalse
 }
 
-func (v Value) AsBool() bool     { return v.Bool }
-func (v Value) AsNumber() float64 { return v.Number }
-func (v Value) AsObj() *Obj      { return v.Obj }
+func (v Value) AsBool() bool      { return v.bits == tagTrue }
+func (v Value) AsNumber() float64 { return math.Float64frombits(v.bits) }
+func (v Value) AsObj() *Obj       { return v.obj }
 func (v Value) AsString() *ObjString {
-	return (*ObjString)(unsafe.Pointer(v.Obj))
+	return (*ObjString)(unsafe.Pointer(v.obj))
 }
 func (v Value) AsCString() string {
 	return v.AsString().Chars
 }
+func (v Value) AsError() *ObjError {
+	return (*ObjError)(unsafe.Pointer(v.obj))
+}
 
 func NewString(chars string) *ObjString {
 	str := &ObjString{
@@ -97,46 +157,71 @@ func (s *ObjString) AsObj() *Obj {
 	return &s.Object
 }
 
+func NewError(kind, message string, trace []TraceFrame) *ObjError {
+	err := &ObjError{
+		Kind:    kind,
+		Message: message,
+		Trace:   trace,
+	}
+	err.Object.Type = OBJ_ERROR
+	return err
+}
+
+func (e *ObjError) AsObj() *Obj {
+	return &e.Object
+}
+
 func (va *ValueArray) Write(value Value) {
 	va.Values = append(va.Values, value)
 }
 
 func PrintValue(value Value) {
-	switch value.Type {
+	FprintValue(os.Stdout, value)
+}
+
+func FprintValue(w io.Writer, value Value) {
+	switch value.Type() {
 	case VAL_BOOL:
-		if value.Bool {
-			fmt.Print("true")
+		if value.AsBool() {
+			fmt.Fprint(w, "true")
 		} else {
-			fmt.Print("false")
+			fmt.Fprint(w, "false")
 		}
 	case VAL_NIL:
-		fmt.Print("nil")
+		fmt.Fprint(w, "nil")
 	case VAL_NUMBER:
-		fmt.Printf("%g", value.Number)
+		fmt.Fprintf(w, "%g", value.AsNumber())
 	case VAL_OBJ:
-		PrintObject(value)
+		FprintObject(w, value)
 	}
 }
 
 func PrintObject(value Value) {
+	FprintObject(os.Stdout, value)
+}
+
+func FprintObject(w io.Writer, value Value) {
 	switch value.AsObj().Type {
 	case OBJ_STRING:
-		fmt.Print(value.AsCString())
+		fmt.Fprint(w, value.AsCString())
+	case OBJ_ERROR:
+		err := value.AsError()
+		fmt.Fprintf(w, "%s: %s", err.Kind, err.Message)
 	}
 }
 
 func ValuesEqual(a, b Value) bool {
-	if a.Type != b.Type {
+	if a.Type() != b.Type() {
 		return false
 	}
 
-	switch a.Type {
+	switch a.Type() {
 	case VAL_BOOL:
-		return a.Bool == b.Bool
+		return a.AsBool() == b.AsBool()
 	case VAL_NIL:
 		return true
 	case VAL_NUMBER:
-		return a.Number == b.Number
+		return a.AsNumber() == b.AsNumber()
 	case VAL_OBJ:
 		return ObjectsEqual(a, b)
 	default:
@@ -152,13 +237,15 @@ func ObjectsEqual(a, b Value) bool {
 	switch a.AsObj().Type {
 	case OBJ_STRING:
 		return a.AsCString() == b.AsCString()
+	case OBJ_ERROR:
+		return a.AsObj() == b.AsObj()
 	default:
 		return false
 	}
 }
 
 func ValueTypeName(v Value) string {
-	switch v.Type {
+	switch v.Type() {
 	case VAL_BOOL:
 		return "boolean"
 	case VAL_NIL:
@@ -169,6 +256,8 @@ func ValueTypeName(v Value) string {
 		switch v.AsObj().Type {
 		case OBJ_STRING:
 			return "string"
+		case OBJ_ERROR:
+			return "error"
 		default:
 			return "object"
 		}
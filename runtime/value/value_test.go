@@ -0,0 +1,160 @@
+package value
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestNumbers(t *testing.T) {
+	for _, n := range []float64{0, math.Copysign(0, -1), 1, -2.5, math.MaxFloat64, math.SmallestNonzeroFloat64, math.Inf(1), math.Inf(-1)} {
+		v := NumberVal(n)
+		if !v.IsNumber() || v.Type() != VAL_NUMBER {
+			t.Errorf("NumberVal(%g) is not a number", n)
+		}
+		if got := v.AsNumber(); math.Float64bits(got) != math.Float64bits(n) {
+			t.Errorf("NumberVal(%g).AsNumber() = %g", n, got)
+		}
+	}
+}
+
+func TestNaNCannotAliasTags(t *testing.T) {
+	// NaNs with payloads matching each tag must still come back as
+	// numbers.
+	for _, tag := range []uint64{tagNil, tagFalse, tagTrue, tagObj, qnan, 0xffffffffffffffff} {
+		v := NumberVal(math.Float64frombits(tag))
+		if !v.IsNumber() || v.IsNil() || v.IsBool() || v.IsObj() {
+			t.Errorf("NaN with bits %#x is not a plain number", tag)
+		}
+		if !math.IsNaN(v.AsNumber()) {
+			t.Errorf("NaN with bits %#x came back as %g", tag, v.AsNumber())
+		}
+	}
+}
+
+func TestTypes(t *testing.T) {
+	str := ObjVal(NewString("s").AsObj())
+	err := ObjVal(NewError("TypeError", "bad", nil).AsObj())
+
+	tests := []struct {
+		v     Value
+		typ   ValueType
+		name  string
+		falsy bool
+	}{
+		{NilVal(), VAL_NIL, "nil", true},
+		{BoolVal(false), VAL_BOOL, "boolean", true},
+		{BoolVal(true), VAL_BOOL, "boolean", false},
+		{NumberVal(0), VAL_NUMBER, "number", false},
+		{str, VAL_OBJ, "string", false},
+		{err, VAL_OBJ, "error", false},
+	}
+	for _, tt := range tests {
+		if tt.v.Type() != tt.typ {
+			t.Errorf("%s: Type() = %d, want %d", tt.name, tt.v.Type(), tt.typ)
+		}
+		if got := ValueTypeName(tt.v); got != tt.name {
+			t.Errorf("ValueTypeName = %q, want %q", got, tt.name)
+		}
+		if tt.v.IsFalsy() != tt.falsy {
+			t.Errorf("%s: IsFalsy() = %t, want %t", tt.name, tt.v.IsFalsy(), tt.falsy)
+		}
+	}
+
+	if !str.IsString() || str.IsError() || str.AsCString() != "s" {
+		t.Error("string value misidentified")
+	}
+	if !err.IsError() || err.IsString() || err.AsError().Kind != "TypeError" {
+		t.Error("error value misidentified")
+	}
+}
+
+func TestValuesEqual(t *testing.T) {
+	err := ObjVal(NewError("Error", "x", nil).AsObj())
+	equal := [][2]Value{
+		{NilVal(), NilVal()},
+		{BoolVal(true), BoolVal(true)},
+		{NumberVal(1), NumberVal(1)},
+		{NumberVal(0), NumberVal(math.Copysign(0, -1))},
+		{ObjVal(NewString("a").AsObj()), ObjVal(NewString("a").AsObj())},
+		{err, err},
+	}
+	unequal := [][2]Value{
+		{NilVal(), BoolVal(false)},
+		{NumberVal(0), BoolVal(false)},
+		{NumberVal(math.NaN()), NumberVal(math.NaN())},
+		{ObjVal(NewString("a").AsObj()), ObjVal(NewString("b").AsObj())},
+		{ObjVal(NewString("x").AsObj()), ObjVal(NewError("Error", "x", nil).AsObj())},
+		{err, ObjVal(NewError("Error", "x", nil).AsObj())},
+	}
+
+	for _, pair := range equal {
+		if !ValuesEqual(pair[0], pair[1]) {
+			t.Errorf("%s and %s should be equal", show(pair[0]), show(pair[1]))
+		}
+	}
+	for _, pair := range unequal {
+		if ValuesEqual(pair[0], pair[1]) {
+			t.Errorf("%s and %s should differ", show(pair[0]), show(pair[1]))
+		}
+	}
+}
+
+func TestFprintValue(t *testing.T) {
+	tests := map[string]Value{
+		"nil":             NilVal(),
+		"true":            BoolVal(true),
+		"2.5":             NumberVal(2.5),
+		"1e+21":           NumberVal(1e21),
+		"text":            ObjVal(NewString("text").AsObj()),
+		"TypeError: oops": ObjVal(NewError("TypeError", "oops", nil).AsObj()),
+	}
+	for want, v := range tests {
+		if got := show(v); got != want {
+			t.Errorf("printed %q, want %q", got, want)
+		}
+	}
+}
+
+func TestValueSize(t *testing.T) {
+	if size := unsafe.Sizeof(Value{}); size > 16 {
+		t.Errorf("Value is %d bytes, want at most 16", size)
+	}
+}
+
+func show(v Value) string {
+	var b strings.Builder
+	FprintValue(&b, v)
+	return b.String()
+}
+
+func BenchmarkArithmetic(b *testing.B) {
+	acc := NumberVal(0)
+	one := NumberVal(1)
+	for i := 0; i < b.N; i++ {
+		if acc.IsNumber() && one.IsNumber() {
+			acc = NumberVal(acc.AsNumber() + one.AsNumber())
+		}
+	}
+	if acc.AsNumber() != float64(b.N) {
+		b.Fatal("wrong sum")
+	}
+}
+
+func BenchmarkValuesEqual(b *testing.B) {
+	values := []Value{NilVal(), BoolVal(true), NumberVal(3), ObjVal(NewString("abc").AsObj())}
+	for i := 0; i < b.N; i++ {
+		ValuesEqual(values[i%4], values[(i+1)%4])
+	}
+}
+
+func BenchmarkValueArray(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		arr := NewValueArray()
+		for j := 0; j < 64; j++ {
+			arr.Write(NumberVal(float64(j)))
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package vm
+
+import (
+	"context"
+	"errors"
+)
+
+// CHECK_INTERVAL is how many instructions run between checks of the
+// context, which is too costly to poll on every instruction.
+const CHECK_INTERVAL = 1024
+
+// beginLimits arms the execution and heap limits for a run. The
+// instruction budget is exact; timeouts and cancellation are noticed within CHECK_INTERVAL
+// instructions.
+func (vm *VM) beginLimits(ctx context.Context) context.CancelFunc {
+	cancel := context.CancelFunc(func() {})
+	if vm.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, vm.Timeout)
+	}
+
+	vm.ctx = ctx
+	vm.allocated = 0
+	vm.executed = 0
+	vm.slice = 0
+	vm.countdown = 0
+	return cancel
+}
+
+// checkLimits runs whenever the countdown reaches zero. It reports whether
+// execution may continue, printing the reason when it may not. With a hook
+// attached it runs before every instruction.
+func (vm *VM) checkLimits() bool {
+	vm.executed += vm.slice
+	vm.slice = 0
+
+	if vm.MaxInstructions > 0 && vm.executed >= vm.MaxInstructions {
+		vm.abort("Instruction budget of %d exhausted.", vm.MaxInstructions)
+		return false
+	}
+
+	if err := vm.ctx.Err(); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			vm.abort("Deadline exceeded.")
+		} else {
+			vm.abort("Execution cancelled.")
+		}
+		return false
+	}
+
+	vm.slice = CHECK_INTERVAL
+	if vm.MaxInstructions > 0 {
+		vm.slice = min(vm.slice, vm.MaxInstructions-vm.executed)
+	}
+	vm.countdown = vm.slice
+
+	if vm.Hook != nil {
+		return vm.callHook()
+	}
+	return true
+}
+
+// Executed returns how many instructions the current or most recent run
+// has executed.
+func (vm *VM) Executed() int64 {
+	return vm.executed + vm.slice - vm.countdown
+}
+
+func (vm *VM) abort(format string, args ...interface{}) {
+	vm.reportError("Aborted:", true, format, args...)
+}
@@ -0,0 +1,47 @@
+package vm
+
+import "github.com/caelondev/hydor/frontend/bytecode"
+
+// Coverage counts how often each instruction runs. One Coverage may be
+// shared by several VMs in turn, such as one per test, to gather the
+// counts of all their runs; it must not be used by two at once. The
+// profiler keeps its line counts in one too.
+type Coverage struct {
+	counts map[*bytecode.Bytecode][]int64
+	chunks []*bytecode.Bytecode
+
+	// last caches the counts of the chunk that ran most recently, sparing
+	// a map lookup on almost every instruction.
+	last       *bytecode.Bytecode
+	lastCounts []int64
+}
+
+func NewCoverage() *Coverage {
+	return &Coverage{counts: map[*bytecode.Bytecode][]int64{}}
+}
+
+// Record counts the instruction at offset ip of chunk.
+func (c *Coverage) Record(chunk *bytecode.Bytecode, ip int) {
+	if chunk != c.last {
+		counts, ok := c.counts[chunk]
+		if !ok {
+			counts = make([]int64, len(chunk.Code))
+			c.counts[chunk] = counts
+			c.chunks = append(c.chunks, chunk)
+		}
+		c.last, c.lastCounts = chunk, counts
+	}
+	c.lastCounts[ip]++
+}
+
+// Chunks returns every chunk that ran, in the order each first ran.
+func (c *Coverage) Chunks() []*bytecode.Bytecode {
+	return c.chunks
+}
+
+// Counts returns how often the instruction at each offset of chunk ran.
+// Offsets inside an instruction's operands stay zero. It returns nil for
+// a chunk that never ran.
+func (c *Coverage) Counts(chunk *bytecode.Bytecode) []int64 {
+	return c.counts[chunk]
+}
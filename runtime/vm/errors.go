@@ -0,0 +1,220 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/caelondev/hydor/color"
+	"github.com/caelondev/hydor/frontend/debug"
+	"github.com/caelondev/hydor/runtime/value"
+)
+
+// TRACE_HEAD and TRACE_TAIL are how many frames a printed traceback keeps
+// from the innermost and outermost ends once it is too long to show whole.
+const TRACE_HEAD = 10
+const TRACE_TAIL = 5
+
+// TRACE_REPEAT_LIMIT is how many identical consecutive frames are printed
+// before the rest of the run is summarized, as happens in deep recursion.
+const TRACE_REPEAT_LIMIT = 3
+
+// Kinds of error the VM raises. A thrown value that is not already an error
+// is wrapped in one of kind ERROR_THROWN. Internal errors mean the VM itself
+// is in a bad state, so scripts cannot catch them.
+const (
+	ERROR_THROWN         = "Error"
+	ERROR_TYPE           = "TypeError"
+	ERROR_ZERO_DIVISION  = "ZeroDivisionError"
+	ERROR_PROPERTY       = "PropertyError"
+	ERROR_STACK_OVERFLOW = "StackOverflowError"
+	ERROR_MEMORY         = "MemoryError"
+	ERROR_INTERNAL       = "InternalError"
+)
+
+// TraceFrame is one entry of a runtime error's traceback.
+type TraceFrame = value.TraceFrame
+
+// RuntimeError describes why a run failed, with the frames that were
+// active at the time, innermost first.
+type RuntimeError struct {
+	Message string
+	// Kind is the kind of the uncaught error, or empty for aborted runs.
+	Kind  string
+	Trace []TraceFrame
+	// Aborted is set when the run was stopped by a budget, timeout or
+	// cancellation rather than failing on its own.
+	Aborted bool
+}
+
+func (e *RuntimeError) Error() string {
+	return e.Message
+}
+
+// Err returns the error that ended the most recent run, or nil if it
+// succeeded.
+func (vm *VM) Err() *RuntimeError {
+	return vm.lastError
+}
+
+// captureTrace snapshots the active frames, innermost first.
+func (vm *VM) captureTrace() []TraceFrame {
+	trace := make([]TraceFrame, 0, len(vm.Frames))
+
+	for i := len(vm.Frames) - 1; i >= 0; i-- {
+		frame := &vm.Frames[i]
+		ip := frame.Ip
+		if i == len(vm.Frames)-1 {
+			ip = vm.Ip
+		}
+
+		trace = append(trace, TraceFrame{
+			Function: frame.Name,
+			File:     frame.Bytecode.File,
+			Line:     debug.GetLine(frame.Bytecode, ip-1),
+		})
+	}
+	return trace
+}
+
+// raise creates an error of the given kind at the current instruction and
+// unwinds to the nearest handler.
+func (vm *VM) raise(kind string, format string, args ...interface{}) {
+	err := value.NewError(kind, fmt.Sprintf(format, args...), vm.captureTrace())
+	panic(vmPanic{err})
+}
+
+// throw raises v. Errors keep the trace from where they were first raised,
+// so catching and rethrowing one does not hide its origin.
+func (vm *VM) throw(v value.Value) {
+	if v.IsError() {
+		panic(vmPanic{v.AsError()})
+	}
+
+	var message strings.Builder
+	value.FprintValue(&message, v)
+	vm.raise(ERROR_THROWN, "%s", message.String())
+}
+
+// unwind moves execution to the innermost handler covering the instruction
+// that raised err, discarding frames that have none. It reports false when
+// nothing handles err.
+func (vm *VM) unwind(err *value.ObjError) bool {
+	if err.Kind == ERROR_INTERNAL {
+		return false
+	}
+
+	for len(vm.Frames) > 0 {
+		base := vm.Frames[len(vm.Frames)-1].Base
+		for _, h := range vm.Bytecode.Handlers {
+			if h.Start <= vm.Ip-1 && vm.Ip-1 < h.End {
+				vm.StackTop = base + h.Depth
+				vm.Ip = h.Target
+				vm.push(value.ObjVal(err.AsObj()))
+				return true
+			}
+		}
+		vm.popFrame()
+	}
+	return false
+}
+
+// getProperty reads a field of an error object.
+func (vm *VM) getProperty(target value.Value, name string) value.Value {
+	if !target.IsError() {
+		vm.raise(ERROR_TYPE, "Cannot read property '%s' of %s (%s). Only errors have properties.",
+			name, value.ValueTypeName(target), formatValue(target))
+	}
+	err := target.AsError()
+
+	var field string
+	switch name {
+	case "message":
+		field = err.Message
+	case "kind":
+		field = err.Kind
+	case "trace":
+		var trace strings.Builder
+		PrintTrace(&trace, err.Trace)
+		field = strings.TrimSuffix(trace.String(), "\n")
+	default:
+		vm.raise(ERROR_PROPERTY, "Undefined property '%s'. Errors have 'message', 'kind' and 'trace'.", name)
+	}
+
+	vm.chargeString(len(field))
+	return value.ObjVal(value.NewString(field).AsObj())
+}
+
+// reportUncaught records err for Err and prints it with the trace from
+// where it was raised.
+func (vm *VM) reportUncaught(err *value.ObjError) {
+	vm.lastError = &RuntimeError{
+		Message: err.Message,
+		Kind:    err.Kind,
+		Trace:   err.Trace,
+	}
+
+	fmt.Fprintf(vm.Stderr, "%s %s\n", color.Red("Runtime Error:"), err.Message)
+	PrintTrace(vm.Stderr, err.Trace)
+
+	vm.resetStack()
+}
+
+// reportError records a labelled error for Err and prints it followed by
+// its traceback.
+func (vm *VM) reportError(label string, aborted bool, format string, args ...interface{}) {
+	vm.lastError = &RuntimeError{
+		Message: fmt.Sprintf(format, args...),
+		Trace:   vm.captureTrace(),
+		Aborted: aborted,
+	}
+
+	fmt.Fprintf(vm.Stderr, "%s %s\n", color.Red(label), vm.lastError.Message)
+	PrintTrace(vm.Stderr, vm.lastError.Trace)
+
+	vm.resetStack()
+}
+
+// PrintTrace writes trace one frame per line. Runs of an identical frame
+// are collapsed and very long traces keep only their two ends.
+func PrintTrace(w io.Writer, trace []TraceFrame) {
+	lines := []string{}
+
+	for i := 0; i < len(trace); {
+		run := 1
+		for i+run < len(trace) && trace[i+run] == trace[i] {
+			run++
+		}
+
+		for j := 0; j < min(run, TRACE_REPEAT_LIMIT); j++ {
+			lines = append(lines, formatFrame(trace[i]))
+		}
+		if run > TRACE_REPEAT_LIMIT {
+			lines = append(lines, fmt.Sprintf("    [previous frame repeated %d more times]", run-TRACE_REPEAT_LIMIT))
+		}
+		i += run
+	}
+
+	if len(lines) > TRACE_HEAD+TRACE_TAIL+1 {
+		omitted := len(lines) - TRACE_HEAD - TRACE_TAIL
+		shortened := append([]string{}, lines[:TRACE_HEAD]...)
+		shortened = append(shortened, fmt.Sprintf("    ... %d more lines ...", omitted))
+		lines = append(shortened, lines[len(lines)-TRACE_TAIL:]...)
+	}
+
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+}
+
+func formatFrame(frame TraceFrame) string {
+	location := fmt.Sprintf("line %d", frame.Line)
+	if frame.File != "" {
+		location = fmt.Sprintf("%s:%d", frame.File, frame.Line)
+	}
+
+	if frame.Function == SCRIPT_NAME {
+		return fmt.Sprintf("    [%s] in script", location)
+	}
+	return fmt.Sprintf("    [%s] in %s()", location, frame.Function)
+}
@@ -0,0 +1,96 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/caelondev/hydor/frontend/bytecode"
+	"github.com/caelondev/hydor/result"
+	"github.com/caelondev/hydor/runtime/value"
+)
+
+const DEFAULT_MAX_STACK = 1 << 20
+const DEFAULT_MAX_FRAMES = 256
+
+// CallFrame is one activation on the VM's call stack. The innermost frame
+// runs from vm.Bytecode and vm.Ip; the Ip stored in outer frames is where
+// they resume.
+type CallFrame struct {
+	Name     string
+	Bytecode *bytecode.Bytecode
+	Ip       int
+	// Base is the first stack slot owned by the frame.
+	Base int
+}
+
+// vmPanic carries a raised error out of the dispatch loop to the code that
+// unwinds to its handler.
+type vmPanic struct {
+	err *value.ObjError
+}
+
+func (vm *VM) pushFrame(name string, chunk *bytecode.Bytecode) {
+	if len(vm.Frames) >= vm.MaxFrames {
+		vm.raise(ERROR_STACK_OVERFLOW, "Stack overflow: call depth exceeded %d frames.", vm.MaxFrames)
+	}
+
+	if len(vm.Frames) > 0 {
+		vm.Frames[len(vm.Frames)-1].Ip = vm.Ip
+	}
+	vm.Frames = append(vm.Frames, CallFrame{
+		Name:     name,
+		Bytecode: chunk,
+		Base:     vm.StackTop,
+	})
+	vm.Bytecode = chunk
+	vm.Ip = 0
+}
+
+// popFrame discards the innermost frame and its stack slots, resuming the
+// caller where it left off.
+func (vm *VM) popFrame() {
+	frame := vm.Frames[len(vm.Frames)-1]
+	vm.Frames = vm.Frames[:len(vm.Frames)-1]
+	vm.StackTop = frame.Base
+
+	if len(vm.Frames) > 0 {
+		caller := &vm.Frames[len(vm.Frames)-1]
+		vm.Bytecode = caller.Bytecode
+		vm.Ip = caller.Ip
+	}
+}
+
+// ensureStack grows the stack so it can hold at least n values. Asking for
+// more than MaxStack is a stack overflow even when the stack already has
+// room, since a VM may be given a budget smaller than its initial stack.
+func (vm *VM) ensureStack(n int) {
+	if n > vm.MaxStack {
+		vm.raise(ERROR_STACK_OVERFLOW, "Stack overflow: value stack exceeded %d slots.", vm.MaxStack)
+	}
+	if n <= len(vm.Stack) {
+		return
+	}
+
+	size := max(len(vm.Stack), STACK_INITIAL)
+	for size < n {
+		size *= 2
+	}
+	grown := make([]value.Value, min(size, vm.MaxStack))
+	copy(grown, vm.Stack[:vm.StackTop])
+	vm.Stack = grown
+}
+
+// recoverPanic converts a panic escaping the dispatch loop into a runtime
+// error so a bug or exhausted limit never takes down the host process.
+func (vm *VM) recoverPanic(res *result.InterpretResult) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	if p, ok := r.(vmPanic); ok {
+		vm.reportUncaught(p.err)
+	} else {
+		vm.reportUncaught(value.NewError(ERROR_INTERNAL, fmt.Sprintf("Internal error: %v", r), vm.captureTrace()))
+	}
+	*res = result.INTERPRET_RUNTIME_ERROR
+}
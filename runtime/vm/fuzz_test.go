@@ -0,0 +1,127 @@
+package vm
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caelondev/hydor/frontend/compiler"
+	"github.com/caelondev/hydor/frontend/optimizer"
+	"github.com/caelondev/hydor/result"
+)
+
+// FUZZ_MAX_OUTPUT bounds what a fuzzed run may print. Programs have no
+// loops, so their output grows with the source, never beyond it by much.
+const FUZZ_MAX_OUTPUT = 1 << 16
+
+// addSeeds seeds f with the conformance scripts and programs that stress
+// handlers and limits.
+func addSeeds(f *testing.F) {
+	scripts, _ := filepath.Glob(filepath.Join("..", "..", "testdata", "*", "*.hd"))
+	for _, path := range scripts {
+		if data, err := os.ReadFile(path); err == nil {
+			f.Add(string(data))
+		}
+	}
+	for _, s := range []string{
+		"try { try { throw 1 } finally { throw 2 } } catch (e) { e.message }",
+		"try { 1 } catch (e) { e } finally { try { throw 3 } catch (f) { f.trace } }",
+		`-(("a" + "b") * 2)`,
+		"try { throw nil } catch (e) { e.message + e.kind + e.trace }",
+		"0 / 0 == 0 / 0",
+	} {
+		f.Add(s)
+	}
+}
+
+// boundedWriter records output, failing writes past FUZZ_MAX_OUTPUT.
+type boundedWriter struct {
+	strings.Builder
+	overflow bool
+}
+
+func (w *boundedWriter) Write(p []byte) (int, error) {
+	if w.Len()+len(p) > FUZZ_MAX_OUTPUT {
+		w.overflow = true
+		return 0, io.ErrShortWrite
+	}
+	return w.Builder.Write(p)
+}
+
+// outcome is everything a run can be observed doing.
+type outcome struct {
+	res    result.InterpretResult
+	stdout string
+	stderr string
+	kind   string
+}
+
+// FuzzRun runs any source that compiles and checks that the VM neither
+// panics nor prints without bound, and that a program behaves the same
+// on every run and at every optimization level.
+func FuzzRun(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, source string) {
+		var unoptimized *outcome
+		for _, level := range []optimizer.Level{optimizer.O0, optimizer.O1} {
+			chunk, ok := compiler.Compile(source, compiler.Options{Optimize: level, Errors: io.Discard})
+			if !ok {
+				return
+			}
+			program, err := NewProgram(chunk)
+			if err != nil {
+				t.Fatalf("-O%d: compiled chunk does not verify: %v", level, err)
+			}
+
+			got := runFuzz(t, program)
+			if again := runFuzz(t, program); *again != *got {
+				t.Fatalf("-O%d: ran as %+v, then %+v", level, got, again)
+			}
+
+			if unoptimized == nil {
+				unoptimized = got
+				continue
+			}
+			// Folding moves work from run time to compile time, so only
+			// the unoptimized run may exhaust a budget.
+			if unoptimized.exhausted() || got.exhausted() {
+				continue
+			}
+			if got.res != unoptimized.res || got.stdout != unoptimized.stdout || got.kind != unoptimized.kind {
+				t.Fatalf("-O%d ran as %+v, -O0 as %+v", level, got, unoptimized)
+			}
+		}
+	})
+}
+
+func (o *outcome) exhausted() bool {
+	return o.res == result.INTERPRET_ABORTED || o.kind == ERROR_MEMORY
+}
+
+func runFuzz(t *testing.T, program *Program) *outcome {
+	t.Helper()
+	var stdout, stderr boundedWriter
+	machine := NewVM()
+	machine.Stdout = &stdout
+	machine.Stderr = &stderr
+	machine.MaxInstructions = 1 << 16
+	machine.MaxHeap = 1 << 20
+	machine.Timeout = 5 * time.Second
+
+	got := &outcome{res: machine.Run(context.Background(), program)}
+	if stdout.overflow || stderr.overflow {
+		t.Fatalf("printed more than %d bytes", FUZZ_MAX_OUTPUT)
+	}
+	if err := machine.Err(); err != nil {
+		if err.Kind == ERROR_INTERNAL {
+			t.Fatalf("internal error: %s", err.Message)
+		}
+		got.kind = err.Kind
+	}
+	got.stdout, got.stderr = stdout.String(), stderr.String()
+	return got
+}
@@ -0,0 +1,29 @@
+package vm
+
+import "github.com/caelondev/hydor/runtime/value"
+
+// Hook lets a debugger observe execution. While a hook is attached the VM
+// calls Before ahead of every instruction, with vm.Ip at that instruction.
+// Returning false stops the run, which then ends as aborted.
+type Hook interface {
+	Before(vm *VM) bool
+}
+
+// callHook runs from checkLimits. Shrinking the slice to one instruction
+// brings execution back to checkLimits before the next instruction, so the
+// dispatch loop needs no test of its own for an attached hook.
+func (vm *VM) callHook() bool {
+	vm.slice = 1
+	vm.countdown = 1
+
+	if !vm.Hook.Before(vm) {
+		vm.abort("Stopped by debugger.")
+		return false
+	}
+	return true
+}
+
+// Result returns the value the most recent successful run returned.
+func (vm *VM) Result() value.Value {
+	return vm.result
+}
@@ -0,0 +1,39 @@
+package vm
+
+import (
+	"github.com/caelondev/hydor/frontend/bytecode"
+	"github.com/caelondev/hydor/frontend/verifier"
+)
+
+// Program is a verified chunk ready to run. Nothing modifies a Program or
+// its bytecode after NewProgram returns, so a single Program may be run by
+// any number of VMs concurrently.
+type Program struct {
+	chunk    *bytecode.Bytecode
+	maxStack int
+	// heap is what the constant pool's strings count against MaxHeap.
+	// Constant folding builds strings at compile time, so without this a
+	// folded concatenation would escape the limit.
+	heap int64
+}
+
+// NewProgram verifies chunk and wraps it for execution. The caller must not
+// modify chunk afterwards.
+func NewProgram(chunk *bytecode.Bytecode) (*Program, error) {
+	info, err := verifier.Verify(chunk)
+	if err != nil {
+		return nil, err
+	}
+
+	program := &Program{chunk: chunk, maxStack: info.MaxStack}
+	for _, v := range chunk.Constants.Values {
+		if v.IsString() {
+			program.heap += stringSize(len(v.AsCString()))
+		}
+	}
+	return program, nil
+}
+
+func (p *Program) Bytecode() *bytecode.Bytecode {
+	return p.chunk
+}
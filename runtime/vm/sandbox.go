@@ -0,0 +1,47 @@
+package vm
+
+import (
+	"unsafe"
+
+	"github.com/caelondev/hydor/runtime/value"
+)
+
+// SANDBOX_MAX_HEAP is the heap limit Sandbox applies when none is set.
+const SANDBOX_MAX_HEAP = 64 * 1024 * 1024
+
+// Sandbox restricts the VM for running untrusted scripts. For now it only
+// caps the heap at SANDBOX_MAX_HEAP unless a tighter limit is already set.
+// Hydor has no natives yet, so there is no filesystem, process or
+// environment access to disable. A native that reaches the host must add
+// a check here that Sandbox can switch off.
+func (vm *VM) Sandbox() {
+	if vm.MaxHeap == 0 || vm.MaxHeap > SANDBOX_MAX_HEAP {
+		vm.MaxHeap = SANDBOX_MAX_HEAP
+	}
+}
+
+// HeapAllocated returns the bytes of heap objects the current or most
+// recent run has allocated.
+func (vm *VM) HeapAllocated() int64 {
+	return vm.allocated
+}
+
+// allocate charges size bytes against MaxHeap, raising a memory error when
+// the limit would be exceeded.
+func (vm *VM) allocate(size int64) {
+	if vm.MaxHeap > 0 && vm.allocated+size > vm.MaxHeap {
+		vm.raise(ERROR_MEMORY, "Out of memory: heap limit of %d bytes exceeded.", vm.MaxHeap)
+	}
+	vm.allocated += size
+}
+
+// chargeString accounts for a string of length bytes before it is built,
+// so an oversized concatenation fails without allocating.
+func (vm *VM) chargeString(length int) {
+	vm.allocate(stringSize(length))
+}
+
+// stringSize is what a string of length bytes counts against MaxHeap.
+func stringSize(length int) int64 {
+	return int64(unsafe.Sizeof(value.ObjString{})) + int64(length)
+}
@@ -0,0 +1,121 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/caelondev/hydor/frontend/bytecode"
+	"github.com/caelondev/hydor/frontend/debug"
+	"github.com/caelondev/hydor/runtime/value"
+)
+
+// SCRIPT_NAME is the function name reported for top-level code.
+const SCRIPT_NAME = "script"
+
+type TraceFormat int
+
+const (
+	TRACE_TEXT TraceFormat = iota
+	TRACE_JSON
+)
+
+// TraceOptions enables execution tracing on a VM. Each instruction is
+// reported to Writer before it runs, together with the current stack.
+type TraceOptions struct {
+	Writer io.Writer
+	Format TraceFormat
+
+	// FromLine and ToLine restrict tracing to an inclusive source line
+	// range. Zero means unbounded on that side.
+	FromLine int
+	ToLine   int
+
+	// Function restricts tracing to instructions executing inside the
+	// named function. Empty traces everything.
+	Function string
+}
+
+type traceEntry struct {
+	Offset   int      `json:"offset"`
+	Line     int      `json:"line"`
+	Function string   `json:"function"`
+	Op       string   `json:"op"`
+	Operands []int    `json:"operands,omitempty"`
+	Constant string   `json:"constant,omitempty"`
+	Target   int      `json:"target,omitempty"`
+	Stack    []string `json:"stack"`
+}
+
+func (t *TraceOptions) wants(line int, function string) bool {
+	if t.FromLine > 0 && line < t.FromLine {
+		return false
+	}
+	if t.ToLine > 0 && line > t.ToLine {
+		return false
+	}
+	if t.Function != "" && t.Function != function {
+		return false
+	}
+	return true
+}
+
+func (vm *VM) traceInstruction() {
+	line := debug.GetLine(vm.Bytecode, vm.Ip)
+	function := vm.Frames[len(vm.Frames)-1].Name
+	if !vm.Trace.wants(line, function) {
+		return
+	}
+
+	w := vm.Trace.Writer
+	switch vm.Trace.Format {
+	case TRACE_JSON:
+		vm.traceJSON(w, line, function)
+	default:
+		for i := 0; i < vm.StackTop; i++ {
+			fmt.Fprintf(w, "[ ")
+			value.FprintValue(w, vm.Stack[i])
+			fmt.Fprintf(w, " ]")
+			fmt.Fprintln(w)
+		}
+
+		debug.FdisassembleInstruction(w, vm.Bytecode, vm.Ip)
+	}
+}
+
+func (vm *VM) traceJSON(w io.Writer, line int, function string) {
+	op := bytecode.OpCode(vm.Bytecode.Code[vm.Ip])
+	entry := traceEntry{
+		Offset:   vm.Ip,
+		Line:     line,
+		Function: function,
+		Op:       op.String(),
+		Stack:    make([]string, vm.StackTop),
+	}
+
+	if bytecode.HasConstantOperand(op) {
+		index := vm.Bytecode.ConstantIndex(vm.Ip)
+		entry.Operands = []int{index}
+		entry.Constant = formatValue(vm.Bytecode.Constants.Values[index])
+	} else if bytecode.IsJump(op) {
+		// Like the disassembler, report the decoded offset and where it
+		// lands. Jumps only go forward, so the target is never zero.
+		entry.Operands = []int{bytecode.ReadUint16(vm.Bytecode.Code, vm.Ip+1)}
+		entry.Target = vm.Bytecode.JumpTarget(vm.Ip)
+	} else {
+		width := bytecode.OperandWidth(op)
+		for i := 1; i <= width; i++ {
+			entry.Operands = append(entry.Operands, int(vm.Bytecode.Code[vm.Ip+i]))
+		}
+	}
+
+	for i := 0; i < vm.StackTop; i++ {
+		entry.Stack[i] = formatValue(vm.Stack[i])
+	}
+
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	w.Write(append(encoded, '\n'))
+}
@@ -0,0 +1,124 @@
+package vm
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/caelondev/hydor/frontend/optimizer"
+	"github.com/caelondev/hydor/result"
+)
+
+const traced = `1 +
+  try {
+    2
+  } catch (e) {
+    3
+  }`
+
+// trace runs traced at -O0 with options and returns the JSON records it
+// wrote, one per line.
+func trace(t *testing.T, options TraceOptions) []map[string]interface{} {
+	t.Helper()
+	var out strings.Builder
+	options.Writer = &out
+	options.Format = TRACE_JSON
+	machine := NewVM()
+	machine.Trace = &options
+	if res, _, _ := run(t, machine, traced, optimizer.O0); res != result.INTERPRET_OK {
+		t.Fatalf("result %d", res)
+	}
+
+	records := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		record := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("%q is not JSON: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestTraceJSON(t *testing.T) {
+	records := trace(t, TraceOptions{})
+	if len(records) == 0 {
+		t.Fatal("nothing traced")
+	}
+
+	jumped := false
+	for i, r := range records {
+		for _, key := range []string{"offset", "line", "function", "op", "stack"} {
+			if _, ok := r[key]; !ok {
+				t.Errorf("record %d lacks %q: %v", i, key, r)
+			}
+		}
+		if r["function"] != SCRIPT_NAME {
+			t.Errorf("record %d is in %v, want %s", i, r["function"], SCRIPT_NAME)
+		}
+
+		switch r["op"] {
+		case "OP_CONSTANT":
+			operands, _ := r["operands"].([]interface{})
+			if len(operands) != 1 || r["constant"] == nil {
+				t.Errorf("constant record %v lacks its index or value", r)
+			}
+		case "OP_JUMP":
+			// The try body finishes and jumps over the catch clause. The
+			// operand is the decoded distance and the target is where the
+			// next record starts.
+			jumped = true
+			operands, _ := r["operands"].([]interface{})
+			if len(operands) != 1 || i+1 >= len(records) {
+				t.Fatalf("jump record %v", r)
+			}
+			offset, distance, target := r["offset"].(float64), operands[0].(float64), r["target"].(float64)
+			if target != offset+3+distance || records[i+1]["offset"] != target {
+				t.Errorf("jump at %v by %v targets %v, and the next record is at %v", offset, distance, target, records[i+1]["offset"])
+			}
+		}
+	}
+	if !jumped {
+		t.Error("no OP_JUMP traced")
+	}
+
+	last := records[len(records)-1]
+	if stack, _ := last["stack"].([]interface{}); last["op"] != "OP_RETURN" || len(stack) != 1 || stack[0] != "3" {
+		t.Errorf("last record %v, want the return of 3", last)
+	}
+}
+
+func TestTraceFilters(t *testing.T) {
+	lines := func(records []map[string]interface{}) map[float64]bool {
+		seen := map[float64]bool{}
+		for _, r := range records {
+			seen[r["line"].(float64)] = true
+		}
+		return seen
+	}
+
+	all := lines(trace(t, TraceOptions{}))
+	tests := []struct {
+		name    string
+		options TraceOptions
+		want    func(line float64) bool
+	}{
+		{"range", TraceOptions{FromLine: 2, ToLine: 3}, func(l float64) bool { return l >= 2 && l <= 3 }},
+		{"single line", TraceOptions{FromLine: 3, ToLine: 3}, func(l float64) bool { return l == 3 }},
+		{"from", TraceOptions{FromLine: 3}, func(l float64) bool { return l >= 3 }},
+		{"to", TraceOptions{ToLine: 1}, func(l float64) bool { return l <= 1 }},
+		{"function", TraceOptions{Function: SCRIPT_NAME}, func(float64) bool { return true }},
+		{"other function", TraceOptions{Function: "helper"}, func(float64) bool { return false }},
+	}
+	for _, test := range tests {
+		got := lines(trace(t, test.options))
+		for line := range all {
+			if got[line] != test.want(line) {
+				t.Errorf("%s: line %v traced %t, want %t", test.name, line, got[line], test.want(line))
+			}
+		}
+	}
+}
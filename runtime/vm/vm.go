@@ -1,45 +1,167 @@
 package vm
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"math"
 	"os"
+	"time"
 
+	"github.com/caelondev/hydor/color"
 	"github.com/caelondev/hydor/frontend/bytecode"
-	"github.com/caelondev/hydor/frontend/debug"
 	"github.com/caelondev/hydor/result"
 	"github.com/caelondev/hydor/runtime/value"
 )
 
-const DEBUG_TRACE_EXECUTION = false
-const STACK_MAX = 8 * 1024 * 1024
+const STACK_INITIAL = 256
 
 type VM struct {
 	Bytecode *bytecode.Bytecode
 	Ip       int
-	Stack    [STACK_MAX]value.Value
+	Stack    []value.Value
 	StackTop int
+	Frames   []CallFrame
+
+	// MaxStack and MaxFrames bound the value stack and call depth.
+	// Exceeding either is reported as a stack overflow runtime error.
+	MaxStack  int
+	MaxFrames int
+
+	// MaxInstructions caps how many instructions a run may execute and
+	// Timeout caps its wall-clock time. Zero means unlimited. Runs that hit
+	// either limit, or whose context is cancelled, end with
+	// INTERPRET_ABORTED.
+	MaxInstructions int64
+	Timeout         time.Duration
+
+	// MaxHeap caps the bytes of objects a run may allocate, including the
+	// strings in the program's constant pool; zero means unlimited.
+	MaxHeap int64
+
+	ctx       context.Context
+	lastError *RuntimeError
+	allocated int64
+	executed  int64
+	slice     int64
+	countdown int64
+
+	// Trace enables execution tracing when non-nil.
+	Trace *TraceOptions
+
+	// Coverage, when set, counts every instruction the VM executes.
+	Coverage *Coverage
+
+	// Hook, when set, is called before every instruction.
+	Hook   Hook
+	result value.Value
+
+	// Stdout receives program output and Stderr receives error reports.
+	// NewVM points them at the process streams.
+	Stdout io.Writer
+	Stderr io.Writer
 }
 
 func NewVM() *VM {
-	return &VM{}
+	return &VM{
+		Stack:     make([]value.Value, STACK_INITIAL),
+		MaxStack:  DEFAULT_MAX_STACK,
+		MaxFrames: DEFAULT_MAX_FRAMES,
+
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
 }
 
 func (vm *VM) Interpret(chunk *bytecode.Bytecode) result.InterpretResult {
+	return vm.InterpretContext(context.Background(), chunk)
+}
+
+// InterpretContext verifies chunk and runs it until it returns, fails, or
+// ctx is cancelled. Chunks that fail verification are rejected before a
+// single instruction executes.
+func (vm *VM) InterpretContext(ctx context.Context, chunk *bytecode.Bytecode) result.InterpretResult {
+	program, err := NewProgram(chunk)
+	if err != nil {
+		fmt.Fprintf(vm.Stderr, "%s %s\n", color.Red("Verify Error:"), err.Error())
+		return result.INTERPRET_INVALID_BYTECODE
+	}
 
-	vm.Bytecode = chunk
-	vm.Ip = 0
+	return vm.Run(ctx, program)
+}
+
+// Run executes an already verified program. Any panic raised while running
+// is reported as a runtime error rather than crashing the host.
+func (vm *VM) Run(ctx context.Context, program *Program) (res result.InterpretResult) {
 	vm.resetStack()
+	vm.lastError = nil
+	vm.result = value.NilVal()
+	defer vm.recoverPanic(&res)
+
+	cancel := vm.beginLimits(ctx)
+	defer cancel()
+
+	vm.pushFrame(SCRIPT_NAME, program.chunk)
+	vm.ensureStack(program.maxStack)
+	vm.allocate(program.heap)
 
-	result := vm.run()
-	return result
+	return vm.run()
+}
+
+// InterpretCompiled loads a chunk serialized with bytecode.Marshal and runs
+// it. Corrupt or incompatible input is reported instead of executed. The
+// source hash is not checked: the VM is given bytes rather than a file, so
+// it cannot find the source they were built from. Callers that know where
+// the .hdc file lives, as the hydor command does, compare the hash with
+// bytecode.HashSource before running it.
+func (vm *VM) InterpretCompiled(data []byte) result.InterpretResult {
+	chunk, _, err := bytecode.Unmarshal(data)
+	if err != nil {
+		fmt.Fprintf(vm.Stderr, "%s %s\n", color.Red("Load Error:"), err.Error())
+		return result.INTERPRET_INVALID_BYTECODE
+	}
+
+	return vm.Interpret(chunk)
 }
 
 func (vm *VM) resetStack() {
 	vm.StackTop = 0
+	vm.Frames = vm.Frames[:0]
 }
 
+// run executes until the script returns or is aborted, or an error escapes
+// every handler. An error raised during execute unwinds to the innermost
+// handler covering it and execution resumes there.
 func (vm *VM) run() result.InterpretResult {
+	for {
+		res, thrown := vm.dispatch()
+		if thrown == nil {
+			return res
+		}
+		if !vm.unwind(thrown) {
+			vm.reportUncaught(thrown)
+			return result.INTERPRET_RUNTIME_ERROR
+		}
+	}
+}
+
+// dispatch runs execute, catching the error it raises, if any. Panics that
+// are not raised errors are left for recoverPanic.
+func (vm *VM) dispatch() (res result.InterpretResult, thrown *value.ObjError) {
+	defer func() {
+		if r := recover(); r != nil {
+			p, ok := r.(vmPanic)
+			if !ok {
+				panic(r)
+			}
+			thrown = p.err
+		}
+	}()
+
+	return vm.execute(), nil
+}
+
+func (vm *VM) execute() result.InterpretResult {
 	readByte := func() byte {
 		instruction := vm.Bytecode.Code[vm.Ip]
 		vm.Ip++
@@ -50,16 +172,28 @@ func (vm *VM) run() result.InterpretResult {
 		return vm.Bytecode.Constants.Values[readByte()]
 	}
 
+	readShort := func() int {
+		vm.Ip += 2
+		return bytecode.ReadUint16(vm.Bytecode.Code, vm.Ip-2)
+	}
+
+	readConstantLong := func() value.Value {
+		index := bytecode.ReadUint24(vm.Bytecode.Code, vm.Ip)
+		vm.Ip += 3
+		return vm.Bytecode.Constants.Values[index]
+	}
+
 	for {
-		if DEBUG_TRACE_EXECUTION {
-			for i := 0; i < vm.StackTop; i++ {
-				fmt.Printf("[ ")
-				value.PrintValue(vm.Stack[i])
-				fmt.Printf(" ]")
-				fmt.Println()
-			}
+		if vm.countdown == 0 && !vm.checkLimits() {
+			return result.INTERPRET_ABORTED
+		}
+		vm.countdown--
 
-			debug.DisassembleInstruction(vm.Bytecode, vm.Ip)
+		if vm.Trace != nil {
+			vm.traceInstruction()
+		}
+		if vm.Coverage != nil {
+			vm.Coverage.Record(vm.Bytecode, vm.Ip)
 		}
 
 		instruction := readByte()
@@ -67,6 +201,9 @@ func (vm *VM) run() result.InterpretResult {
 		case bytecode.OP_CONSTANT:
 			constant := readConstant()
 			vm.push(constant)
+		case bytecode.OP_CONSTANT_LONG:
+			constant := readConstantLong()
+			vm.push(constant)
 
 		case bytecode.OP_NIL:
 			vm.push(value.NilVal())
@@ -78,29 +215,22 @@ func (vm *VM) run() result.InterpretResult {
 			vm.push(value.BoolVal(vm.pop().IsFalsy()))
 
 		case bytecode.OP_ADD:
-			if vm.peek(0).IsString() && vm.peek(1).IsString() {
-				vm.concatenate()
-			} else if vm.peek(0).IsNumber() && vm.peek(1).IsNumber() {
-				b := vm.pop()
-				a := vm.pop()
-				vm.push(value.NumberVal(a.AsNumber() + b.AsNumber()))
-			} else {
-				b := vm.pop()
-				a := vm.pop()
-				vm.runtimeError("Cannot add %s (%s) and %s (%s). Both operands must be numbers or both must be strings.",
-					value.ValueTypeName(a), formatValue(a),
-					value.ValueTypeName(b), formatValue(b))
-				return result.INTERPRET_RUNTIME_ERROR
-			}
+			b := vm.pop()
+			a := vm.pop()
+			vm.add(a, b)
+
+		case bytecode.OP_ADD_CONSTANT:
+			b := readConstant()
+			a := vm.pop()
+			vm.add(a, b)
 
 		case bytecode.OP_SUBTRACT:
 			b := vm.pop()
 			a := vm.pop()
 			if !a.IsNumber() || !b.IsNumber() {
-				vm.runtimeError("Cannot subtract %s (%s) from %s (%s). Both operands must be numbers.",
+				vm.raise(ERROR_TYPE, "Cannot subtract %s (%s) from %s (%s). Both operands must be numbers.",
 					value.ValueTypeName(b), formatValue(b),
 					value.ValueTypeName(a), formatValue(a))
-				return result.INTERPRET_RUNTIME_ERROR
 			}
 			vm.push(value.NumberVal(a.AsNumber() - b.AsNumber()))
 
@@ -108,10 +238,9 @@ func (vm *VM) run() result.InterpretResult {
 			b := vm.pop()
 			a := vm.pop()
 			if !a.IsNumber() || !b.IsNumber() {
-				vm.runtimeError("Cannot multiply %s (%s) by %s (%s). Both operands must be numbers.",
+				vm.raise(ERROR_TYPE, "Cannot multiply %s (%s) by %s (%s). Both operands must be numbers.",
 					value.ValueTypeName(a), formatValue(a),
 					value.ValueTypeName(b), formatValue(b))
-				return result.INTERPRET_RUNTIME_ERROR
 			}
 			vm.push(value.NumberVal(a.AsNumber() * b.AsNumber()))
 
@@ -119,15 +248,13 @@ func (vm *VM) run() result.InterpretResult {
 			b := vm.pop()
 			a := vm.pop()
 			if !a.IsNumber() || !b.IsNumber() {
-				vm.runtimeError("Cannot divide %s (%s) by %s (%s). Both operands must be numbers.",
+				vm.raise(ERROR_TYPE, "Cannot divide %s (%s) by %s (%s). Both operands must be numbers.",
 					value.ValueTypeName(a), formatValue(a),
 					value.ValueTypeName(b), formatValue(b))
-				return result.INTERPRET_RUNTIME_ERROR
 			}
 
 			if b.AsNumber() == 0 {
-				vm.runtimeError("Cannot divide %g by zero. Division by zero is undefined.", a.AsNumber())
-				return result.INTERPRET_RUNTIME_ERROR
+				vm.raise(ERROR_ZERO_DIVISION, "Cannot divide %g by zero. Division by zero is undefined.", a.AsNumber())
 			}
 			vm.push(value.NumberVal(a.AsNumber() / b.AsNumber()))
 
@@ -135,15 +262,13 @@ func (vm *VM) run() result.InterpretResult {
 			b := vm.pop()
 			a := vm.pop()
 			if !a.IsNumber() || !b.IsNumber() {
-				vm.runtimeError("Cannot divide %s (%s) by %s (%s). Both operands must be numbers.",
+				vm.raise(ERROR_TYPE, "Cannot divide %s (%s) by %s (%s). Both operands must be numbers.",
 					value.ValueTypeName(a), formatValue(a),
 					value.ValueTypeName(b), formatValue(b))
-				return result.INTERPRET_RUNTIME_ERROR
 			}
 
 			if b.AsNumber() == 0 {
-				vm.runtimeError("Cannot modulo %g by zero. Division by zero is undefined.", a.AsNumber())
-				return result.INTERPRET_RUNTIME_ERROR
+				vm.raise(ERROR_ZERO_DIVISION, "Cannot modulo %g by zero. Division by zero is undefined.", a.AsNumber())
 			}
 		 vm.push(value.NumberVal(math.Mod(a.AsNumber(), b.AsNumber())))
 
@@ -152,52 +277,117 @@ func (vm *VM) run() result.InterpretResult {
 			a := vm.pop()
 			vm.push(value.BoolVal(value.ValuesEqual(a, b)))
 
+		case bytecode.OP_NOT_EQUAL:
+			b := vm.pop()
+			a := vm.pop()
+			vm.push(value.BoolVal(!value.ValuesEqual(a, b)))
+
 		case bytecode.OP_GREATER:
 			b := vm.pop()
 			a := vm.pop()
 			if !a.IsNumber() || !b.IsNumber() {
-				vm.runtimeError("Cannot compare %s (%s) > %s (%s). Comparison operators require numeric operands.",
+				vm.raise(ERROR_TYPE, "Cannot compare %s (%s) > %s (%s). Comparison operators require numeric operands.",
 					value.ValueTypeName(a), formatValue(a),
 					value.ValueTypeName(b), formatValue(b))
-				return result.INTERPRET_RUNTIME_ERROR
 			}
 			vm.push(value.BoolVal(a.AsNumber() > b.AsNumber()))
 
+		// a <= b compiles to !(a > b), so the fused form keeps that
+		// meaning (and its error message) for NaN operands.
+		case bytecode.OP_LESS_EQUAL:
+			b := vm.pop()
+			a := vm.pop()
+			if !a.IsNumber() || !b.IsNumber() {
+				vm.raise(ERROR_TYPE, "Cannot compare %s (%s) > %s (%s). Comparison operators require numeric operands.",
+					value.ValueTypeName(a), formatValue(a),
+					value.ValueTypeName(b), formatValue(b))
+			}
+			vm.push(value.BoolVal(!(a.AsNumber() > b.AsNumber())))
+
 		case bytecode.OP_LESS:
 			b := vm.pop()
 			a := vm.pop()
 			if !a.IsNumber() || !b.IsNumber() {
-				vm.runtimeError("Cannot compare %s (%s) < %s (%s). Comparison operators require numeric operands.",
+				vm.raise(ERROR_TYPE, "Cannot compare %s (%s) < %s (%s). Comparison operators require numeric operands.",
 					value.ValueTypeName(a), formatValue(a),
 					value.ValueTypeName(b), formatValue(b))
-				return result.INTERPRET_RUNTIME_ERROR
 			}
 			vm.push(value.BoolVal(a.AsNumber() < b.AsNumber()))
 
+		// a >= b compiles to !(a < b); see OP_LESS_EQUAL.
+		case bytecode.OP_GREATER_EQUAL:
+			b := vm.pop()
+			a := vm.pop()
+			if !a.IsNumber() || !b.IsNumber() {
+				vm.raise(ERROR_TYPE, "Cannot compare %s (%s) < %s (%s). Comparison operators require numeric operands.",
+					value.ValueTypeName(a), formatValue(a),
+					value.ValueTypeName(b), formatValue(b))
+			}
+			vm.push(value.BoolVal(!(a.AsNumber() < b.AsNumber())))
+
 		case bytecode.OP_NEGATE:
 			val := vm.pop()
 			if !val.IsNumber() {
-				vm.runtimeError("Cannot negate %s (%s). Unary '-' operator requires a numeric operand.",
+				vm.raise(ERROR_TYPE, "Cannot negate %s (%s). Unary '-' operator requires a numeric operand.",
 					value.ValueTypeName(val), formatValue(val))
-				return result.INTERPRET_RUNTIME_ERROR
 			}
 
 			vm.push(value.NumberVal(-val.AsNumber()))
 
+		case bytecode.OP_POP:
+			vm.pop()
+
+		case bytecode.OP_SWAP:
+			vm.Stack[vm.StackTop-1], vm.Stack[vm.StackTop-2] = vm.Stack[vm.StackTop-2], vm.Stack[vm.StackTop-1]
+
+		case bytecode.OP_GET_LOCAL:
+			slot := int(readByte())
+			vm.push(vm.Stack[vm.Frames[len(vm.Frames)-1].Base+slot])
+
+		case bytecode.OP_GET_PROPERTY:
+			name := readConstant().AsCString()
+			vm.push(vm.getProperty(vm.pop(), name))
+		case bytecode.OP_GET_PROPERTY_LONG:
+			name := readConstantLong().AsCString()
+			vm.push(vm.getProperty(vm.pop(), name))
+
+		case bytecode.OP_JUMP:
+			offset := readShort()
+			vm.Ip += offset
+
+		case bytecode.OP_JUMP_IF_FALSE:
+			offset := readShort()
+			if vm.peek(0).IsFalsy() {
+				vm.Ip += offset
+			}
+
+		case bytecode.OP_THROW:
+			vm.throw(vm.pop())
+
 		case bytecode.OP_RETURN:
-			value.PrintValue(vm.pop())
-			fmt.Println()
+			vm.result = vm.pop()
+			value.FprintValue(vm.Stdout, vm.result)
+			fmt.Fprintln(vm.Stdout)
 			return result.INTERPRET_OK
+
+		default:
+			vm.raise(ERROR_INTERNAL, "Unknown opcode %d.", instruction)
 		}
 	}
 }
 
 func (vm *VM) push(value value.Value) {
+	if vm.StackTop == len(vm.Stack) || vm.StackTop == vm.MaxStack {
+		vm.ensureStack(vm.StackTop + 1)
+	}
 	vm.Stack[vm.StackTop] = value
 	vm.StackTop++
 }
 
 func (vm *VM) pop() value.Value {
+	if vm.StackTop == 0 {
+		vm.raise(ERROR_INTERNAL, "Stack underflow.")
+	}
 	vm.StackTop--
 	return vm.Stack[vm.StackTop]
 }
@@ -206,28 +396,32 @@ func (vm *VM) peek(distance int) value.Value {
 	return vm.Stack[vm.StackTop-1-distance]
 }
 
-func (vm *VM) runtimeError(format string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, "Runtime Error: ")
-	fmt.Fprintf(os.Stderr, format, args...)
-	fmt.Fprintln(os.Stderr)
+// add pushes a + b, raising a type error when the operands are neither
+// both numbers nor both strings.
+func (vm *VM) add(a, b value.Value) {
+	if a.IsString() && b.IsString() {
+		vm.concatenate(a.AsString(), b.AsString())
+		return
+	}
 
-	instruction := vm.Ip - 1
-	line := debug.GetLine(vm.Bytecode, instruction)
-	fmt.Fprintf(os.Stderr, "    [line %d] in script\n", line)
+	if a.IsNumber() && b.IsNumber() {
+		vm.push(value.NumberVal(a.AsNumber() + b.AsNumber()))
+		return
+	}
 
-	vm.resetStack()
+	vm.raise(ERROR_TYPE, "Cannot add %s (%s) and %s (%s). Both operands must be numbers or both must be strings.",
+		value.ValueTypeName(a), formatValue(a),
+		value.ValueTypeName(b), formatValue(b))
 }
 
-func (vm *VM) concatenate() {
-	b := vm.pop().AsString()
-	a := vm.pop().AsString()
-
+func (vm *VM) concatenate(a, b *value.ObjString) {
+	vm.chargeString(len(a.Chars) + len(b.Chars))
 	str := value.NewString(a.Chars + b.Chars)
 	vm.push(value.ObjVal(str.AsObj()))
 }
 
 func formatValue(v value.Value) string {
-	switch v.Type {
+	switch v.Type() {
 	case value.VAL_BOOL:
 		if v.AsBool() {
 			return "true"
@@ -241,6 +435,9 @@ func formatValue(v value.Value) string {
 		if v.IsString() {
 			return fmt.Sprintf("\"%s\"", v.AsCString())
 		}
+		if v.IsError() {
+			return v.AsError().Kind
+		}
 		return "object"
 	default:
 		return "unknown"
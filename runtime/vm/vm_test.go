@@ -0,0 +1,411 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/caelondev/hydor/frontend/bytecode"
+	"github.com/caelondev/hydor/frontend/compiler"
+	"github.com/caelondev/hydor/frontend/optimizer"
+	"github.com/caelondev/hydor/result"
+)
+
+func compile(t testing.TB, source string, level optimizer.Level) *bytecode.Bytecode {
+	t.Helper()
+	var errors strings.Builder
+	chunk, ok := compiler.Compile(source, compiler.Options{Optimize: level, Errors: &errors})
+	if !ok {
+		t.Fatalf("%q does not compile: %s", source, errors.String())
+	}
+	return chunk
+}
+
+// run interprets source on machine and returns what it printed.
+func run(t *testing.T, machine *VM, source string, level optimizer.Level) (result.InterpretResult, string, string) {
+	t.Helper()
+	var stdout, stderr strings.Builder
+	machine.Stdout = &stdout
+	machine.Stderr = &stderr
+	res := machine.Interpret(compile(t, source, level))
+	return res, stdout.String(), stderr.String()
+}
+
+func TestInterpret(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"1 + 2 * 3", "7"},
+		{"(1*(46+(8-29)))/3", "8.333333333333334"},
+		{"7 % 3 - -1", "2"},
+		{`"con" + "cat"`, "concat"},
+		{"!nil == true", "true"},
+		{"1 < 2 == 2 >= 2", "true"},
+		{`"a" == "a" != false`, "true"},
+		{"try { 1 } catch (e) { 2 }", "1"},
+		{`try { throw "x" } catch (e) { e.message + "!" }`, "x!"},
+		{"try { 1 / 0 } catch (e) { e.kind }", "ZeroDivisionError"},
+		{`try { -"a" } catch (e) { e.kind }`, "TypeError"},
+		{"try { throw 1 } catch (e) { e.nope } ", ""},
+		{"try { 1 } finally { throw 2 }", ""},
+		{"try { try { throw 1 } finally { 2 } } catch (e) { e.message }", "1"},
+		{"1 + try { throw 2 } catch (a) { try { throw 3 } catch (b) { a.message + b.message } }", ""},
+		{`1 + try { throw 2 } catch (a) { 10 } + try { 3 } catch (b) { b }`, "14"},
+	}
+
+	for _, level := range []optimizer.Level{optimizer.O0, optimizer.O1} {
+		for _, tt := range tests {
+			res, stdout, _ := run(t, NewVM(), tt.source, level)
+			if tt.want == "" {
+				if res != result.INTERPRET_RUNTIME_ERROR {
+					t.Errorf("-O%d %q: result %d, want a runtime error", level, tt.source, res)
+				}
+				continue
+			}
+			if res != result.INTERPRET_OK || stdout != tt.want+"\n" {
+				t.Errorf("-O%d %q: result %d printing %q, want %q", level, tt.source, res, stdout, tt.want)
+			}
+		}
+	}
+}
+
+// TestLongPropertyOperand reads a property whose name lands past the first
+// 256 constants, where it needs a 24-bit operand.
+func TestLongPropertyOperand(t *testing.T) {
+	var source strings.Builder
+	source.WriteString("try { 0")
+	for i := 1; i < 300; i++ {
+		fmt.Fprintf(&source, " + %d", i)
+	}
+	source.WriteString(` + throw "deep" } catch (e) { e.message }`)
+
+	chunk := compile(t, source.String(), optimizer.O0)
+	long := false
+	for offset := 0; offset < len(chunk.Code); {
+		op := bytecode.OpCode(chunk.Code[offset])
+		long = long || op == bytecode.OP_GET_PROPERTY_LONG
+		offset += 1 + bytecode.OperandWidth(op)
+	}
+	if !long {
+		t.Fatal("no OP_GET_PROPERTY_LONG emitted")
+	}
+	machine := NewVM()
+	var stdout strings.Builder
+	machine.Stdout = &stdout
+	if res := machine.Interpret(chunk); res != result.INTERPRET_OK || stdout.String() != "deep\n" {
+		t.Errorf("result %d printing %q, want deep", res, stdout.String())
+	}
+}
+
+func TestLongConstantOperand(t *testing.T) {
+	// Starting from the caught message keeps every sum a runtime one, so
+	// -O1 cannot fold the 300 strings back into a single constant.
+	var source, want strings.Builder
+	source.WriteString(`try { throw "x" } catch (e) { e.message`)
+	want.WriteString("x")
+	for i := 0; i < 300; i++ {
+		fmt.Fprintf(&source, ` + "%d"`, i)
+		fmt.Fprintf(&want, "%d", i)
+	}
+	source.WriteString(" }")
+	want.WriteString("\n")
+
+	for _, level := range []optimizer.Level{optimizer.O0, optimizer.O1} {
+		chunk := compile(t, source.String(), level)
+		long := false
+		for offset := 0; offset < len(chunk.Code); {
+			op := bytecode.OpCode(chunk.Code[offset])
+			long = long || op == bytecode.OP_CONSTANT_LONG
+			offset += 1 + bytecode.OperandWidth(op)
+		}
+		if !long {
+			t.Errorf("-O%d: no OP_CONSTANT_LONG emitted", level)
+		}
+		machine := NewVM()
+		var stdout strings.Builder
+		machine.Stdout = &stdout
+		if res := machine.Interpret(chunk); res != result.INTERPRET_OK || stdout.String() != want.String() {
+			t.Errorf("-O%d: result %d printing %q", level, res, stdout.String())
+		}
+	}
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	tests := []struct {
+		source  string
+		kind    string
+		message string
+		line    int
+	}{
+		{"1 +\n\"x\"", ERROR_TYPE, `Cannot add number (1) and string ("x"). Both operands must be numbers or both must be strings.`, 2},
+		{"\n\n4 % 0", ERROR_ZERO_DIVISION, "Cannot modulo 4 by zero. Division by zero is undefined.", 3},
+		{`throw "boom"`, ERROR_THROWN, "boom", 1},
+		{"try { throw 1 }\ncatch (e) {\n  e.size }", ERROR_PROPERTY, "Undefined property 'size'. Errors have 'message', 'kind' and 'trace'.", 3},
+		{"try { 1 / 0 } catch (e) { throw e }", ERROR_ZERO_DIVISION, "Cannot divide 1 by zero. Division by zero is undefined.", 1},
+	}
+
+	for _, tt := range tests {
+		machine := NewVM()
+		res, _, stderr := run(t, machine, tt.source, optimizer.O1)
+		if res != result.INTERPRET_RUNTIME_ERROR {
+			t.Errorf("%q: result %d, want a runtime error", tt.source, res)
+			continue
+		}
+		err := machine.Err()
+		if err == nil || err.Kind != tt.kind || err.Message != tt.message {
+			t.Errorf("%q: error %+v, want %s %q", tt.source, err, tt.kind, tt.message)
+			continue
+		}
+		if len(err.Trace) != 1 || err.Trace[0].Line != tt.line || err.Trace[0].Function != SCRIPT_NAME {
+			t.Errorf("%q: trace %+v, want one frame on line %d", tt.source, err.Trace, tt.line)
+		}
+		if !strings.Contains(stderr, tt.message) {
+			t.Errorf("%q: stderr %q does not report the error", tt.source, stderr)
+		}
+	}
+}
+
+func TestInstructionBudget(t *testing.T) {
+	machine := NewVM()
+	machine.MaxInstructions = 3
+	res, _, stderr := run(t, machine, "1 + 2 + 3", optimizer.O0)
+	if res != result.INTERPRET_ABORTED {
+		t.Fatalf("result %d, want aborted", res)
+	}
+	if err := machine.Err(); err == nil || !err.Aborted {
+		t.Errorf("Err() = %+v, want an aborted run", err)
+	}
+	if machine.Executed() != 3 {
+		t.Errorf("executed %d instructions, want exactly 3", machine.Executed())
+	}
+	if !strings.Contains(stderr, "Instruction budget of 3 exhausted.") {
+		t.Errorf("stderr %q does not explain the abort", stderr)
+	}
+
+	machine.MaxInstructions = 6
+	if res, stdout, _ := run(t, machine, "1 + 2 + 3", optimizer.O0); res != result.INTERPRET_OK || stdout != "6\n" {
+		t.Errorf("with enough budget: result %d printing %q", res, stdout)
+	}
+}
+
+func TestCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	machine := NewVM()
+	machine.Stdout = io.Discard
+	machine.Stderr = io.Discard
+	if res := machine.InterpretContext(ctx, compile(t, "1", optimizer.O1)); res != result.INTERPRET_ABORTED {
+		t.Errorf("result %d, want aborted", res)
+	}
+	if err := machine.Err(); err == nil || err.Message != "Execution cancelled." {
+		t.Errorf("Err() = %+v, want a cancellation", err)
+	}
+}
+
+func TestHeapLimit(t *testing.T) {
+	// heapNeeded is what source allocates when nothing stops it, constant
+	// pool included.
+	heapNeeded := func(source string, level optimizer.Level) int64 {
+		machine := NewVM()
+		if res, _, _ := run(t, machine, source, level); res != result.INTERPRET_OK {
+			t.Fatalf("%q: result %d without a limit", source, res)
+		}
+		return machine.HeapAllocated()
+	}
+
+	// One byte short leaves room for the literals but not for the
+	// concatenation, which raises a catchable memory error.
+	source := `try { "a" + "b" } catch (e) { 0 }`
+	machine := NewVM()
+	machine.MaxHeap = heapNeeded(source, optimizer.O0) - 1
+	if res, stdout, _ := run(t, machine, source, optimizer.O0); res != result.INTERPRET_OK || stdout != "0\n" {
+		t.Errorf("result %d printing %q, want the memory error caught", res, stdout)
+	}
+	// Reading a property builds a string, which is charged too.
+	source = `try { "a" + "b" } catch (e) { e.kind }`
+	machine.MaxHeap = heapNeeded(source, optimizer.O0) - 1
+	res, _, _ := run(t, machine, source, optimizer.O0)
+	if res != result.INTERPRET_RUNTIME_ERROR || machine.Err().Kind != ERROR_MEMORY {
+		t.Errorf("result %d, error %+v, want an uncaught %s", res, machine.Err(), ERROR_MEMORY)
+	}
+
+	// Folding builds the string at compile time, so it is charged when the
+	// program starts instead.
+	machine.MaxHeap = heapNeeded(`"ab"`, optimizer.O1) - 1
+	res, _, _ = run(t, machine, `"a" + "b"`, optimizer.O1)
+	if res != result.INTERPRET_RUNTIME_ERROR || machine.Err().Kind != ERROR_MEMORY {
+		t.Errorf("folded: result %d, error %+v, want %s", res, machine.Err(), ERROR_MEMORY)
+	}
+
+	machine.MaxHeap = 0
+	if res, stdout, _ := run(t, machine, `"a" + "b"`, optimizer.O0); res != result.INTERPRET_OK || stdout != "ab\n" {
+		t.Errorf("without a limit: result %d printing %q", res, stdout)
+	}
+}
+
+func TestStackLimit(t *testing.T) {
+	// The budget is far below STACK_INITIAL, so the stack NewVM allocates
+	// already has room and only the limit can stop the run.
+	machine := NewVM()
+	machine.MaxStack = 2
+	res, _, _ := run(t, machine, "1 + (2 + (3 + 4))", optimizer.O0)
+	if res != result.INTERPRET_RUNTIME_ERROR || machine.Err().Kind != ERROR_STACK_OVERFLOW {
+		t.Errorf("result %d, error %+v, want a stack overflow", res, machine.Err())
+	}
+
+	machine.MaxStack = 4
+	if res, stdout, _ := run(t, machine, "1 + (2 + (3 + 4))", optimizer.O0); res != result.INTERPRET_OK || stdout != "10\n" {
+		t.Errorf("with enough stack: result %d printing %q", res, stdout)
+	}
+}
+
+func TestInvalidBytecode(t *testing.T) {
+	chunk := bytecode.NewBytecode("")
+	chunk.Write(byte(bytecode.OP_ADD), 1)
+	chunk.Write(byte(bytecode.OP_RETURN), 1)
+
+	machine := NewVM()
+	machine.Stderr = io.Discard
+	if res := machine.Interpret(chunk); res != result.INTERPRET_INVALID_BYTECODE {
+		t.Errorf("result %d, want invalid bytecode", res)
+	}
+}
+
+func TestReuse(t *testing.T) {
+	machine := NewVM()
+	if res, _, _ := run(t, machine, "throw 1", optimizer.O1); res != result.INTERPRET_RUNTIME_ERROR {
+		t.Fatalf("first run: result %d", res)
+	}
+	res, stdout, _ := run(t, machine, "try { 2 } catch (e) { e }", optimizer.O1)
+	if res != result.INTERPRET_OK || stdout != "2\n" || machine.Err() != nil {
+		t.Errorf("second run: result %d printing %q, error %v", res, stdout, machine.Err())
+	}
+	if machine.Result().AsNumber() != 2 {
+		t.Errorf("Result() = %v, want 2", machine.Result())
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	chunk := compile(t, "try { 1 } catch (e) { 2 }", optimizer.O0)
+	cov := NewCoverage()
+	for i := 0; i < 2; i++ {
+		machine := NewVM()
+		machine.Stdout = io.Discard
+		machine.Coverage = cov
+		machine.Interpret(chunk)
+	}
+
+	if chunks := cov.Chunks(); len(chunks) != 1 || chunks[0] != chunk {
+		t.Fatalf("chunks = %v, want the one that ran", chunks)
+	}
+	counts := cov.Counts(chunk)
+	for offset := 0; offset < len(chunk.Code); {
+		op := bytecode.OpCode(chunk.Code[offset])
+		// The handler runs from its target up to the final return, and
+		// nothing throws.
+		want := int64(2)
+		if offset >= chunk.Handlers[0].Target && op != bytecode.OP_RETURN {
+			want = 0
+		}
+		if counts[offset] != want {
+			t.Errorf("%s at %d ran %d times, want %d", op, offset, counts[offset], want)
+		}
+		offset += 1 + bytecode.OperandWidth(op)
+	}
+	if cov.Counts(compile(t, "1", optimizer.O0)) != nil {
+		t.Error("a chunk that never ran has counts")
+	}
+}
+
+// TestConcurrentVMs shares one Program between many VMs while other
+// goroutines compile. Run it with -race to check for shared state.
+func TestConcurrentVMs(t *testing.T) {
+	program, err := NewProgram(compile(t, `try { 1 / 0 } catch (e) { e.kind + "!" }`, optimizer.O1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const workers = 8
+	const runs = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*runs)
+	for w := 0; w < workers; w++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			machine := NewVM()
+			var out strings.Builder
+			machine.Stdout = &out
+			for i := 0; i < runs; i++ {
+				out.Reset()
+				if res := machine.Run(context.Background(), program); res != result.INTERPRET_OK || out.String() != "ZeroDivisionError!\n" {
+					errs <- fmt.Errorf("shared program: result %d printing %q", res, out.String())
+				}
+			}
+		}()
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < runs; i++ {
+				source := fmt.Sprintf("%d + %d", w, i)
+				chunk, ok := compiler.Compile(source, compiler.Options{Optimize: optimizer.O0, Errors: io.Discard})
+				if !ok {
+					errs <- fmt.Errorf("%q does not compile", source)
+					continue
+				}
+				machine := NewVM()
+				var out strings.Builder
+				machine.Stdout = &out
+				if res := machine.Interpret(chunk); res != result.INTERPRET_OK || out.String() != fmt.Sprintf("%d\n", w+i) {
+					errs <- fmt.Errorf("%q: result %d printing %q", source, res, out.String())
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+var sink *VM
+
+func BenchmarkNewVM(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sink = NewVM()
+	}
+}
+
+func benchmarkRun(b *testing.B, source string) {
+	program, err := NewProgram(compile(b, source, optimizer.O0))
+	if err != nil {
+		b.Fatal(err)
+	}
+	machine := NewVM()
+	machine.Stdout = io.Discard
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if res := machine.Run(context.Background(), program); res != result.INTERPRET_OK {
+			b.Fatalf("result %d", res)
+		}
+	}
+}
+
+func BenchmarkArithmetic(b *testing.B) {
+	benchmarkRun(b, strings.Repeat("(1 + 2 * 3 - 4 / 5) + ", 100)+"0")
+}
+
+func BenchmarkStrings(b *testing.B) {
+	benchmarkRun(b, strings.Repeat(`"ab" + `, 100)+`""`)
+}
+
+func BenchmarkTryCatch(b *testing.B) {
+	benchmarkRun(b, strings.Repeat("try { 1 / 0 } catch (e) { 1 } + ", 100)+"0")
+}